@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Version of nuttyqt, set at build time with "-ldflags '-X main.Version=<version>'".
+var Version = "dev"
+
+// Usage of the nuttyqt command line, printed for "help" or unknown commands.
+const usage = `Usage: nuttyqt [command] [flags]
+
+Commands:
+  run              Relay the UPS devices of the NUT servers to the MQTT broker (default)
+  fakenut          Start only the fake NUT server
+  list [ups [var]] Print the UPS devices of the NUT servers and their variables, like upsc
+  validate-config  Check the configuration and exit
+  version          Print the version and exit
+
+Run "nuttyqt <command> -h" for the flags of a command.
+Flags take precedence over environment variables, which take precedence over the config file.
+`
+
+// configFlag is a command line flag for a configuration setting.
+// Its value is only applied after the config file and environment variables have been loaded, so it takes precedence over them.
+type configFlag struct {
+	value  string
+	isSet  bool
+	isBool bool
+	apply  func(cfg *Config, value string) error
+}
+
+func (f *configFlag) String() string {
+	return f.value
+}
+
+func (f *configFlag) Set(value string) error {
+	f.value, f.isSet = value, true
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// ConfigFlags are the command line flags for every configuration setting.
+type ConfigFlags struct {
+	// Path to the config file.
+	ConfigPath string
+
+	flags map[string]*configFlag
+}
+
+// Get the first NUT server of a configuration, which the NUT flags apply to, adding it if the config file has no servers.
+func firstNUTServer(cfg *Config) *NUTServerConfig {
+	if len(cfg.NUTServers) == 0 {
+		cfg.NUTServers = append(cfg.NUTServers, withNUTServerDefaults(NUTServerConfig{}))
+	}
+	return &cfg.NUTServers[0]
+}
+
+// Add the flags for every configuration setting to a flag set, with the current configuration as their defaults.
+func NewConfigFlags(flagSet *flag.FlagSet) *ConfigFlags {
+	configFlags := &ConfigFlags{flags: map[string]*configFlag{}}
+	defaults := *CurrentConfig()
+	flagSet.StringVar(&configFlags.ConfigPath, "config", "", "path to a YAML config file (NUTTYQT_CONFIG)")
+
+	add := func(name string, env string, usage string, defaultValue string, isBool bool, apply func(cfg *Config, value string) error) {
+		f := &configFlag{value: defaultValue, isBool: isBool, apply: apply}
+		configFlags.flags[name] = f
+		flagSet.Var(f, name, fmt.Sprintf("%s (%s)", usage, env))
+	}
+	addString := func(name string, env string, usage string, target func(cfg *Config) *string) {
+		add(name, env, usage, *target(&defaults), false, func(cfg *Config, value string) error {
+			*target(cfg) = value
+			return nil
+		})
+	}
+	addInt := func(name string, env string, usage string, target func(cfg *Config) *int) {
+		add(name, env, usage, strconv.Itoa(*target(&defaults)), false, func(cfg *Config, value string) error {
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a whole number", value)
+			}
+			*target(cfg) = number
+			return nil
+		})
+	}
+	addFloat := func(name string, env string, usage string, target func(cfg *Config) *float64) {
+		add(name, env, usage, strconv.FormatFloat(*target(&defaults), 'g', -1, 64), false, func(cfg *Config, value string) error {
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return fmt.Errorf("%q is not a number", value)
+			}
+			*target(cfg) = number
+			return nil
+		})
+	}
+	addBool := func(name string, env string, usage string, target func(cfg *Config) *bool) {
+		add(name, env, usage, strconv.FormatBool(*target(&defaults)), true, func(cfg *Config, value string) error {
+			boolean, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("%q is not a boolean, use true or false", value)
+			}
+			*target(cfg) = boolean
+			return nil
+		})
+	}
+	addList := func(name string, env string, usage string, target func(cfg *Config) *[]string) {
+		add(name, env, usage, strings.Join(*target(&defaults), ","), false, func(cfg *Config, value string) error {
+			*target(cfg) = ParseList(value)
+			return nil
+		})
+	}
+	addMap := func(name string, env string, usage string, target func(cfg *Config) *map[string][]string) {
+		add(name, env, usage, "", false, func(cfg *Config, value string) error {
+			*target(cfg) = ParseMap(value)
+			return nil
+		})
+	}
+
+	// MQTT
+	addString("mqtt-protocol", "MQTT_BROKER_PROTOCOL", "MQTT broker protocol", func(cfg *Config) *string { return &cfg.MQTTBrokerProtocol })
+	addString("mqtt-host", "MQTT_BROKER_HOST", "MQTT broker host", func(cfg *Config) *string { return &cfg.MQTTBrokerHost })
+	addInt("mqtt-port", "MQTT_BROKER_PORT", "MQTT broker port", func(cfg *Config) *int { return &cfg.MQTTBrokerPort })
+	addString("mqtt-client", "MQTT_CLIENT", "MQTT client ID", func(cfg *Config) *string { return &cfg.MQTTClient })
+	addString("mqtt-topic", "MQTT_TOPIC", "MQTT base topic", func(cfg *Config) *string { return &cfg.MQTTTopic })
+	addString("mqtt-user", "MQTT_USER", "MQTT username", func(cfg *Config) *string { return &cfg.MQTTUser })
+	addString("mqtt-pass", "MQTT_PASS", "MQTT password", func(cfg *Config) *string { return &cfg.MQTTPass })
+	addString("mqtt-tls-ca", "MQTT_TLS_CA", "CA bundle to verify the MQTT broker with", func(cfg *Config) *string { return &cfg.MQTTTLSCA })
+	addString("mqtt-tls-cert", "MQTT_TLS_CERT", "client certificate for mutual TLS with the MQTT broker", func(cfg *Config) *string { return &cfg.MQTTTLSCert })
+	addString("mqtt-tls-key", "MQTT_TLS_KEY", "key of the client certificate", func(cfg *Config) *string { return &cfg.MQTTTLSKey })
+	addString("mqtt-tls-server-name", "MQTT_TLS_SERVER_NAME", "name to verify the certificate of the MQTT broker for", func(cfg *Config) *string { return &cfg.MQTTTLSServerName })
+	addString("mqtt-tls-min-version", "MQTT_TLS_MIN_VERSION", "minimum TLS version of the MQTT connection, either 1.0, 1.1, 1.2 or 1.3", func(cfg *Config) *string { return &cfg.MQTTTLSMinVersion })
+	addBool("mqtt-tls-insecure", "MQTT_TLS_INSECURE", "skip verifying the certificate of the MQTT broker", func(cfg *Config) *bool { return &cfg.MQTTTLSInsecure })
+	addString("mqtt-publish-mode", "MQTT_PUBLISH_MODE", "how UPS devices are published, either json, variables or both", func(cfg *Config) *string { return &cfg.MQTTPublishMode })
+
+	// Home Assistant
+	addBool("ha-discovery", "HA_DISCOVERY", "publish Home Assistant MQTT discovery configs", func(cfg *Config) *bool { return &cfg.HADiscovery })
+	addString("ha-discovery-prefix", "HA_DISCOVERY_PREFIX", "Home Assistant MQTT discovery topic prefix", func(cfg *Config) *string { return &cfg.HADiscoveryPrefix })
+
+	// NUT, where the server flags apply to the first NUT server.
+	addString("nut-name", "NUT_NAME", "NUT server name", func(cfg *Config) *string { return &firstNUTServer(cfg).Name })
+	addString("nut-server", "NUT_SERVER", "NUT server host", func(cfg *Config) *string { return &firstNUTServer(cfg).Host })
+	addInt("nut-port", "NUT_PORT", "NUT server port", func(cfg *Config) *int { return &firstNUTServer(cfg).Port })
+	addString("nut-user", "NUT_USER", "NUT username", func(cfg *Config) *string { return &firstNUTServer(cfg).User })
+	addString("nut-pass", "NUT_PASS", "NUT password", func(cfg *Config) *string { return &firstNUTServer(cfg).Pass })
+	addBool("nut-starttls", "NUT_STARTTLS", "negotiate TLS with STARTTLS before authenticating", func(cfg *Config) *bool { return &firstNUTServer(cfg).StartTLS })
+	addString("nut-tls-ca", "NUT_TLS_CA", "CA bundle to verify the NUT server with", func(cfg *Config) *string { return &firstNUTServer(cfg).TLSCA })
+	addString("nut-tls-fingerprint", "NUT_TLS_FINGERPRINT", "SHA-256 fingerprint of the certificate of the NUT server to pin", func(cfg *Config) *string { return &firstNUTServer(cfg).TLSFingerprint })
+	addString("nut-tls-server-name", "NUT_TLS_SERVER_NAME", "name to verify the certificate of the NUT server for", func(cfg *Config) *string { return &firstNUTServer(cfg).TLSServerName })
+	addBool("nut-allow-cleartext-auth", "NUT_ALLOW_CLEARTEXT_AUTH", "send the NUT credentials without STARTTLS", func(cfg *Config) *bool { return &firstNUTServer(cfg).AllowCleartextAuth })
+	addString("nut-topic-prefix", "NUT_TOPIC_PREFIX", "MQTT topic prefix for the UPS devices of the NUT server", func(cfg *Config) *string { return &firstNUTServer(cfg).TopicPrefix })
+	addString("nut-topic-template", "NUT_TOPIC_TEMPLATE", "Go template for the MQTT topics of the UPS devices of the NUT server", func(cfg *Config) *string { return &firstNUTServer(cfg).TopicTemplate })
+	addList("nut-ups-include", "NUT_UPS_INCLUDE", "comma separated list of UPS names to monitor", func(cfg *Config) *[]string { return &firstNUTServer(cfg).UPSInclude })
+	addList("nut-ups-exclude", "NUT_UPS_EXCLUDE", "comma separated list of UPS names to skip", func(cfg *Config) *[]string { return &firstNUTServer(cfg).UPSExclude })
+	addMap("nut-commands", "NUT_COMMANDS", "instant commands that may be run over MQTT, eg. ups:cmd,cmd;*:cmd", func(cfg *Config) *map[string][]string { return &firstNUTServer(cfg).UPSCommands })
+	addMap("nut-variables", "NUT_VARIABLES", "variables that may be written over MQTT, eg. ups:var,var;*:var", func(cfg *Config) *map[string][]string { return &firstNUTServer(cfg).UPSVariables })
+	addInt("nut-reconnect-min-delay", "NUT_RECONNECT_MIN_DELAY", "minimum delay in seconds before reconnecting to a NUT server", func(cfg *Config) *int { return &cfg.NUTReconnectMinDelay })
+	addInt("nut-reconnect-max-delay", "NUT_RECONNECT_MAX_DELAY", "maximum delay in seconds before reconnecting to a NUT server", func(cfg *Config) *int { return &cfg.NUTReconnectMaxDelay })
+	addBool("nut-fake", "NUT_FAKE", "start the built-in fake NUT server", func(cfg *Config) *bool { return &cfg.NUTFake })
+	addFloat("nut-fake-rate", "NUT_FAKE_RATE", "simulated seconds per second of the fake NUT server", func(cfg *Config) *float64 { return &cfg.NUTFakeRate })
+	addString("nut-fake-scenario", "NUT_FAKE_SCENARIO", "scenario file that the fake NUT server plays", func(cfg *Config) *string { return &cfg.NUTFakeScenario })
+	addString("nut-fake-dumps", "NUT_FAKE_DUMPS", "directory of upsc dumps that the fake NUT server serves", func(cfg *Config) *string { return &cfg.NUTFakeDumps })
+
+	// InfluxDB
+	addString("influxdb-url", "INFLUXDB_URL", "InfluxDB URL to write the UPS devices to, eg. http://localhost:8086 or udp://localhost:8089", func(cfg *Config) *string { return &cfg.InfluxDBURL })
+	addString("influxdb-database", "INFLUXDB_DATABASE", "InfluxDB 1.x database", func(cfg *Config) *string { return &cfg.InfluxDBDatabase })
+	addString("influxdb-user", "INFLUXDB_USER", "InfluxDB 1.x username", func(cfg *Config) *string { return &cfg.InfluxDBUser })
+	addString("influxdb-pass", "INFLUXDB_PASS", "InfluxDB 1.x password", func(cfg *Config) *string { return &cfg.InfluxDBPass })
+	addString("influxdb-org", "INFLUXDB_ORG", "InfluxDB 2.x organization", func(cfg *Config) *string { return &cfg.InfluxDBOrg })
+	addString("influxdb-bucket", "INFLUXDB_BUCKET", "InfluxDB 2.x bucket", func(cfg *Config) *string { return &cfg.InfluxDBBucket })
+	addString("influxdb-token", "INFLUXDB_TOKEN", "InfluxDB 2.x API token", func(cfg *Config) *string { return &cfg.InfluxDBToken })
+	addString("influxdb-measurement", "INFLUXDB_MEASUREMENT", "InfluxDB measurement of the UPS devices", func(cfg *Config) *string { return &cfg.InfluxDBMeasurement })
+	addInt("influxdb-batch-size", "INFLUXDB_BATCH_SIZE", "maximum number of lines per write to InfluxDB", func(cfg *Config) *int { return &cfg.InfluxDBBatchSize })
+	addInt("influxdb-buffer-size", "INFLUXDB_BUFFER_SIZE", "maximum number of lines to keep while InfluxDB is unreachable", func(cfg *Config) *int { return &cfg.InfluxDBBufferSize })
+
+	// Metrics
+	addString("metrics-listen", "METRICS_LISTEN", "address to serve the Prometheus metrics on, eg. :9199", func(cfg *Config) *string { return &cfg.MetricsListen })
+
+	// Other
+	addInt("update-interval", "UPDATE_INTERVAL", "update interval in seconds", func(cfg *Config) *int { return &cfg.UpdateInterval })
+	addBool("verbose", "VERBOSE", "verbose logging", func(cfg *Config) *bool { return &cfg.Verbose })
+
+	return configFlags
+}
+
+// configFlagAlias is a flag of a command for a configuration setting, with another name and usage than the flag of the setting.
+type configFlagAlias struct {
+	name    string
+	setting string
+	usage   string
+}
+
+// Add the flags of some configuration settings to a flag set, under other names, eg. "host" for "nut-server".
+func NewConfigFlagAliases(flagSet *flag.FlagSet, aliases []configFlagAlias) *ConfigFlags {
+	settings := NewConfigFlags(flag.NewFlagSet("", flag.ContinueOnError))
+	configFlags := &ConfigFlags{flags: map[string]*configFlag{}}
+	flagSet.StringVar(&configFlags.ConfigPath, "config", "", "path to a YAML config file (NUTTYQT_CONFIG)")
+	for _, alias := range aliases {
+		f := settings.flags[alias.setting]
+		configFlags.flags[alias.name] = f
+		flagSet.Var(f, alias.name, alias.usage)
+	}
+	return configFlags
+}
+
+// Apply the flags that were set on the command line to a configuration.
+func (configFlags *ConfigFlags) Apply(cfg *Config, errs *ConfigErrors) {
+	if configFlags == nil {
+		return
+	}
+	for name, f := range configFlags.flags {
+		if !f.isSet {
+			continue
+		}
+		if err := f.apply(cfg, f.value); err != nil {
+			errs.Addf("--"+name, "%s", err)
+		}
+	}
+}
+
+// Create the flag set of a command, which exits on -h.
+func newFlagSet(command string) *flag.FlagSet {
+	flagSet := flag.NewFlagSet(command, flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage of nuttyqt %s:\n", command)
+		flagSet.PrintDefaults()
+	}
+	return flagSet
+}
+
+// Parse the flags of a command and load the configuration, exiting with every problem if it's invalid.
+func parseConfigFlags(command string, args []string) (*flag.FlagSet, *ConfigFlags) {
+	flagSet := newFlagSet(command)
+	configFlags := NewConfigFlags(flagSet)
+	_ = flagSet.Parse(args)
+	loadConfigFlags(configFlags)
+	return flagSet, configFlags
+}
+
+// Load the configuration with the flags of a command, exiting with every problem if it's invalid.
+func loadConfigFlags(configFlags *ConfigFlags) {
+	cfg, err := LoadConfig(configFlags.ConfigPath, configFlags)
+	if err != nil {
+		var configErrs ConfigErrors
+		if errors.As(err, &configErrs) {
+			for _, configErr := range configErrs {
+				log.Error(configErr)
+			}
+			log.Fatal("Invalid configuration, exiting ...")
+		}
+		log.Fatal(err)
+	}
+	SetConfig(cfg)
+}
+
+// Run a command of the command line, eg. "run" or "list".
+func RunCommand(args []string) {
+	command := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "run":
+		_, configFlags := parseConfigFlags(command, args)
+		Run(configFlags)
+	case "fakenut":
+		FakeNUTCommand(args)
+	case "list":
+		ListCommand(args)
+	case "validate-config":
+		ValidateConfigCommand(args)
+	case "version":
+		fmt.Println(VersionString())
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+}
+
+// Get the version of nuttyqt, with the VCS revision and Go version it was built with.
+func VersionString() string {
+	revision := ""
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" && len(setting.Value) >= 7 {
+				revision = setting.Value[:7] + ", "
+			}
+		}
+	}
+	return fmt.Sprintf("nuttyqt %s (%s%s, %s/%s)", Version, revision, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// Start only the fake NUT server, and wait for SIGINT or SIGTERM.
+// Its settings come from the configuration, like with NUT_FAKE=true, which its flags override.
+func FakeNUTCommand(args []string) {
+	flagSet := newFlagSet("fakenut")
+	configFlags := NewConfigFlagAliases(flagSet, []configFlagAlias{
+		{"host", "nut-server", "host to listen on (NUT_SERVER)"},
+		{"port", "nut-port", "port to listen on (NUT_PORT)"},
+		{"rate", "nut-fake-rate", "simulated seconds per second, eg. 60 to play out a 30-minute power outage in 30 seconds (NUT_FAKE_RATE)"},
+		{"dumps", "nut-fake-dumps", "directory of upsc dumps to serve a device of each, named after the file, instead of FakeUPS (NUT_FAKE_DUMPS)"},
+		{"scenario", "nut-fake-scenario", "scenario file (YAML or JSON) that the devices play (NUT_FAKE_SCENARIO)"},
+		{"verbose", "verbose", "log every command the fake NUT server receives (VERBOSE)"},
+	})
+	_ = flagSet.Parse(args)
+	loadConfigFlags(configFlags)
+	config := CurrentConfig()
+	fakeNUTServer, err := NewFakeNUTServerFromConfig(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Out = os.Stdout
+	if config.Verbose {
+		log.SetLevel(logrus.DebugLevel)
+	}
+	go func() {
+		if err := fakeNUTServer.Start(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	shutdown := make(chan os.Signal, 1)
+	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
+	<-shutdown
+	_ = fakeNUTServer.Stop()
+}
+
+// Print the UPS devices of the NUT servers and their variables, like upsc.
+// With a UPS name, only its variables are printed as "<name>: <value>", and with a variable name, only its value.
+// NUT servers that fail are logged and skipped, so the others are still listed, and exit with an error at the end.
+func ListCommand(args []string) {
+	// Keep stdout clean for scripts.
+	log.Out = os.Stderr
+	log.SetLevel(logrus.WarnLevel)
+	flagSet, _ := parseConfigFlags("list", args)
+	config := CurrentConfig()
+	if config.Verbose {
+		log.SetLevel(logrus.DebugLevel)
+	}
+	upsName, variableName := flagSet.Arg(0), flagSet.Arg(1)
+
+	found, failed := false, false
+	for _, serverConfig := range config.NUTServers {
+		server := NewNUTServer(serverConfig)
+		upsList, err := server.ListUPS()
+		if err != nil {
+			log.Error(err)
+			failed = true
+			_ = server.Close()
+			continue
+		}
+		for _, ups := range upsList {
+			if upsName != "" && ups.Name != upsName {
+				continue
+			}
+			found = true
+			variables, err := server.ListVariables(ups.Name)
+			if err != nil {
+				log.Error(err)
+				failed = true
+				continue
+			}
+
+			if variableName != "" {
+				for _, variable := range variables {
+					if variable.Name == variableName {
+						fmt.Println(variable.Value)
+						return
+					}
+				}
+				log.Fatal(fmt.Sprintf("Variable %s not found on UPS device %s", variableName, ups.Name))
+			}
+
+			if upsName == "" {
+				fmt.Printf("[%s@%s] %s\n", ups.Name, server.Config.Name, ups.Value)
+			}
+			for _, variable := range variables {
+				fmt.Printf("%s: %s\n", variable.Name, variable.Value)
+			}
+			if upsName == "" {
+				fmt.Println()
+			}
+		}
+		_ = server.Close()
+	}
+	if failed {
+		os.Exit(1)
+	}
+	if upsName != "" && !found {
+		log.Fatal(fmt.Sprintf("UPS device %s not found", upsName))
+	}
+}
+
+// Check the configuration, and print every problem with it.
+func ValidateConfigCommand(args []string) {
+	parseConfigFlags("validate-config", args)
+	if config := CurrentConfig(); config.NUTFakeDumps != "" {
+		if _, err := LoadFakeNUTDumps(config.NUTFakeDumps); err != nil {
+			log.Fatal(err)
+		}
+	}
+	fmt.Println("Configuration is valid")
+}
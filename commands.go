@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// UPSCommandResult is the outcome of a command received over MQTT, published to its result topic.
+type UPSCommandResult struct {
+	UPS       string    `json:"ups"`
+	Command   string    `json:"command"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// UPSVariableResult is the outcome of a variable write received over MQTT, published to its result topic.
+type UPSVariableResult struct {
+	UPS       string    `json:"ups"`
+	Variable  string    `json:"variable"`
+	Value     string    `json:"value"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Message   string    `json:"message,omitempty"`
+	NewValue  *string   `json:"new_value,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Find the NUT server and name of the UPS device that an MQTT topic belongs to,
+// along with the rest of the topic after "<ups topic>/<kind>/", eg. the command name.
+func findUPSForTopic(topic string, kind string) (*NUTServer, string, string, bool) {
+	upsDevicesMutex.Lock()
+	defer upsDevicesMutex.Unlock()
+	for _, server := range nutServers {
+		for _, ups := range upsDevices[server] {
+			upsTopic, err := server.UPSTopic(ups.Name)
+			if err != nil {
+				continue
+			}
+			prefix := fmt.Sprintf("%s/%s/", upsTopic, kind)
+			if name := strings.TrimPrefix(topic, prefix); name != topic && name != "" && !strings.Contains(name, "/") {
+				return server, ups.Name, name, true
+			}
+		}
+	}
+	return nil, "", "", false
+}
+
+// Get the MQTT topic filters for commands of the given kind, eg. "<MQTT topic>/+/cmd/+".
+func upsCommandTopicFilters(kind string) map[string]byte {
+	upsDevicesMutex.Lock()
+	defer upsDevicesMutex.Unlock()
+	filters := map[string]byte{}
+	for _, server := range nutServers {
+		upsTopic, err := server.UPSTopic("+")
+		if err != nil {
+			log.Error("Not subscribing to the ", kind, " topics of NUT server ", server.Config.Name, ": ", err)
+			continue
+		}
+		filters[fmt.Sprintf("%s/%s/+", upsTopic, kind)] = 1
+	}
+	return filters
+}
+
+// Subscribe to the instant command and variable topics of all UPS devices,
+// eg. "<ups topic>/cmd/beeper.disable" and "<ups topic>/set/battery.charge.low".
+func SubscribeUPSCommands(client mqtt.Client) {
+	commandFilters := upsCommandTopicFilters("cmd")
+	log.Debug("Subscribing to instant command topics ", commandFilters, " ...")
+	commandToken := client.SubscribeMultiple(commandFilters, upsCommandHandler)
+
+	variableFilters := upsCommandTopicFilters("set")
+	log.Debug("Subscribing to variable topics ", variableFilters, " ...")
+	variableToken := client.SubscribeMultiple(variableFilters, upsVariableHandler)
+
+	go func() {
+		if !commandToken.WaitTimeout(5*time.Second) || commandToken.Error() != nil {
+			log.Warn("Failed to subscribe to instant command topics: ", commandToken.Error())
+		}
+		if !variableToken.WaitTimeout(5*time.Second) || variableToken.Error() != nil {
+			log.Warn("Failed to subscribe to variable topics: ", variableToken.Error())
+		}
+	}()
+}
+
+// Unsubscribe from the topic filters that are no longer in use, eg. after the topic template of a NUT server has changed.
+func unsubscribeUPSCommands(client mqtt.Client, previousFilters map[string]byte, filters map[string]byte) {
+	unused := []string{}
+	for filter := range previousFilters {
+		if _, ok := filters[filter]; !ok {
+			unused = append(unused, filter)
+		}
+	}
+	if len(unused) == 0 {
+		return
+	}
+	log.Debug("Unsubscribing from topics ", unused, " ...")
+	token := client.Unsubscribe(unused...)
+	go func() {
+		if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+			log.Warn("Failed to unsubscribe from topics: ", token.Error())
+		}
+	}()
+}
+
+// Handle an instant command received over MQTT, by sending it to the UPS device
+// and publishing the outcome to "<ups topic>/cmd/<command>/result".
+var upsCommandHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	// Never run retained commands, as they would run again on every reconnect.
+	if msg.Retained() {
+		log.Warn("Ignoring retained instant command on topic ", msg.Topic())
+		return
+	}
+
+	server, upsName, command, ok := findUPSForTopic(msg.Topic(), "cmd")
+	if !ok {
+		log.Debug("Ignoring instant command for unknown UPS device on topic ", msg.Topic())
+		return
+	}
+
+	// Don't block the MQTT client while waiting for the NUT server.
+	go func() {
+		result := UPSCommandResult{UPS: upsName, Command: command, Result: "OK"}
+		if !server.IsCommandAllowed(upsName, command) {
+			log.Warn(fmt.Sprintf("Instant command %s is not allowed for UPS device %s on %s", command, upsName, server.Config.Name))
+			result.Result, result.Error, result.Message = "ERR", "NOT-ALLOWED", "The instant command is not in the allowlist of the UPS device"
+		} else if err := server.SendCommand(upsName, command); err != nil {
+			log.Warn(fmt.Sprintf("Instant command %s failed for UPS device %s on %s: %s", command, upsName, server.Config.Name, err))
+			result.Result, result.Error, result.Message = "ERR", NUTErrorCode(err), err.Error()
+		}
+		result.Timestamp = time.Now().UTC()
+
+		resultJSON, jsonErr := json.Marshal(result)
+		if jsonErr != nil {
+			log.Warn("Failed to serialize instant command result to JSON: ", jsonErr)
+			return
+		}
+		if err := PublishMQTT(fmt.Sprintf("%s/result", msg.Topic()), 1, false, resultJSON); err != nil {
+			log.Warn("Failed to send instant command result to MQTT broker: ", err)
+		}
+	}()
+}
+
+// Handle a variable write received over MQTT, by validating the value and setting it on the UPS device,
+// and publishing the outcome and the new value to "<ups topic>/set/<variable>/result".
+var upsVariableHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	// Never apply retained values, as they would be written again on every reconnect.
+	if msg.Retained() {
+		log.Warn("Ignoring retained variable value on topic ", msg.Topic())
+		return
+	}
+
+	server, upsName, variable, ok := findUPSForTopic(msg.Topic(), "set")
+	if !ok {
+		log.Debug("Ignoring variable value for unknown UPS device on topic ", msg.Topic())
+		return
+	}
+	value := strings.TrimSpace(string(msg.Payload()))
+
+	// Don't block the MQTT client while waiting for the NUT server.
+	go func() {
+		result := UPSVariableResult{UPS: upsName, Variable: variable, Value: value, Result: "OK"}
+		if !server.IsVariableAllowed(upsName, variable) {
+			log.Warn(fmt.Sprintf("Setting variable %s is not allowed for UPS device %s on %s", variable, upsName, server.Config.Name))
+			result.Result, result.Error, result.Message = "ERR", "NOT-ALLOWED", "The variable is not in the allowlist of the UPS device"
+		} else if newValue, err := server.SetVariable(upsName, variable, value); err != nil {
+			log.Warn(fmt.Sprintf("Setting variable %s failed for UPS device %s on %s: %s", variable, upsName, server.Config.Name, err))
+			result.Result, result.Error, result.Message = "ERR", NUTErrorCode(err), err.Error()
+		} else {
+			result.NewValue = &newValue
+		}
+		result.Timestamp = time.Now().UTC()
+
+		resultJSON, jsonErr := json.Marshal(result)
+		if jsonErr != nil {
+			log.Warn("Failed to serialize variable result to JSON: ", jsonErr)
+			return
+		}
+		if err := PublishMQTT(fmt.Sprintf("%s/result", msg.Topic()), 1, false, resultJSON); err != nil {
+			log.Warn("Failed to send variable result to MQTT broker: ", err)
+		}
+	}()
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigErrors is a list of problems with the configuration, so they can all be reported at once.
+type ConfigErrors []string
+
+func (errs ConfigErrors) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(errs, "\n  - ")
+}
+
+// Add a problem to the list, unless err is nil.
+func (errs *ConfigErrors) Add(err error) {
+	if err != nil {
+		*errs = append(*errs, err.Error())
+	}
+}
+
+// Add a problem with a configuration field to the list.
+func (errs *ConfigErrors) Addf(field string, format string, args ...interface{}) {
+	*errs = append(*errs, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+// Return the list as an error, or nil if there are no problems.
+func (errs ConfigErrors) Err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// ConfigFile is the structure of the YAML configuration file.
+// Every field is optional, and only the fields that are set override the defaults.
+type ConfigFile struct {
+	MQTT struct {
+		Protocol    *string `yaml:"protocol"`
+		Host        *string `yaml:"host"`
+		Port        *int    `yaml:"port"`
+		Client      *string `yaml:"client"`
+		Topic       *string `yaml:"topic"`
+		User        *string `yaml:"user"`
+		Pass        *string `yaml:"pass"`
+		PublishMode *string `yaml:"publish_mode"`
+
+		TLS struct {
+			CA         *string `yaml:"ca"`
+			Cert       *string `yaml:"cert"`
+			Key        *string `yaml:"key"`
+			ServerName *string `yaml:"server_name"`
+			MinVersion *string `yaml:"min_version"`
+			Insecure   *bool   `yaml:"insecure"`
+		} `yaml:"tls"`
+	} `yaml:"mqtt"`
+
+	HomeAssistant struct {
+		Discovery       *bool   `yaml:"discovery"`
+		DiscoveryPrefix *string `yaml:"discovery_prefix"`
+	} `yaml:"home_assistant"`
+
+	NUT struct {
+		Servers           []NUTServerConfig `yaml:"servers"`
+		ReconnectMinDelay *int              `yaml:"reconnect_min_delay"`
+		ReconnectMaxDelay *int              `yaml:"reconnect_max_delay"`
+		Fake              *bool             `yaml:"fake"`
+		FakeRate          *float64          `yaml:"fake_rate"`
+		FakeScenario      *string           `yaml:"fake_scenario"`
+		FakeDumps         *string           `yaml:"fake_dumps"`
+	} `yaml:"nut"`
+
+	InfluxDB struct {
+		URL         *string `yaml:"url"`
+		Database    *string `yaml:"database"`
+		User        *string `yaml:"user"`
+		Pass        *string `yaml:"pass"`
+		Org         *string `yaml:"org"`
+		Bucket      *string `yaml:"bucket"`
+		Token       *string `yaml:"token"`
+		Measurement *string `yaml:"measurement"`
+		BatchSize   *int    `yaml:"batch_size"`
+		BufferSize  *int    `yaml:"buffer_size"`
+	} `yaml:"influxdb"`
+
+	Metrics struct {
+		Listen *string `yaml:"listen"`
+	} `yaml:"metrics"`
+
+	UpdateInterval *int  `yaml:"update_interval"`
+	Verbose        *bool `yaml:"verbose"`
+}
+
+// Get the value of an environment variable as an integer or return a default value.
+func GetEnvInt(key string, fallback int) (int, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	number, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return fallback, fmt.Errorf("%s: %q is not a whole number", key, value)
+	}
+	return number, nil
+}
+
+// Get the value of an environment variable as a number or return a default value.
+func GetEnvFloat(key string, fallback float64) (float64, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return fallback, fmt.Errorf("%s: %q is not a number", key, value)
+	}
+	return number, nil
+}
+
+// Get the value of an environment variable as a boolean or return a default value.
+func GetEnvBool(key string, fallback bool) (bool, error) {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback, nil
+	}
+	boolean, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return fallback, fmt.Errorf("%s: %q is not a boolean, use true or false", key, value)
+	}
+	return boolean, nil
+}
+
+// Get the value of a secret from an environment variable, or from the file named by the same variable with a "_FILE" suffix,
+// eg. "MQTT_PASS_FILE=/run/secrets/mqtt_pass" for Docker and Kubernetes secrets, or return a default value.
+// The trailing newline of the file is trimmed, and the secret itself is never included in errors.
+// An empty variable, eg. "MQTT_PASS=" from a .env file, doesn't conflict with its file.
+func GetEnvSecret(key string, fallback string) (string, error) {
+	value, ok := os.LookupEnv(key)
+	path, fileOk := os.LookupEnv(key + "_FILE")
+	switch {
+	case !fileOk || path == "":
+		if ok {
+			return value, nil
+		}
+		return fallback, nil
+	case value != "":
+		return fallback, fmt.Errorf("%s: can't be set together with %s_FILE", key, key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fallback, fmt.Errorf("%s_FILE: %w", key, err)
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+}
+
+// Load a configuration from a YAML file, on top of the given configuration.
+func LoadConfigFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	// Reject unknown fields, so typos don't go unnoticed.
+	var file ConfigFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			errs := ConfigErrors{}
+			for _, message := range typeErr.Errors {
+				// Drop the Go type from unknown field errors, eg. "line 2: field prot not found in type struct { ... }".
+				message = strings.SplitN(message, " in type ", 2)[0]
+				errs = append(errs, fmt.Sprintf("%s: %s", path, message))
+			}
+			return errs
+		}
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	setString := func(target *string, value *string) {
+		if value != nil {
+			*target = *value
+		}
+	}
+	setInt := func(target *int, value *int) {
+		if value != nil {
+			*target = *value
+		}
+	}
+	setFloat := func(target *float64, value *float64) {
+		if value != nil {
+			*target = *value
+		}
+	}
+	setBool := func(target *bool, value *bool) {
+		if value != nil {
+			*target = *value
+		}
+	}
+
+	// MQTT
+	setString(&cfg.MQTTBrokerProtocol, file.MQTT.Protocol)
+	setString(&cfg.MQTTBrokerHost, file.MQTT.Host)
+	setInt(&cfg.MQTTBrokerPort, file.MQTT.Port)
+	setString(&cfg.MQTTClient, file.MQTT.Client)
+	setString(&cfg.MQTTTopic, file.MQTT.Topic)
+	setString(&cfg.MQTTUser, file.MQTT.User)
+	setString(&cfg.MQTTPass, file.MQTT.Pass)
+	setString(&cfg.MQTTPublishMode, file.MQTT.PublishMode)
+	setString(&cfg.MQTTTLSCA, file.MQTT.TLS.CA)
+	setString(&cfg.MQTTTLSCert, file.MQTT.TLS.Cert)
+	setString(&cfg.MQTTTLSKey, file.MQTT.TLS.Key)
+	setString(&cfg.MQTTTLSServerName, file.MQTT.TLS.ServerName)
+	setString(&cfg.MQTTTLSMinVersion, file.MQTT.TLS.MinVersion)
+	setBool(&cfg.MQTTTLSInsecure, file.MQTT.TLS.Insecure)
+
+	// Home Assistant
+	setBool(&cfg.HADiscovery, file.HomeAssistant.Discovery)
+	setString(&cfg.HADiscoveryPrefix, file.HomeAssistant.DiscoveryPrefix)
+
+	// NUT
+	if file.NUT.Servers != nil {
+		cfg.NUTServers = []NUTServerConfig{}
+		for _, server := range file.NUT.Servers {
+			cfg.NUTServers = append(cfg.NUTServers, withNUTServerDefaults(server))
+		}
+	}
+	setInt(&cfg.NUTReconnectMinDelay, file.NUT.ReconnectMinDelay)
+	setInt(&cfg.NUTReconnectMaxDelay, file.NUT.ReconnectMaxDelay)
+	setBool(&cfg.NUTFake, file.NUT.Fake)
+	setFloat(&cfg.NUTFakeRate, file.NUT.FakeRate)
+	setString(&cfg.NUTFakeScenario, file.NUT.FakeScenario)
+	setString(&cfg.NUTFakeDumps, file.NUT.FakeDumps)
+
+	// InfluxDB
+	setString(&cfg.InfluxDBURL, file.InfluxDB.URL)
+	setString(&cfg.InfluxDBDatabase, file.InfluxDB.Database)
+	setString(&cfg.InfluxDBUser, file.InfluxDB.User)
+	setString(&cfg.InfluxDBPass, file.InfluxDB.Pass)
+	setString(&cfg.InfluxDBOrg, file.InfluxDB.Org)
+	setString(&cfg.InfluxDBBucket, file.InfluxDB.Bucket)
+	setString(&cfg.InfluxDBToken, file.InfluxDB.Token)
+	setString(&cfg.InfluxDBMeasurement, file.InfluxDB.Measurement)
+	setInt(&cfg.InfluxDBBatchSize, file.InfluxDB.BatchSize)
+	setInt(&cfg.InfluxDBBufferSize, file.InfluxDB.BufferSize)
+
+	// Metrics
+	setString(&cfg.MetricsListen, file.Metrics.Listen)
+
+	// Other
+	setInt(&cfg.UpdateInterval, file.UpdateInterval)
+	setBool(&cfg.Verbose, file.Verbose)
+	return nil
+}
+
+// Fill in the defaults of a NUT server configuration.
+func withNUTServerDefaults(server NUTServerConfig) NUTServerConfig {
+	if server.Host == "" {
+		server.Host = "localhost"
+	}
+	if server.Port == 0 {
+		server.Port = 3493
+	}
+	if server.UPSInclude == nil {
+		server.UPSInclude = []string{}
+	}
+	if server.UPSExclude == nil {
+		server.UPSExclude = []string{}
+	}
+	if server.UPSCommands == nil {
+		server.UPSCommands = map[string][]string{}
+	}
+	if server.UPSVariables == nil {
+		server.UPSVariables = map[string][]string{}
+	}
+	return server
+}
+
+// Get the suffix of the environment variables of the NUT server at an index, eg. "" for the first server and "_2" for the second.
+func nutServerEnvSuffix(index int) string {
+	if index == 0 {
+		return ""
+	}
+	return fmt.Sprintf("_%d", index+1)
+}
+
+// Load the configuration from the config file, if any, then from environment variables and then from command line flags,
+// where each takes precedence over the previous one. The config file path is taken from the NUTTYQT_CONFIG environment variable if path is empty.
+// The configuration is returned along with its problems, and only becomes the current configuration with SetConfig.
+func LoadConfig(path string, flags *ConfigFlags) (Config, error) {
+	cfg := DefaultConfig()
+	if path == "" {
+		path = GetEnv("NUTTYQT_CONFIG", "")
+	}
+	if path != "" {
+		if err := LoadConfigFile(&cfg, path); err != nil {
+			return cfg, err
+		}
+	}
+
+	errs := ConfigErrors{}
+	envInt := func(key string, fallback int) int {
+		value, err := GetEnvInt(key, fallback)
+		errs.Add(err)
+		return value
+	}
+	envFloat := func(key string, fallback float64) float64 {
+		value, err := GetEnvFloat(key, fallback)
+		errs.Add(err)
+		return value
+	}
+	envBool := func(key string, fallback bool) bool {
+		value, err := GetEnvBool(key, fallback)
+		errs.Add(err)
+		return value
+	}
+	envSecret := func(key string, fallback string) string {
+		value, err := GetEnvSecret(key, fallback)
+		errs.Add(err)
+		return value
+	}
+
+	// MQTT
+	cfg.MQTTBrokerProtocol = GetEnv("MQTT_BROKER_PROTOCOL", cfg.MQTTBrokerProtocol)
+	cfg.MQTTBrokerHost = GetEnv("MQTT_BROKER_HOST", cfg.MQTTBrokerHost)
+	cfg.MQTTBrokerPort = envInt("MQTT_BROKER_PORT", cfg.MQTTBrokerPort)
+	cfg.MQTTClient = GetEnv("MQTT_CLIENT", cfg.MQTTClient)
+	cfg.MQTTTopic = GetEnv("MQTT_TOPIC", cfg.MQTTTopic)
+	cfg.MQTTUser = envSecret("MQTT_USER", cfg.MQTTUser)
+	cfg.MQTTPass = envSecret("MQTT_PASS", cfg.MQTTPass)
+	cfg.MQTTPublishMode = GetEnv("MQTT_PUBLISH_MODE", cfg.MQTTPublishMode)
+	cfg.MQTTTLSCA = GetEnv("MQTT_TLS_CA", cfg.MQTTTLSCA)
+	cfg.MQTTTLSCert = GetEnv("MQTT_TLS_CERT", cfg.MQTTTLSCert)
+	cfg.MQTTTLSKey = GetEnv("MQTT_TLS_KEY", cfg.MQTTTLSKey)
+	cfg.MQTTTLSServerName = GetEnv("MQTT_TLS_SERVER_NAME", cfg.MQTTTLSServerName)
+	cfg.MQTTTLSMinVersion = GetEnv("MQTT_TLS_MIN_VERSION", cfg.MQTTTLSMinVersion)
+	cfg.MQTTTLSInsecure = envBool("MQTT_TLS_INSECURE", cfg.MQTTTLSInsecure)
+
+	// Home Assistant
+	cfg.HADiscovery = envBool("HA_DISCOVERY", cfg.HADiscovery)
+	cfg.HADiscoveryPrefix = GetEnv("HA_DISCOVERY_PREFIX", cfg.HADiscoveryPrefix)
+
+	// NUT servers are numbered after the first one, eg. "NUT_SERVER_2", "NUT_PORT_2" and so on.
+	// The variables override the servers from the config file, and add new servers after them.
+	for i := 0; ; i++ {
+		suffix := nutServerEnvSuffix(i)
+		if i >= len(cfg.NUTServers) {
+			host, ok := os.LookupEnv("NUT_SERVER" + suffix)
+			if !ok {
+				break
+			}
+			cfg.NUTServers = append(cfg.NUTServers, withNUTServerDefaults(NUTServerConfig{Host: host}))
+		}
+		server := &cfg.NUTServers[i]
+		server.Name = GetEnv("NUT_NAME"+suffix, server.Name)
+		server.Host = GetEnv("NUT_SERVER"+suffix, server.Host)
+		server.Port = envInt("NUT_PORT"+suffix, server.Port)
+		server.User = envSecret("NUT_USER"+suffix, server.User)
+		server.Pass = envSecret("NUT_PASS"+suffix, server.Pass)
+		server.StartTLS = envBool("NUT_STARTTLS"+suffix, server.StartTLS)
+		server.TLSCA = GetEnv("NUT_TLS_CA"+suffix, server.TLSCA)
+		server.TLSFingerprint = GetEnv("NUT_TLS_FINGERPRINT"+suffix, server.TLSFingerprint)
+		server.TLSServerName = GetEnv("NUT_TLS_SERVER_NAME"+suffix, server.TLSServerName)
+		server.AllowCleartextAuth = envBool("NUT_ALLOW_CLEARTEXT_AUTH"+suffix, server.AllowCleartextAuth)
+		server.TopicPrefix = GetEnv("NUT_TOPIC_PREFIX"+suffix, server.TopicPrefix)
+		server.TopicTemplate = GetEnv("NUT_TOPIC_TEMPLATE"+suffix, server.TopicTemplate)
+		server.UPSInclude = GetEnvList("NUT_UPS_INCLUDE"+suffix, server.UPSInclude)
+		server.UPSExclude = GetEnvList("NUT_UPS_EXCLUDE"+suffix, server.UPSExclude)
+		server.UPSCommands = GetEnvMap("NUT_COMMANDS"+suffix, server.UPSCommands)
+		server.UPSVariables = GetEnvMap("NUT_VARIABLES"+suffix, server.UPSVariables)
+	}
+	cfg.NUTReconnectMinDelay = envInt("NUT_RECONNECT_MIN_DELAY", cfg.NUTReconnectMinDelay)
+	cfg.NUTReconnectMaxDelay = envInt("NUT_RECONNECT_MAX_DELAY", cfg.NUTReconnectMaxDelay)
+	cfg.NUTFake = envBool("NUT_FAKE", cfg.NUTFake)
+	cfg.NUTFakeRate = envFloat("NUT_FAKE_RATE", cfg.NUTFakeRate)
+	cfg.NUTFakeScenario = GetEnv("NUT_FAKE_SCENARIO", cfg.NUTFakeScenario)
+	cfg.NUTFakeDumps = GetEnv("NUT_FAKE_DUMPS", cfg.NUTFakeDumps)
+
+	// InfluxDB
+	cfg.InfluxDBURL = GetEnv("INFLUXDB_URL", cfg.InfluxDBURL)
+	cfg.InfluxDBDatabase = GetEnv("INFLUXDB_DATABASE", cfg.InfluxDBDatabase)
+	cfg.InfluxDBUser = envSecret("INFLUXDB_USER", cfg.InfluxDBUser)
+	cfg.InfluxDBPass = envSecret("INFLUXDB_PASS", cfg.InfluxDBPass)
+	cfg.InfluxDBOrg = GetEnv("INFLUXDB_ORG", cfg.InfluxDBOrg)
+	cfg.InfluxDBBucket = GetEnv("INFLUXDB_BUCKET", cfg.InfluxDBBucket)
+	cfg.InfluxDBToken = envSecret("INFLUXDB_TOKEN", cfg.InfluxDBToken)
+	cfg.InfluxDBMeasurement = GetEnv("INFLUXDB_MEASUREMENT", cfg.InfluxDBMeasurement)
+	cfg.InfluxDBBatchSize = envInt("INFLUXDB_BATCH_SIZE", cfg.InfluxDBBatchSize)
+	cfg.InfluxDBBufferSize = envInt("INFLUXDB_BUFFER_SIZE", cfg.InfluxDBBufferSize)
+
+	// Metrics
+	cfg.MetricsListen = GetEnv("METRICS_LISTEN", cfg.MetricsListen)
+
+	// Other
+	cfg.UpdateInterval = envInt("UPDATE_INTERVAL", cfg.UpdateInterval)
+	cfg.Verbose = envBool("VERBOSE", cfg.Verbose)
+
+	// Command line flags
+	flags.Apply(&cfg, &errs)
+
+	var validationErrs ConfigErrors
+	if errors.As(ValidateConfig(cfg), &validationErrs) {
+		errs = append(errs, validationErrs...)
+	}
+	return cfg, errs.Err()
+}
+
+// Check every field of a configuration, and return all the problems at once.
+// Fields are named after the config file, followed by the environment variable.
+func ValidateConfig(cfg Config) error {
+	errs := ConfigErrors{}
+
+	// MQTT
+	switch cfg.MQTTBrokerProtocol {
+	case "tcp", "mqtt", "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "ws", "wss", "unix":
+	default:
+		errs.Addf("mqtt.protocol (MQTT_BROKER_PROTOCOL)", "unsupported protocol %q, use tcp, ssl, ws or wss", cfg.MQTTBrokerProtocol)
+	}
+	if cfg.MQTTBrokerHost == "" {
+		errs.Addf("mqtt.host (MQTT_BROKER_HOST)", "must not be empty")
+	}
+	if cfg.MQTTBrokerPort < 1 || cfg.MQTTBrokerPort > 65535 {
+		errs.Addf("mqtt.port (MQTT_BROKER_PORT)", "must be between 1 and 65535, got %d", cfg.MQTTBrokerPort)
+	}
+	if cfg.MQTTClient == "" {
+		errs.Addf("mqtt.client (MQTT_CLIENT)", "must not be empty")
+	}
+	if err := validateMQTTTopic(cfg.MQTTTopic); err != nil {
+		errs.Addf("mqtt.topic (MQTT_TOPIC)", "%s", err)
+	}
+	if cfg.MQTTTLSCA != "" || cfg.MQTTTLSCert != "" || cfg.MQTTTLSKey != "" || cfg.MQTTTLSServerName != "" || cfg.MQTTTLSInsecure {
+		if !IsMQTTTLSProtocol(cfg.MQTTBrokerProtocol) {
+			errs.Addf("mqtt.tls", "TLS settings are only used with the ssl, tls, mqtts, mqtt+ssl, tcps or wss protocols, got %q", cfg.MQTTBrokerProtocol)
+		}
+	}
+	if _, err := LoadTLSFiles(cfg.MQTTTLSCA, "", ""); err != nil {
+		errs.Addf("mqtt.tls.ca (MQTT_TLS_CA)", "%s", err)
+	}
+	if _, err := LoadTLSFiles("", cfg.MQTTTLSCert, cfg.MQTTTLSKey); err != nil {
+		errs.Addf("mqtt.tls.cert (MQTT_TLS_CERT, MQTT_TLS_KEY)", "%s", err)
+	}
+	if _, err := ParseTLSVersion(cfg.MQTTTLSMinVersion); err != nil {
+		errs.Addf("mqtt.tls.min_version (MQTT_TLS_MIN_VERSION)", "%s", err)
+	}
+	switch cfg.MQTTPublishMode {
+	case MQTTPublishModeJSON, MQTTPublishModeVariables, MQTTPublishModeBoth:
+	default:
+		errs.Addf("mqtt.publish_mode (MQTT_PUBLISH_MODE)", "unsupported publish mode %q, use %s, %s or %s",
+			cfg.MQTTPublishMode, MQTTPublishModeJSON, MQTTPublishModeVariables, MQTTPublishModeBoth)
+	}
+
+	// Home Assistant
+	if err := validateMQTTTopic(cfg.HADiscoveryPrefix); err != nil {
+		errs.Addf("home_assistant.discovery_prefix (HA_DISCOVERY_PREFIX)", "%s", err)
+	}
+
+	// NUT
+	if len(cfg.NUTServers) == 0 {
+		errs.Addf("nut.servers", "at least one NUT server is required")
+	}
+	names := map[string]bool{}
+	for i, server := range cfg.NUTServers {
+		field := func(name string, env string) string {
+			return fmt.Sprintf("nut.servers[%d].%s (%s%s)", i, name, env, nutServerEnvSuffix(i))
+		}
+		if server.Host == "" {
+			errs.Addf(field("host", "NUT_SERVER"), "must not be empty")
+		}
+		if server.Port < 1 || server.Port > 65535 {
+			errs.Addf(field("port", "NUT_PORT"), "must be between 1 and 65535, got %d", server.Port)
+		}
+		name := server.Name
+		if name == "" {
+			name = fmt.Sprintf("%s:%d", server.Host, server.Port)
+		}
+		if names[name] {
+			errs.Addf(field("name", "NUT_NAME"), "another NUT server is already named %q", name)
+		}
+		names[name] = true
+		if server.StartTLS {
+			if _, err := LoadTLSFiles(server.TLSCA, "", ""); err != nil {
+				errs.Addf(field("tls_ca", "NUT_TLS_CA"), "%s", err)
+			}
+			if server.TLSFingerprint != "" {
+				if _, err := ParseTLSFingerprint(server.TLSFingerprint); err != nil {
+					errs.Addf(field("tls_fingerprint", "NUT_TLS_FINGERPRINT"), "%s", err)
+				}
+			}
+		} else if server.TLSCA != "" || server.TLSFingerprint != "" || server.TLSServerName != "" {
+			errs.Addf(field("starttls", "NUT_STARTTLS"), "must be enabled to use the TLS settings of the NUT server")
+		}
+		if server.User != "" && server.Pass != "" && !server.StartTLS && !server.AllowCleartextAuth {
+			errs.Addf(field("pass", "NUT_PASS"), "the credentials would be sent in cleartext, enable starttls (NUT_STARTTLS%s) "+
+				"or allow_cleartext_auth (NUT_ALLOW_CLEARTEXT_AUTH%s)", nutServerEnvSuffix(i), nutServerEnvSuffix(i))
+		}
+		prefixErr := false
+		if prefix := strings.Trim(server.TopicPrefix, "/"); prefix != "" {
+			err := validateMQTTTopic(prefix)
+			if err == nil && server.TopicTemplate == "" {
+				err = checkMQTTReservedTopic(cfg.MQTTTopic, cfg.MQTTTopic+"/"+prefix)
+			}
+			if err != nil {
+				errs.Addf(field("topic_prefix", "NUT_TOPIC_PREFIX"), "%s", err)
+				prefixErr = true
+			}
+		}
+		var topicTemplate *template.Template
+		if server.TopicTemplate != "" {
+			var err error
+			if topicTemplate, err = ParseNUTTopicTemplate(server.TopicTemplate, NewNUTTopicTemplateData(server, cfg.MQTTTopic)); err != nil {
+				errs.Addf(field("topic_template", "NUT_TOPIC_TEMPLATE"), "%s", err)
+			}
+		}
+		// The topics of the included UPS devices are known upfront, eg. a UPS device named "status" directly under the MQTT topic.
+		if !prefixErr && (server.TopicTemplate == "" || topicTemplate != nil) {
+			for _, upsName := range server.UPSInclude {
+				if _, err := nutUPSTopic(server, topicTemplate, cfg.MQTTTopic, upsName); err != nil {
+					errs.Addf(field("ups_include", "NUT_UPS_INCLUDE"), "%s", err)
+				}
+			}
+		}
+	}
+	if cfg.NUTReconnectMinDelay < 0 {
+		errs.Addf("nut.reconnect_min_delay (NUT_RECONNECT_MIN_DELAY)", "must not be negative, got %d", cfg.NUTReconnectMinDelay)
+	}
+	if cfg.NUTReconnectMaxDelay < cfg.NUTReconnectMinDelay {
+		errs.Addf("nut.reconnect_max_delay (NUT_RECONNECT_MAX_DELAY)", "must not be less than the minimum delay of %d, got %d",
+			cfg.NUTReconnectMinDelay, cfg.NUTReconnectMaxDelay)
+	}
+	if cfg.NUTFakeRate <= 0 {
+		errs.Addf("nut.fake_rate (NUT_FAKE_RATE)", "must be greater than 0, got %g", cfg.NUTFakeRate)
+	}
+	if cfg.NUTFakeScenario != "" {
+		if _, err := LoadFakeNUTScenario(cfg.NUTFakeScenario); err != nil {
+			errs.Addf("nut.fake_scenario (NUT_FAKE_SCENARIO)", "%s", err)
+		}
+	}
+	// The upsc dumps are only loaded when the fake NUT server starts, so the lines they skip are only logged once.
+	if cfg.NUTFakeDumps != "" {
+		if info, err := os.Stat(cfg.NUTFakeDumps); err != nil {
+			errs.Addf("nut.fake_dumps (NUT_FAKE_DUMPS)", "failed to read upsc dumps: %s", err)
+		} else if !info.IsDir() {
+			errs.Addf("nut.fake_dumps (NUT_FAKE_DUMPS)", "%s is not a directory", cfg.NUTFakeDumps)
+		}
+	}
+
+	// InfluxDB
+	if cfg.InfluxDBURL != "" {
+		validateInfluxDBConfig(cfg, &errs)
+	}
+
+	// Metrics
+	if cfg.MetricsListen != "" {
+		if _, port, err := net.SplitHostPort(cfg.MetricsListen); err != nil {
+			errs.Addf("metrics.listen (METRICS_LISTEN)", "%q is not a listen address, eg. :9199", cfg.MetricsListen)
+		} else if number, err := strconv.Atoi(port); err != nil || number < 0 || number > 65535 {
+			errs.Addf("metrics.listen (METRICS_LISTEN)", "port must be between 0 and 65535, got %q", port)
+		}
+	}
+
+	// Other
+	if cfg.UpdateInterval < 1 {
+		errs.Addf("update_interval (UPDATE_INTERVAL)", "must be at least 1 second, got %d", cfg.UpdateInterval)
+	}
+
+	return errs.Err()
+}
+
+// Check the InfluxDB settings, which depend on whether the HTTP write API of InfluxDB 1.x or 2.x, or UDP is used.
+func validateInfluxDBConfig(cfg Config, errs *ConfigErrors) {
+	u, err := url.Parse(cfg.InfluxDBURL)
+	switch {
+	case err != nil:
+		errs.Addf("influxdb.url (INFLUXDB_URL)", "%s", err)
+		return
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "udp":
+		errs.Addf("influxdb.url (INFLUXDB_URL)", "unsupported scheme %q, use http, https or udp", u.Scheme)
+		return
+	case u.Host == "":
+		errs.Addf("influxdb.url (INFLUXDB_URL)", "%q has no host, eg. http://localhost:8086", cfg.InfluxDBURL)
+		return
+	}
+
+	v1 := cfg.InfluxDBDatabase != "" || cfg.InfluxDBUser != "" || cfg.InfluxDBPass != ""
+	v2 := cfg.InfluxDBOrg != "" || cfg.InfluxDBBucket != "" || cfg.InfluxDBToken != ""
+	switch {
+	case u.Scheme == "udp":
+		if v1 || v2 {
+			errs.Addf("influxdb.url (INFLUXDB_URL)", "the database, credentials, organization, bucket and token aren't used with UDP, "+
+				"as the database is set by the UDP listener of InfluxDB")
+		}
+	case v1 && v2:
+		errs.Addf("influxdb.bucket (INFLUXDB_BUCKET)", "use either the database and credentials of InfluxDB 1.x, "+
+			"or the organization, bucket and token of InfluxDB 2.x")
+	case v2:
+		if cfg.InfluxDBOrg == "" || cfg.InfluxDBBucket == "" {
+			errs.Addf("influxdb.bucket (INFLUXDB_BUCKET)", "the organization and bucket of InfluxDB 2.x must be set together")
+		}
+	case cfg.InfluxDBDatabase == "":
+		errs.Addf("influxdb.database (INFLUXDB_DATABASE)", "must be set for InfluxDB 1.x, or set the organization and bucket for InfluxDB 2.x")
+	}
+	if cfg.InfluxDBMeasurement == "" {
+		errs.Addf("influxdb.measurement (INFLUXDB_MEASUREMENT)", "must not be empty")
+	}
+	if cfg.InfluxDBBatchSize < 1 {
+		errs.Addf("influxdb.batch_size (INFLUXDB_BATCH_SIZE)", "must be at least 1, got %d", cfg.InfluxDBBatchSize)
+	}
+	if cfg.InfluxDBBufferSize < cfg.InfluxDBBatchSize {
+		errs.Addf("influxdb.buffer_size (INFLUXDB_BUFFER_SIZE)", "must not be less than the batch size of %d, got %d",
+			cfg.InfluxDBBatchSize, cfg.InfluxDBBufferSize)
+	}
+}
+
+// Check that a topic can be used as the base of other MQTT topics.
+func validateMQTTTopic(topic string) error {
+	if topic == "" {
+		return errors.New("must not be empty")
+	}
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("%q must not contain MQTT wildcards", topic)
+	}
+	if strings.HasPrefix(topic, "/") || strings.HasSuffix(topic, "/") || strings.Contains(topic, "//") {
+		return fmt.Errorf("%q must not have empty topic levels", topic)
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	err := os.WriteFile(path, []byte(`
+mqtt:
+  host: broker.local
+  port: 8883
+  publish_mode: both
+nut:
+  servers:
+    - name: site-a
+      host: nut-a.local
+      ups_include: [rack1, rack2]
+      commands:
+        rack1: [beeper.disable]
+    - name: site-b
+      host: nut-b.local
+      topic_template: "{{.Topic}}/{{.Server}}/{{.UPS}}"
+update_interval: 30
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MQTT_BROKER_HOST", "broker.override")
+	t.Setenv("NUT_PORT_2", "3494")
+	t.Setenv("NUT_SERVER_3", "nut-c.local")
+	t.Setenv("NUT_FAKE_RATE", "0.5")
+
+	config, err := LoadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MQTTBrokerHost != "broker.override" || config.MQTTBrokerPort != 8883 || config.MQTTPublishMode != MQTTPublishModeBoth {
+		t.Errorf("MQTT config = %s:%d %s, want the file overridden by the environment", config.MQTTBrokerHost, config.MQTTBrokerPort, config.MQTTPublishMode)
+	}
+	if config.NUTFakeRate != 0.5 {
+		t.Errorf("NUT fake rate = %g, want 0.5 from the environment", config.NUTFakeRate)
+	}
+	if len(config.NUTServers) != 3 {
+		t.Fatalf("NUT servers = %+v, want 2 from the file and 1 from the environment", config.NUTServers)
+	}
+	if siteA := config.NUTServers[0]; siteA.Port != 3493 || len(siteA.UPSInclude) != 2 || len(siteA.UPSCommands["rack1"]) != 1 {
+		t.Errorf("site-a = %+v, want the default port, UPS list and commands", siteA)
+	}
+	if siteB := config.NUTServers[1]; siteB.Port != 3494 || siteB.TopicTemplate == "" {
+		t.Errorf("site-b = %+v, want the port from the environment and the topic template", siteB)
+	}
+	if third := config.NUTServers[2]; third.Host != "nut-c.local" || third.Port != 3493 {
+		t.Errorf("third server = %+v, want it added from the environment", third)
+	}
+	if topic, err := NewNUTServer(config.NUTServers[1]).UPSTopic("rack1"); err != nil || topic != "nuttyqt/site-b/rack1" {
+		t.Errorf("site-b UPS topic = %q, %v, want %q", topic, err, "nuttyqt/site-b/rack1")
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	err := os.WriteFile(path, []byte(`
+mqtt:
+  port: 70000
+  publish_mode: xml
+  tls:
+    insecure: true
+    cert: /nonexistent/client.pem
+    min_version: "1.4"
+nut:
+  servers:
+    - topic_template: "{{.Topic}}/all"
+    - name: no-prefix
+      topic_template: "{{.Topic}}/{{.Prefix}}/{{.UPS}}"
+  reconnect_min_delay: 10
+  reconnect_max_delay: 5
+  fake_rate: 0
+  fake_scenario: /nonexistent/scenario.yml
+  fake_dumps: /nonexistent
+influxdb:
+  url: udp://localhost:8089
+  database: nut
+metrics:
+  listen: "9199"
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("UPDATE_INTERVAL", "60s")
+
+	var errs ConfigErrors
+	if _, err := LoadConfig(path, nil); !errors.As(err, &errs) {
+		t.Fatalf("LoadConfig() = %v, want configuration errors", err)
+	}
+	for _, field := range []string{"UPDATE_INTERVAL", "mqtt.port", "mqtt.publish_mode", "mqtt.tls:", "mqtt.tls.cert", "mqtt.tls.min_version", "nut.servers[0].topic_template", "nut.servers[1].topic_template", "nut.reconnect_max_delay", "nut.fake_rate", "nut.fake_scenario", "nut.fake_dumps", "influxdb.url", "metrics.listen"} {
+		found := false
+		for _, message := range errs {
+			found = found || strings.HasPrefix(message, field)
+		}
+		if !found {
+			t.Errorf("missing error for %s, got %q", field, errs)
+		}
+	}
+}
+
+func TestLoadConfigReservedTopics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	err := os.WriteFile(path, []byte(`
+nut:
+  servers:
+    - name: site-a
+      ups_include: [rack1, status]
+    - name: site-b
+      topic_prefix: nut
+    - name: site-c
+      topic_template: "{{.Topic}}/schema/{{.UPS}}"
+    - name: site-d
+      topic_prefix: site-d
+      ups_include: [status, schema, nut]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The topics of nuttyqt itself can't be used by the UPS devices, unless they are under a topic prefix.
+	var errs ConfigErrors
+	if _, err := LoadConfig(path, nil); !errors.As(err, &errs) || len(errs) != 3 {
+		t.Fatalf("LoadConfig() = %v, want 3 configuration errors", err)
+	}
+	for i, field := range []string{"nut.servers[0].ups_include", "nut.servers[1].topic_prefix", "nut.servers[2].topic_template"} {
+		if !strings.HasPrefix(errs[i], field) || !strings.Contains(errs[i], "reserved") {
+			t.Errorf("error %d = %q, want a reserved topic error for %s", i, errs[i], field)
+		}
+	}
+}
+
+func TestLoadConfigFileUnknownField(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	if err := os.WriteFile(path, []byte("mqtt:\n  hots: broker.local\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	if err := LoadConfigFile(&cfg, path); err == nil || !strings.Contains(err.Error(), "line 2: field hots not found") {
+		t.Errorf("LoadConfigFile() = %v, want an unknown field error", err)
+	}
+}
+
+func TestLoadConfigFlags(t *testing.T) {
+	flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := NewConfigFlags(flagSet)
+	if err := flagSet.Parse([]string{"--mqtt-port", "8883", "--nut-server", "nut.flag", "--nut-ups-include", "rack1,rack2", "--verbose", "--update-interval", "soon"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MQTT_BROKER_PORT", "1884")
+	t.Setenv("MQTT_BROKER_HOST", "broker.env")
+
+	var errs ConfigErrors
+	config, err := LoadConfig("", flags)
+	if !errors.As(err, &errs) || len(errs) != 1 || !strings.HasPrefix(errs[0], "--update-interval") {
+		t.Fatalf("LoadConfig() = %v, want an error for --update-interval", err)
+	}
+	if config.MQTTBrokerPort != 8883 || config.MQTTBrokerHost != "broker.env" {
+		t.Errorf("MQTT broker = %s:%d, want the port from the flag and the host from the environment", config.MQTTBrokerHost, config.MQTTBrokerPort)
+	}
+	if server := config.NUTServers[0]; server.Host != "nut.flag" || len(server.UPSInclude) != 2 || !config.Verbose {
+		t.Errorf("NUT server = %+v, verbose = %v, want the host, UPS list and verbose from the flags", server, config.Verbose)
+	}
+}
+
+func TestConfigFlagAliases(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	if err := os.WriteFile(path, []byte("nut:\n  servers:\n    - host: nut.file\n      port: 3494\n  fake_rate: 60\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	flagSet := flag.NewFlagSet("fakenut", flag.ContinueOnError)
+	flags := NewConfigFlagAliases(flagSet, []configFlagAlias{{"host", "nut-server", "host"}, {"rate", "nut-fake-rate", "rate"}})
+	if err := flagSet.Parse([]string{"--config", path, "--rate", "0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if flagSet.Lookup("nut-server") != nil || flagSet.Lookup("mqtt-host") != nil {
+		t.Error("flag set has the flags of all settings, want only the aliases")
+	}
+
+	config, err := LoadConfig(flags.ConfigPath, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server := config.NUTServers[0]; server.Host != "nut.file" || server.Port != 3494 || config.NUTFakeRate != 0.5 {
+		t.Errorf("config = %s:%d at rate %g, want the NUT server from the config file and the rate from the flag", server.Host, server.Port, config.NUTFakeRate)
+	}
+}
+
+func TestGetEnvSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("hunter2\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		env   map[string]string
+		value string
+		err   string
+	}{
+		{map[string]string{}, "fallback", ""},
+		{map[string]string{"TEST_SECRET": "plain"}, "plain", ""},
+		{map[string]string{"TEST_SECRET_FILE": path}, "hunter2", ""},
+		{map[string]string{"TEST_SECRET": "", "TEST_SECRET_FILE": path}, "hunter2", ""},
+		{map[string]string{"TEST_SECRET": "plain", "TEST_SECRET_FILE": path}, "fallback", "TEST_SECRET: can't be set together with TEST_SECRET_FILE"},
+		{map[string]string{"TEST_SECRET_FILE": path + ".missing"}, "fallback", "TEST_SECRET_FILE: open " + path + ".missing"},
+	}
+	for _, test := range tests {
+		os.Unsetenv("TEST_SECRET")
+		os.Unsetenv("TEST_SECRET_FILE")
+		for key, value := range test.env {
+			t.Setenv(key, value)
+		}
+		value, err := GetEnvSecret("TEST_SECRET", "fallback")
+		if value != test.value || (err == nil) != (test.err == "") || (err != nil && !strings.HasPrefix(err.Error(), test.err)) {
+			t.Errorf("GetEnvSecret() with %v = %q, %v, want %q, %q", test.env, value, err, test.value, test.err)
+		}
+	}
+}
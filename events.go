@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+// UPSEvent is a discrete change of the "ups.status" variable of a UPS device, eg. a power failure.
+type UPSEvent struct {
+	// Name of the event, eg. "power_lost".
+	Event string `json:"event"`
+
+	// Name of the NUT server the UPS device belongs to.
+	Server string `json:"server"`
+
+	// Name of the UPS device.
+	UPS string `json:"ups"`
+
+	// Status flags of the UPS device after the change, eg. "OB DISCHRG".
+	Status string `json:"status"`
+
+	// Status flags of the UPS device before the change, eg. "OL CHRG".
+	PreviousStatus string `json:"previous_status"`
+
+	// Time the change was noticed.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Time the previous state began, or when it was first seen by nuttyqt.
+	PreviousSince time.Time `json:"previous_since"`
+
+	// Duration of the previous state in seconds, eg. how long the UPS device was on battery for "power_restored".
+	PreviousDuration float64 `json:"previous_duration"`
+}
+
+// upsStatusEvent describes the events for a "ups.status" flag being set and cleared.
+type upsStatusEvent struct {
+	Flag    string
+	Set     string
+	Cleared string
+}
+
+// Events for the "ups.status" flags, in the order they are published.
+// "OL" is left out, as it's the opposite of "OB" and would only duplicate its events.
+var upsStatusEvents = []upsStatusEvent{
+	{"OB", "power_lost", "power_restored"},
+	{"LB", "battery_low", "battery_low_cleared"},
+	{"HB", "battery_high", "battery_high_cleared"},
+	{"RB", "replace_battery", "replace_battery_cleared"},
+	{"CHRG", "charging_started", "charging_stopped"},
+	{"DISCHRG", "discharging_started", "discharging_stopped"},
+	{"BYPASS", "bypass_on", "bypass_off"},
+	{"CAL", "calibration_started", "calibration_finished"},
+	{"OFF", "output_off", "output_on"},
+	{"OVER", "overload", "overload_cleared"},
+	{"TRIM", "trim_on", "trim_off"},
+	{"BOOST", "boost_on", "boost_off"},
+	{"FSD", "forced_shutdown", "forced_shutdown_cleared"},
+}
+
+// Event that is published for every change of "ups.status", in addition to the events of the individual flags.
+const upsStatusChangedEvent = "status_changed"
+
+// upsStatusState is the last known "ups.status" of a UPS device.
+type upsStatusState struct {
+	Status string
+	Since  time.Time
+
+	// Time the UPS device was first polled.
+	FirstSeen time.Time
+
+	// Times each flag was last set or cleared, by flag.
+	FlagsSince map[string]time.Time
+}
+
+var (
+	// Last known status of each UPS device, by "<server name>/<ups name>".
+	upsStatusStates      = map[string]*upsStatusState{}
+	upsStatusStatesMutex sync.Mutex
+)
+
+// Get the flags of a "ups.status" value, eg. "OL CHRG" to {"OL": true, "CHRG": true}.
+func upsStatusFlags(status string) map[string]bool {
+	flags := map[string]bool{}
+	for _, flag := range strings.Fields(status) {
+		flags[flag] = true
+	}
+	return flags
+}
+
+// Detect the changes of the "ups.status" variable of a UPS device since the last poll, and return them as events.
+// The first poll of a UPS device only records its status, as there is nothing to compare it with.
+func DetectUPSEvents(server *NUTServer, ups nut.UPS, timestamp time.Time) []UPSEvent {
+	status := strings.Join(strings.Fields(upsVariableString(ups, "ups.status")), " ")
+	if status == "" {
+		return nil
+	}
+
+	upsStatusStatesMutex.Lock()
+	defer upsStatusStatesMutex.Unlock()
+	key := server.Config.Name + "/" + ups.Name
+	state, ok := upsStatusStates[key]
+	if !ok {
+		upsStatusStates[key] = &upsStatusState{Status: status, Since: timestamp, FirstSeen: timestamp, FlagsSince: map[string]time.Time{}}
+		return nil
+	}
+	if state.Status == status {
+		return nil
+	}
+
+	newEvent := func(name string, since time.Time) UPSEvent {
+		return UPSEvent{
+			Event:            name,
+			Server:           server.Config.Name,
+			UPS:              ups.Name,
+			Status:           status,
+			PreviousStatus:   state.Status,
+			Timestamp:        timestamp.UTC(),
+			PreviousSince:    since.UTC(),
+			PreviousDuration: timestamp.Sub(since).Seconds(),
+		}
+	}
+
+	events := []UPSEvent{newEvent(upsStatusChangedEvent, state.Since)}
+	previousFlags, flags := upsStatusFlags(state.Status), upsStatusFlags(status)
+	for _, statusEvent := range upsStatusEvents {
+		if previousFlags[statusEvent.Flag] == flags[statusEvent.Flag] {
+			continue
+		}
+		// Flags that haven't changed since the first poll have been in their state since then.
+		since, ok := state.FlagsSince[statusEvent.Flag]
+		if !ok {
+			since = state.FirstSeen
+		}
+		name := statusEvent.Cleared
+		if flags[statusEvent.Flag] {
+			name = statusEvent.Set
+		}
+		events = append(events, newEvent(name, since))
+		state.FlagsSince[statusEvent.Flag] = timestamp
+	}
+
+	state.Status, state.Since = status, timestamp
+	return events
+}
+
+// Publish an event of a UPS device to "<ups topic>/events".
+func PublishUPSEvent(server *NUTServer, event UPSEvent) error {
+	upsTopic, err := server.UPSTopic(event.UPS)
+	if err != nil {
+		return err
+	}
+	topic := fmt.Sprintf("%s/events", upsTopic)
+	log.Debug("Sending UPS event ", event.Event, " to MQTT broker on topic ", topic, " ...")
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize UPS event to JSON: %w", err)
+	}
+	if err := PublishMQTT(topic, 1, false, eventJSON); err != nil {
+		return fmt.Errorf("failed to send UPS event to MQTT broker: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+func TestDetectUPSEvents(t *testing.T) {
+	server := NewNUTServer(NUTServerConfig{Name: "events-test", Host: "localhost", Port: 3493, TopicPrefix: "events-test"})
+	start := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		status    string
+		seconds   int
+		events    []string
+		durations []float64
+	}{
+		{"OL CHRG", 0, nil, nil},
+		{"OL CHRG", 60, nil, nil},
+		{"OB DISCHRG", 120, []string{"status_changed", "power_lost", "charging_stopped", "discharging_started"}, []float64{120, 120, 120, 120}},
+		{"OB DISCHRG LB", 150, []string{"status_changed", "battery_low"}, []float64{30, 150}},
+		{"OL CHRG", 300, []string{"status_changed", "power_restored", "battery_low_cleared", "charging_started", "discharging_stopped"}, []float64{150, 180, 150, 180, 180}},
+	}
+	for _, test := range tests {
+		ups := nut.UPS{Name: "rack1", Variables: []nut.Variable{{Name: "ups.status", Value: test.status}}}
+		events := DetectUPSEvents(server, ups, start.Add(time.Duration(test.seconds)*time.Second))
+
+		names, durations := []string{}, []float64{}
+		for _, event := range events {
+			names, durations = append(names, event.Event), append(durations, event.PreviousDuration)
+		}
+		if fmt.Sprint(names) != fmt.Sprint(test.events) || fmt.Sprint(durations) != fmt.Sprint(test.durations) {
+			t.Errorf("DetectUPSEvents(%q) at %ds = %v %v, want %v %v", test.status, test.seconds, names, durations, test.events, test.durations)
+		}
+	}
+}
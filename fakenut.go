@@ -2,12 +2,18 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
-	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 type FakeNUTMessage struct {
@@ -40,13 +46,99 @@ type FakeNUTServer struct {
 	// Port to listen on. Defaults to "3493".
 	Port string
 
-	// Map of devices, eg. "FakeUPS: FakeNUTDevice"
+	// Map of devices, eg. "FakeUPS: FakeNUTDevice". Defaults to FakeUPS.
 	Devices map[string]*FakeNUTDevice
+
+	// Certificate for STARTTLS, or nil to answer STARTTLS with "ERR FEATURE-NOT-CONFIGURED". Defaults to the test certificate.
+	TLSCertificate *tls.Certificate
+
+	// Simulated seconds per second, eg. 60 to play out a 30-minute power outage in 30 seconds. Defaults to 1.
+	Rate float64
+
+	// Scenario that the devices play, or nil to only simulate them. Defaults to nil.
+	Scenario *FakeNUTScenario
 	// Commands []FakeNUTCommand
+
+	// Connections of the clients, so they can be closed by the scenario.
+	connectionsMutex sync.Mutex
+	connections      map[net.Conn]struct{}
+
+	// Closed by Stop, which stops the listener, the simulation and the scenario.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+const (
+	// Maximum length of the string variables of a fake NUT device.
+	fakeNUTStringLength = 64
+
+	// Value of ups.timer.shutdown and ups.timer.start while the timer isn't running.
+	fakeNUTTimerIdle = -60
+
+	// Duration of a quick and a deep battery test.
+	fakeNUTQuickTestDuration = 10 * time.Second
+	fakeNUTDeepTestDuration  = 60 * time.Second
+
+	// Time it takes to recharge an empty battery.
+	fakeNUTRechargeDuration = 2 * time.Hour
+
+	// Interval at which the simulation of the fake NUT devices advances.
+	fakeNUTTickInterval = 100 * time.Millisecond
+)
+
+// Instant commands of the fake NUT devices.
+var fakeNUTCommands = []string{
+	"beeper.disable",
+	"beeper.enable",
+	"beeper.mute",
+	"beeper.off",
+	"beeper.on",
+	"fake.power.fail",
+	"fake.power.restore",
+	"load.off",
+	"load.off.delay",
+	"load.on",
+	"load.on.delay",
+	"shutdown.return",
+	"shutdown.stayoff",
+	"shutdown.stop",
+	"test.battery.start.deep",
+	"test.battery.start.quick",
+	"test.battery.stop",
+}
+
+// Variables of the default fake NUT device that can be changed with SET VAR.
+var fakeNUTWritableVariables = []string{
+	"battery.charge.low",
+	"battery.charge.warning",
+	"battery.runtime.low",
+	"input.transfer.high",
+	"input.transfer.low",
+	"ups.delay.shutdown",
+	"ups.delay.start",
+}
+
+// fakeNUTError is an error that the fake NUT server sends to the client, eg. "READONLY" for "ERR READONLY".
+type fakeNUTError string
+
+func (err fakeNUTError) Error() string {
+	return "ERR " + string(err)
+}
+
+// fakeNUTSession is the state of a client connection to the fake NUT server.
+type fakeNUTSession struct {
+	Username string
+	Password string
 }
 
 // FakeNUTDevice represents a fake NUT device.
+// Its variables are the fields with a JSON tag, which are guarded by the mutex as clients may change them with SET VAR.
 type FakeNUTDevice struct {
+	mutex sync.Mutex
+
+	// Variables that can be changed with SET VAR, eg. "battery.charge.low". Other variables are read-only.
+	Writable []string `json:"-"`
+
 	// Battery charge in percent. Example: 100
 	BatteryCharge int `json:"battery.charge"`
 
@@ -172,6 +264,481 @@ type FakeNUTDevice struct {
 
 	// UPS vendor ID. Example: 0764
 	UPSVendorID string `json:"ups.vendorid"`
+
+	// Remaining time of the battery test, and of the shutdown and start timers while they are running.
+	testRemaining     time.Duration
+	shutdownRemaining time.Duration
+	shutdownRunning   bool
+	startRemaining    time.Duration
+	startRunning      bool
+
+	// Whether the load is turned back on after the shutdown timer has expired, once the UPS is on line power.
+	returnAfterShutdown bool
+
+	// Whether the mains power has failed, and the input voltage to restore once it's back.
+	powerFailed  bool
+	mainsVoltage float64
+
+	// Energy and capacity of the battery in joules, and the battery.charge that was last simulated,
+	// so a battery.charge that was set in the meantime is taken over.
+	batteryEnergy   float64
+	batteryCapacity float64
+	simulatedCharge int
+
+	// Whether the battery isn't simulated, as the device plays a scenario or was loaded from a upsc dump.
+	static bool
+
+	// Whether a timer was started, after which the timer variables follow the timers.
+	timersUsed bool
+
+	// Names of the variables in the upsc dump that the device was loaded from, in order, or nil for a device
+	// with all the variables of its fields, and their values as they were dumped or last set.
+	dumped []string
+	raw    map[string]string
+
+	// Error that the commands for the device are answered with, eg. "DATA-STALE", or "" to answer them normally.
+	injectedError string
+}
+
+// Get the field of a variable of the device, or false if the device doesn't have the variable,
+// or the variable was loaded from a upsc dump with a value that doesn't fit the field. The device must be locked.
+func (device *FakeNUTDevice) field(name string) (reflect.Value, bool) {
+	raw, dumped := device.raw[name]
+	if device.dumped != nil && !dumped {
+		return reflect.Value{}, false
+	}
+	deviceValue := reflect.ValueOf(device).Elem()
+	for i := 0; i < deviceValue.NumField(); i++ {
+		if tag := deviceValue.Type().Field(i).Tag.Get("json"); tag != "" && tag != "-" && tag == name {
+			if _, err := parseFakeNUTValue(deviceValue.Field(i).Kind(), raw); dumped && err != nil {
+				return reflect.Value{}, false
+			}
+			return deviceValue.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// Parse the value of a variable for a field of the given kind, eg. reflect.Int for "30".
+func parseFakeNUTValue(kind reflect.Kind, value string) (reflect.Value, error) {
+	switch kind {
+	case reflect.Int:
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return reflect.Value{}, fakeNUTError("INVALID-VALUE")
+		}
+		return reflect.ValueOf(number), nil
+	case reflect.Float64:
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return reflect.Value{}, fakeNUTError("INVALID-VALUE")
+		}
+		return reflect.ValueOf(number), nil
+	default:
+		if len(value) > fakeNUTStringLength {
+			return reflect.Value{}, fakeNUTError("TOO-LONG")
+		}
+		return reflect.ValueOf(value), nil
+	}
+}
+
+// Get the kind of a variable that was loaded from a upsc dump without a field, from its value.
+// The device must be locked.
+func (device *FakeNUTDevice) rawKind(name string) reflect.Kind {
+	if _, err := parseFakeNUTValue(reflect.Float64, device.raw[name]); err == nil {
+		return reflect.Float64
+	}
+	return reflect.String
+}
+
+// Format the value of a variable the way upsd sends it, keeping a decimal for floats, eg. "50.0".
+func formatFakeNUTValue(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Int:
+		return strconv.FormatInt(value.Int(), 10)
+	case reflect.Float64:
+		formatted := strconv.FormatFloat(value.Float(), 'f', -1, 64)
+		if !strings.Contains(formatted, ".") {
+			formatted += ".0"
+		}
+		return formatted
+	default:
+		return value.String()
+	}
+}
+
+// Get the formatted value of a variable, or false if the device doesn't have the variable. The device must be locked.
+func (device *FakeNUTDevice) value(name string) (string, bool) {
+	raw, dumped := device.raw[name]
+	field, ok := device.field(name)
+	if !ok {
+		return raw, dumped
+	}
+	// Keep the value from the upsc dump as it was, eg. "230" instead of "230.0", until it changes.
+	if parsed, err := parseFakeNUTValue(field.Kind(), raw); dumped && err == nil && parsed.Interface() == field.Interface() {
+		return raw, true
+	}
+	return formatFakeNUTValue(field), true
+}
+
+// List the variables of the device with their formatted values, in order.
+func (device *FakeNUTDevice) ListVariables() []NUTListItem {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	items := []NUTListItem{}
+	if device.dumped != nil {
+		for _, name := range device.dumped {
+			value, _ := device.value(name)
+			items = append(items, NUTListItem{Name: name, Value: value})
+		}
+		return items
+	}
+	deviceValue := reflect.ValueOf(device).Elem()
+	for i := 0; i < deviceValue.NumField(); i++ {
+		if tag := deviceValue.Type().Field(i).Tag.Get("json"); tag != "" && tag != "-" {
+			items = append(items, NUTListItem{Name: tag, Value: formatFakeNUTValue(deviceValue.Field(i))})
+		}
+	}
+	return items
+}
+
+// Get the formatted value of a variable, or false if the device doesn't have the variable.
+func (device *FakeNUTDevice) GetVariable(name string) (string, bool) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	return device.value(name)
+}
+
+// Check whether a variable can be changed with SET VAR.
+func (device *FakeNUTDevice) IsWritable(name string) bool {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	for _, writable := range device.Writable {
+		if writable == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the type of a variable the way upsd reports it, eg. "RW NUMBER" or "STRING:64",
+// or false if the device doesn't have the variable.
+func (device *FakeNUTDevice) VariableType(name string) (string, bool) {
+	device.mutex.Lock()
+	kind := reflect.Invalid
+	if field, ok := device.field(name); ok {
+		kind = field.Kind()
+	} else if _, dumped := device.raw[name]; dumped {
+		kind = device.rawKind(name)
+	}
+	device.mutex.Unlock()
+	if kind == reflect.Invalid {
+		return "", false
+	}
+	varType := "NUMBER"
+	if kind == reflect.String {
+		varType = fmt.Sprintf("STRING:%d", fakeNUTStringLength)
+	}
+	if device.IsWritable(name) {
+		varType = "RW " + varType
+	}
+	return varType, true
+}
+
+// Set a variable, after checking that the value is valid for its type. Read-only variables can be set too,
+// so the fake NUT server can change them itself, while SET VAR checks that the variable is writable first.
+func (device *FakeNUTDevice) SetVariable(name string, value string) error {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	field, ok := device.field(name)
+	if !ok {
+		// Variables from a upsc dump without a field keep their value as it is.
+		if _, dumped := device.raw[name]; !dumped {
+			return fakeNUTError("VAR-NOT-SUPPORTED")
+		}
+		if _, err := parseFakeNUTValue(device.rawKind(name), value); err != nil {
+			return err
+		}
+		device.raw[name] = value
+		return nil
+	}
+	parsed, err := parseFakeNUTValue(field.Kind(), value)
+	if err != nil {
+		return err
+	}
+	field.Set(parsed)
+	if device.dumped != nil {
+		device.raw[name] = value
+	}
+	return nil
+}
+
+// Check whether a flag is set in ups.status, eg. "OL". The device must be locked.
+func (device *FakeNUTDevice) hasStatusFlag(flag string) bool {
+	for _, statusFlag := range strings.Fields(device.UPSStatus) {
+		if statusFlag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// Set or clear a flag in ups.status, keeping the order of the other flags. The device must be locked.
+func (device *FakeNUTDevice) setStatusFlag(flag string, set bool) {
+	if set == device.hasStatusFlag(flag) {
+		return
+	}
+	flags := []string{}
+	for _, statusFlag := range strings.Fields(device.UPSStatus) {
+		if statusFlag != flag {
+			flags = append(flags, statusFlag)
+		}
+	}
+	if set {
+		flags = append(flags, flag)
+	}
+	device.UPSStatus = strings.Join(flags, " ")
+}
+
+// Run an instant command, eg. "beeper.disable", and simulate its effect on the variables of the device.
+// Delayed commands take effect as the device ticks.
+func (device *FakeNUTDevice) RunCommand(command string) error {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	switch command {
+	case "beeper.enable", "beeper.on":
+		device.UPSBeeperStatus = "enabled"
+	case "beeper.disable", "beeper.off":
+		device.UPSBeeperStatus = "disabled"
+	case "beeper.mute":
+		device.UPSBeeperStatus = "muted"
+	case "fake.power.fail":
+		device.setPowerFailure(true)
+	case "fake.power.restore":
+		device.setPowerFailure(false)
+	case "load.off":
+		device.shutdownRunning, device.startRunning, device.returnAfterShutdown = false, false, false
+		device.setStatusFlag("OFF", true)
+	case "load.on":
+		device.shutdownRunning, device.startRunning, device.returnAfterShutdown = false, false, false
+		device.setStatusFlag("OFF", false)
+	case "load.off.delay", "shutdown.stayoff":
+		device.startShutdownTimer(false)
+	case "shutdown.return":
+		device.startShutdownTimer(true)
+	case "load.on.delay":
+		device.startStartTimer()
+	case "shutdown.stop":
+		device.shutdownRunning, device.returnAfterShutdown = false, false
+	case "test.battery.start.quick":
+		device.testRemaining = fakeNUTQuickTestDuration
+		device.setStatusFlag("TEST", true)
+	case "test.battery.start.deep":
+		device.testRemaining = fakeNUTDeepTestDuration
+		device.setStatusFlag("TEST", true)
+	case "test.battery.stop":
+		device.testRemaining = 0
+		device.setStatusFlag("TEST", false)
+	default:
+		return fakeNUTError("CMD-NOT-SUPPORTED")
+	}
+	device.advance(0)
+	return nil
+}
+
+// Start the shutdown timer, which turns off the load after ups.delay.shutdown. The device must be locked.
+func (device *FakeNUTDevice) startShutdownTimer(returnAfterShutdown bool) {
+	device.shutdownRemaining = time.Duration(device.UPSDelayShutdown) * time.Second
+	device.shutdownRunning, device.returnAfterShutdown = true, returnAfterShutdown
+	device.startRunning, device.timersUsed = false, true
+}
+
+// Start the start timer, which turns on the load after ups.delay.start. The device must be locked.
+func (device *FakeNUTDevice) startStartTimer() {
+	device.startRemaining = time.Duration(device.UPSDelayStart) * time.Second
+	device.startRunning, device.timersUsed = true, true
+}
+
+// Fail or restore the mains power. While it has failed, the UPS is on battery and the battery drains at the rate of
+// ups.load and ups.realpower.nominal, until the load is turned off when it's empty. Once the mains power is back,
+// the battery recharges, and the load is turned back on after ups.delay.start if the battery had run out.
+func (device *FakeNUTDevice) SetPowerFailure(failed bool) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	device.setPowerFailure(failed)
+}
+
+// Fail or restore the mains power. The device must be locked.
+func (device *FakeNUTDevice) setPowerFailure(failed bool) {
+	if failed == device.powerFailed {
+		return
+	}
+	device.simulateBattery(0)
+	device.powerFailed = failed
+	if failed {
+		device.mainsVoltage, device.InputVoltage = device.InputVoltage, 0
+		device.setStatusFlag("OL", false)
+		device.setStatusFlag("OB", true)
+	} else {
+		device.InputVoltage = device.mainsVoltage
+		device.setStatusFlag("OB", false)
+		device.setStatusFlag("OL", true)
+	}
+	device.advance(0)
+}
+
+// Answer the commands for the device with an error from now on, eg. "DATA-STALE", or answer them normally again with "".
+func (device *FakeNUTDevice) InjectError(code string) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	device.injectedError = code
+}
+
+// Get the error that the commands for the device are answered with, or "" if they are answered normally.
+func (device *FakeNUTDevice) InjectedError() string {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	return device.injectedError
+}
+
+// Power drawn by the load in watts, from ups.load in percent of ups.realpower.nominal. The device must be locked.
+func (device *FakeNUTDevice) loadPower() float64 {
+	return math.Max(float64(device.UPSLoad)*float64(device.UPSRealPowerNominal)/100, 1)
+}
+
+// Drain the battery while the mains power has failed, or recharge it otherwise,
+// and update the battery variables and status flags. The device must be locked.
+func (device *FakeNUTDevice) simulateBattery(elapsed time.Duration) {
+	if device.static {
+		return
+	}
+
+	// Derive the capacity of the battery from the runtime at the initial charge and load.
+	if device.batteryCapacity == 0 {
+		charge := math.Max(float64(device.BatteryCharge), 1) / 100
+		device.batteryCapacity = float64(device.BatteryRuntime) * device.loadPower() / charge
+		device.simulatedCharge = -1
+	}
+	if device.BatteryCharge != device.simulatedCharge {
+		device.batteryEnergy = device.batteryCapacity * float64(device.BatteryCharge) / 100
+	}
+
+	loadOff := device.hasStatusFlag("OFF")
+	if device.powerFailed && !loadOff {
+		device.batteryEnergy -= device.loadPower() * elapsed.Seconds()
+	} else if !device.powerFailed {
+		device.batteryEnergy += device.batteryCapacity * elapsed.Seconds() / fakeNUTRechargeDuration.Seconds()
+	}
+	device.batteryEnergy = math.Min(math.Max(device.batteryEnergy, 0), device.batteryCapacity)
+
+	// Turn off the load when the battery is empty, and turn it back on once the mains power is back.
+	if device.powerFailed && !loadOff && device.batteryEnergy == 0 {
+		device.shutdownRunning, device.startRunning, device.returnAfterShutdown = false, false, true
+		device.setStatusFlag("OFF", true)
+		loadOff = true
+	}
+
+	device.BatteryCharge = int(math.Round(device.batteryEnergy / device.batteryCapacity * 100))
+	device.BatteryRuntime = int(math.Round(device.batteryEnergy / device.loadPower()))
+	device.simulatedCharge = device.BatteryCharge
+	device.setStatusFlag("CHRG", !device.powerFailed && device.batteryEnergy < device.batteryCapacity)
+	device.setStatusFlag("DISCHRG", device.powerFailed && !loadOff)
+	device.setStatusFlag("LB", device.powerFailed && device.BatteryCharge <= device.BatteryChargeLow)
+}
+
+// Advance the simulation of the device.
+func (device *FakeNUTDevice) tick(elapsed time.Duration) {
+	device.mutex.Lock()
+	defer device.mutex.Unlock()
+	device.advance(elapsed)
+}
+
+// Advance the battery, the timers and the battery test of the device, and update the timer variables. The device must be locked.
+func (device *FakeNUTDevice) advance(elapsed time.Duration) {
+	device.simulateBattery(elapsed)
+	if device.testRemaining > 0 {
+		if device.testRemaining -= elapsed; device.testRemaining <= 0 {
+			device.testRemaining = 0
+			device.setStatusFlag("TEST", false)
+		}
+	}
+	if device.startRunning {
+		if device.startRemaining -= elapsed; device.startRemaining <= 0 {
+			device.startRunning = false
+			device.setStatusFlag("OFF", false)
+		}
+	}
+	if device.shutdownRunning {
+		if device.shutdownRemaining -= elapsed; device.shutdownRemaining <= 0 {
+			device.shutdownRunning = false
+			device.setStatusFlag("OFF", true)
+		}
+	}
+	if !device.shutdownRunning && device.returnAfterShutdown && device.hasStatusFlag("OL") {
+		device.returnAfterShutdown = false
+		device.startStartTimer()
+		if device.startRemaining <= 0 {
+			device.startRunning = false
+			device.setStatusFlag("OFF", false)
+		}
+	}
+
+	// The timer variables of a device from a upsc dump stay as they were until a timer is started.
+	if !device.timersUsed {
+		return
+	}
+	device.UPSTimerShutdown, device.UPSTimerStart = fakeNUTTimerIdle, fakeNUTTimerIdle
+	if device.shutdownRunning {
+		device.UPSTimerShutdown = int(math.Ceil(device.shutdownRemaining.Seconds()))
+	}
+	if device.startRunning {
+		device.UPSTimerStart = int(math.Ceil(device.startRemaining.Seconds()))
+	}
+}
+
+// Quote a value for a response of the fake NUT server, escaping it the way upsd does.
+func quoteFakeNUTValue(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// Split a command into its arguments, where quoted arguments may contain spaces and escaped quotes,
+// eg. `SET VAR FakeUPS battery.charge.low "30"`.
+func splitFakeNUTCommand(command string) []string {
+	args := []string{}
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, r := range command {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted, inArg = !quoted, true
+		case r == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
+}
+
+// Hide the password of a PASSWORD command, so it doesn't end up in the logs.
+func redactNUTCommand(command string) string {
+	if strings.HasPrefix(command, "PASSWORD ") {
+		return "PASSWORD <redacted>"
+	}
+	return command
 }
 
 func NewFakeNUTServer() *FakeNUTServer {
@@ -219,28 +786,56 @@ func NewFakeNUTServer() *FakeNUTServer {
 		UPSTimerShutdown:            -60,
 		UPSTimerStart:               -60,
 		UPSVendorID:                 "0764",
+		Writable:                    append([]string{}, fakeNUTWritableVariables...),
 	}
+	device.mainsVoltage = device.InputVoltage
 
 	// Create a new fake NUT server.
 	server := &FakeNUTServer{
 		Host:    "localhost",
 		Port:    "3493",
 		Devices: map[string]*FakeNUTDevice{"FakeUPS": device},
+		Rate:    1,
+		stop:    make(chan struct{}),
 	}
 
-	// Set the server host and/or port if the appropriate environment variables are set.
-	if host, ok := os.LookupEnv("NUT_SERVER"); ok {
-		server.Host = host
-	}
-	if port, ok := os.LookupEnv("NUT_PORT"); ok {
-		server.Port = port
+	// Accept STARTTLS with the test certificate.
+	if certificate, err := tls.X509KeyPair(fakeNUTCertificate, fakeNUTKey); err != nil {
+		log.Warn("Fake NUT server failed to load its test certificate, STARTTLS is disabled: ", err)
+	} else {
+		server.TLSCertificate = &certificate
 	}
 
 	// Return the server.
 	return server
 }
 
-func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, command string) {
+// Create the fake NUT server of a configuration, which listens on the host and port of the first NUT server,
+// at the fake rate, with the devices of the upsc dumps and the scenario if set.
+func NewFakeNUTServerFromConfig(cfg Config) (*FakeNUTServer, error) {
+	server := NewFakeNUTServer()
+	if len(cfg.NUTServers) > 0 {
+		server.Host, server.Port = cfg.NUTServers[0].Host, strconv.Itoa(cfg.NUTServers[0].Port)
+	}
+	server.Rate = cfg.NUTFakeRate
+	if cfg.NUTFakeDumps != "" {
+		devices, err := LoadFakeNUTDumps(cfg.NUTFakeDumps)
+		if err != nil {
+			return nil, err
+		}
+		server.Devices = devices
+	}
+	if cfg.NUTFakeScenario != "" {
+		scenario, err := LoadFakeNUTScenario(cfg.NUTFakeScenario)
+		if err != nil {
+			return nil, err
+		}
+		server.Scenario = scenario
+	}
+	return server, nil
+}
+
+func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, session *fakeNUTSession, command string) {
 	// // Parse the command
 	// parts := strings.Split(cmd, " ")
 	// if len(parts) < 2 {
@@ -249,7 +844,10 @@ func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, command stri
 	// var upsCmd, upsVar string
 	// upsCmd, upsVar = parts[0], parts[1]
 
-	args := strings.Split(command, " ")
+	args := splitFakeNUTCommand(command)
+	if len(args) == 0 {
+		args = []string{""}
+	}
 	cmd := args[0]
 	subCmd := ""
 	subCmdVal := ""
@@ -270,6 +868,28 @@ func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, command stri
 	// The second argument is either a variable or a subcommand, and is optional.
 	// The third argument is the value to set the variable to, and is optional.
 
+	// Answer the commands for a device with its injected error, and LIST UPS with the error of any device.
+	upsNames := []string{}
+	switch {
+	case cmd == "GET" || cmd == "SET" || (cmd == "LIST" && subCmd != "UPS"):
+		upsNames = append(upsNames, subCmdVal)
+	case cmd == "INSTCMD":
+		upsNames = append(upsNames, subCmd)
+	case cmd == "LIST" && subCmd == "UPS":
+		for upsName := range fakeNUTServer.Devices {
+			upsNames = append(upsNames, upsName)
+		}
+		sort.Strings(upsNames)
+	}
+	for _, upsName := range upsNames {
+		if fakeNUTDevice, deviceOk := fakeNUTServer.Devices[upsName]; deviceOk {
+			if code := fakeNUTDevice.InjectedError(); code != "" {
+				fmt.Fprintln(conn, fakeNUTError(code))
+				return
+			}
+		}
+	}
+
 	switch cmd {
 	case "HELP":
 		// Handle HELP command
@@ -324,14 +944,33 @@ func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, command stri
 			}
 			fmt.Fprintf(conn, "UPSDESC %s \"Fake UPS Device\"\n", subCmdVal)
 			// log.Println("Sent UPSDESC response")
-		default:
-			if subCmdVal == "" {
+		case "VAR", "TYPE", "DESC":
+			// Handle GET VAR, GET TYPE and GET DESC commands
+			if subCmdVal == "" || subCmdVar == "" {
 				fmt.Fprintln(conn, "ERR INVALID-ARGUMENT")
-				// log.Println("Sent ERR response")
 				return
 			}
-			fmt.Fprintf(conn, "NUMLOGINS %s 1\n", subCmdVal)
-			// log.Println("Sent NUMLOGINS response")
+			fakeNUTDevice, deviceOk := fakeNUTServer.Devices[subCmdVal]
+			if !deviceOk {
+				fmt.Fprintln(conn, "ERR UNKNOWN-UPS")
+				return
+			}
+			value, varOk := fakeNUTDevice.GetVariable(subCmdVar)
+			if !varOk {
+				fmt.Fprintln(conn, "ERR VAR-NOT-SUPPORTED")
+				return
+			}
+			switch subCmd {
+			case "VAR":
+				fmt.Fprintf(conn, "VAR %s %s %s\n", subCmdVal, subCmdVar, quoteFakeNUTValue(value))
+			case "TYPE":
+				varType, _ := fakeNUTDevice.VariableType(subCmdVar)
+				fmt.Fprintf(conn, "TYPE %s %s %s\n", subCmdVal, subCmdVar, varType)
+			case "DESC":
+				fmt.Fprintf(conn, "DESC %s %s \"Description unavailable\"\n", subCmdVal, subCmdVar)
+			}
+		default:
+			fmt.Fprintln(conn, "ERR INVALID-ARGUMENT")
 		}
 	case "LIST":
 		// TODO: Handle LIST command
@@ -364,97 +1003,96 @@ func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, command stri
 				return
 			}
 			fmt.Fprintf(conn, "BEGIN LIST CMD %s\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s beeper.disable\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s beeper.enable\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s beeper.mute\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s beeper.off\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s beeper.on\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s load.off\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s load.off.delay\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s load.on\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s load.on.delay\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s shutdown.return\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s shutdown.stayoff\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s shutdown.stop\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s test.battery.start.deep\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s test.battery.start.quick\n", subCmdVal)
-			fmt.Fprintf(conn, "CMD %s test.battery.stop\n", subCmdVal)
+			for _, instantCommand := range fakeNUTCommands {
+				fmt.Fprintf(conn, "CMD %s %s\n", subCmdVal, instantCommand)
+			}
 			fmt.Fprintf(conn, "END LIST CMD %s\n", subCmdVal)
 			// log.Println("Sent LIST CMD response")
-		case "VAR":
-			// Handle LIST VAR command
+		case "VAR", "RW":
+			// Handle LIST VAR and LIST RW commands
 			if subCmdVal == "" {
 				fmt.Fprintln(conn, "ERR INVALID-ARGUMENT")
 				// log.Println("Sent ERR response")
 				return
 			}
-			fmt.Fprintf(conn, "BEGIN LIST VAR %s\n", subCmdVal)
-			// log.Println("Sent LIST VAR header")
-
-			// Get the device based on the UPS command name
-			var fakeNUTDevice *FakeNUTDevice
-			var deviceOk bool
-			if fakeNUTDevice, deviceOk = fakeNUTServer.Devices[subCmdVal]; !deviceOk {
-				fmt.Fprintf(conn, "ERR NOSUCHCMD %s\n", subCmdVal)
-				// log.Println("Sent ERR response")
-			}
-
-			// Use reflection to get and print all field values from the fakeNUTDevice
-			fakeNUTDeviceValue := reflect.ValueOf(fakeNUTDevice).Elem()
-			for i := 0; i < fakeNUTDeviceValue.NumField(); i++ {
-				field := fakeNUTDeviceValue.Type().Field(i)
 
-				// Get the JSON tag value from the field
-				jsonTag := field.Tag.Get("json")
-
-				// Get the field value from the fakeNUTDevice
-				fieldValue := fakeNUTDeviceValue.Field(i)
-
-				fmt.Fprintf(conn, "VAR %s %s \"%s\"\n", subCmdVal, jsonTag, fieldValue)
-				// log.Println("Sent VAR response: VAR", subCmdVal, jsonTag, fieldValue)
+			// Get the device based on the UPS name
+			fakeNUTDevice, deviceOk := fakeNUTServer.Devices[subCmdVal]
+			if !deviceOk {
+				fmt.Fprintln(conn, "ERR UNKNOWN-UPS")
+				return
 			}
 
-			fmt.Fprintf(conn, "END LIST VAR %s\n", subCmdVal)
-			// log.Println("Sent LIST VAR footer")
-
-			// // Print all the variables for the device in the format required by NUT
-			// for _, variable := range fakeNUTDevice.Variables {
-			// 	fmt.Fprintf(conn, "VAR %s %s %s", subCmdVal, variable.Name, variable.Type)
-			// }
-			// fmt.Fprintln(conn, "END LIST VAR %s", subCmdVal)
-
-			// // Use reflection to get the field value from the fakeNUTDevice
-			// fieldValue := reflect.ValueOf(&fakeNUTDevice).Elem().FieldByName(upsCommand.Arg)
-			// if !fieldValue.IsValid() {
-			// 	fmt.Fprintf(conn, "ERR BADVAR %s\n", upsCommand.Arg)
-			// 	return
-			// }
-
-			// // Compare the requested value to the actual value using reflection
-			// requestedValue := reflect.ValueOf(upsCommand.Arg)
-			// if requestedValue.Type() != fieldValue.Type() {
-			// 	fmt.Fprintf(conn, "ERR BADTYPE %s\n", upsCommand.Arg)
-			// 	return
-			// }
-			// if requestedValue.Interface() != fieldValue.Interface() {
-			// 	fmt.Fprintf(conn, "ERR REJECTED %s\n", upsCommand.Arg)
-			// 	return
-			// }
-
-			// // Return the value of the requested variable
-			// fmt.Fprintf(conn, "OK %s %v\n", upsCommand.Arg, fieldValue.Interface())
+			fmt.Fprintf(conn, "BEGIN LIST %s %s\n", subCmd, subCmdVal)
+			for _, variable := range fakeNUTDevice.ListVariables() {
+				if subCmd == "RW" && !fakeNUTDevice.IsWritable(variable.Name) {
+					continue
+				}
+				fmt.Fprintf(conn, "%s %s %s %s\n", subCmd, subCmdVal, variable.Name, quoteFakeNUTValue(variable.Value))
+			}
+			fmt.Fprintf(conn, "END LIST %s %s\n", subCmd, subCmdVal)
 		default:
 			fmt.Fprintln(conn, "ERR INVALID-ARGUMENT")
 			// log.Println("Sent ERR response")
 		}
 	case "SET":
-		// TODO: Handle SET command
-		fmt.Fprintln(conn, "ERR INVALID ARGUMENT")
-		// log.Println("Sent ERR response")
+		// Handle SET VAR command, eg. `SET VAR FakeUPS battery.charge.low "30"`
+		if subCmd != "VAR" || len(args) != 5 {
+			fmt.Fprintln(conn, "ERR INVALID-ARGUMENT")
+			return
+		}
+		if session.Username == "" {
+			fmt.Fprintln(conn, "ERR USERNAME-REQUIRED")
+			return
+		}
+		if session.Password == "" {
+			fmt.Fprintln(conn, "ERR PASSWORD-REQUIRED")
+			return
+		}
+		fakeNUTDevice, deviceOk := fakeNUTServer.Devices[subCmdVal]
+		if !deviceOk {
+			fmt.Fprintln(conn, "ERR UNKNOWN-UPS")
+			return
+		}
+		if _, varOk := fakeNUTDevice.GetVariable(subCmdVar); !varOk {
+			fmt.Fprintln(conn, "ERR VAR-NOT-SUPPORTED")
+			return
+		}
+		if !fakeNUTDevice.IsWritable(subCmdVar) {
+			fmt.Fprintln(conn, "ERR READONLY")
+			return
+		}
+		if err := fakeNUTDevice.SetVariable(subCmdVar, args[4]); err != nil {
+			fmt.Fprintln(conn, err)
+			return
+		}
+		log.Printf("Fake NUT server set variable %s of %s to %q", subCmdVar, subCmdVal, args[4])
+		fmt.Fprintln(conn, "OK")
 	case "INSTCMD":
-		// Handle INSTCMD command
-		fmt.Fprintln(conn, "ERR USERNAME-REQUIRED")
-		// log.Println("Sent ERR response")
+		// Handle INSTCMD command, eg. "INSTCMD FakeUPS beeper.disable"
+		if subCmd == "" || subCmdVal == "" {
+			fmt.Fprintln(conn, "ERR INVALID-ARGUMENT")
+			return
+		}
+		if session.Username == "" {
+			fmt.Fprintln(conn, "ERR USERNAME-REQUIRED")
+			return
+		}
+		if session.Password == "" {
+			fmt.Fprintln(conn, "ERR PASSWORD-REQUIRED")
+			return
+		}
+		fakeNUTDevice, deviceOk := fakeNUTServer.Devices[subCmd]
+		if !deviceOk {
+			fmt.Fprintln(conn, "ERR UNKNOWN-UPS")
+			return
+		}
+		if err := fakeNUTDevice.RunCommand(subCmdVal); err != nil {
+			fmt.Fprintln(conn, err)
+			return
+		}
+		log.Printf("Fake NUT server ran instant command %s on %s", subCmdVal, subCmd)
+		fmt.Fprintln(conn, "OK")
 	case "LOGIN":
 		// Handle LOGIN command
 		fmt.Fprintln(conn, "OK")
@@ -465,10 +1103,12 @@ func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, command stri
 		// log.Println("Sent OK response")
 	case "USERNAME":
 		// Handle USERNAME command
+		session.Username = subCmd
 		fmt.Fprintln(conn, "OK")
 		// log.Println("Sent OK response")
 	case "PASSWORD":
 		// Handle PASSWORD command
+		session.Password = subCmd
 		fmt.Fprintln(conn, "OK")
 		// log.Println("Sent OK response")
 	case "STARTTLS":
@@ -535,7 +1175,14 @@ func (fakeNUTServer *FakeNUTServer) handleUPSCommand(conn net.Conn, command stri
 	// return err
 }
 
+// Serve the devices until Stop is called, and then wait for the simulation and the scenario to stop.
 func (fakeNUTServer *FakeNUTServer) Start() error {
+	if fakeNUTServer.Scenario != nil {
+		if err := fakeNUTServer.checkScenario(); err != nil {
+			return err
+		}
+	}
+
 	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%s", fakeNUTServer.Host, fakeNUTServer.Port))
 	if err != nil {
 		return fmt.Errorf("Fake NUT server failed to start server: %w", err)
@@ -543,25 +1190,59 @@ func (fakeNUTServer *FakeNUTServer) Start() error {
 	defer listener.Close()
 
 	log.Printf("Fake NUT server listening on %s:%s", fakeNUTServer.Host, fakeNUTServer.Port)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fakeNUTServer.simulate()
+	}()
+	if fakeNUTServer.Scenario != nil {
+		for name, steps := range fakeNUTServer.Scenario.Devices {
+			wg.Add(1)
+			go func(name string, steps []FakeNUTScenarioStep) {
+				defer wg.Done()
+				fakeNUTServer.playScenario(name, steps)
+			}(name, steps)
+		}
+	}
+
+	// Closing the listener stops the loop below.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-fakeNUTServer.stop
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			select {
+			case <-fakeNUTServer.stop:
+				log.Printf("Fake NUT server stopped listening on %s:%s", fakeNUTServer.Host, fakeNUTServer.Port)
+				return nil
+			default:
+			}
 			log.Printf("Fake NUT server error accepting connection: %v", err)
 			continue
 		}
 
 		// log.Printf("Fake NUT server accepted connection from %s", conn.RemoteAddr())
 
+		fakeNUTServer.trackConnection(conn, true)
 		go func() {
-			defer conn.Close()
+			defer fakeNUTServer.trackConnection(conn, false)
+			defer func() { conn.Close() }()
 
 			reader := bufio.NewReader(conn)
+			isTLS := false
+			session := &fakeNUTSession{}
 
 			for {
 				command, err := reader.ReadString('\n')
 				if err != nil {
-					if err != io.EOF {
+					if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 						log.Printf("Fake NUT server error reading from connection: %v", err)
 					}
 					return
@@ -569,11 +1250,25 @@ func (fakeNUTServer *FakeNUTServer) Start() error {
 
 				command = strings.TrimSpace(command)
 
-				if config.Verbose {
-					log.Printf("Fake NUT server received command from %s: %s", conn.RemoteAddr(), command)
+				log.Debugf("Fake NUT server received command from %s: %s", conn.RemoteAddr(), redactNUTCommand(command))
+
+				// Switch the connection to TLS, which has to be handled here as it replaces the connection itself.
+				if command == "STARTTLS" && fakeNUTServer.TLSCertificate != nil {
+					if isTLS {
+						fmt.Fprintln(conn, "ERR ALREADY-SSL-MODE")
+						continue
+					}
+					fmt.Fprintln(conn, "OK STARTTLS")
+					tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{*fakeNUTServer.TLSCertificate}, MinVersion: tls.VersionTLS12})
+					if err := tlsConn.Handshake(); err != nil {
+						log.Printf("Fake NUT server TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+						return
+					}
+					conn, reader, isTLS = tlsConn, bufio.NewReader(tlsConn), true
+					continue
 				}
 
-				fakeNUTServer.handleUPSCommand(conn, command)
+				fakeNUTServer.handleUPSCommand(conn, session, command)
 
 				// if strings.HasPrefix(command, "UPS") {
 				// 	fakeNUTServer.handleUPSCommand(conn, command)
@@ -589,9 +1284,60 @@ func (fakeNUTServer *FakeNUTServer) Start() error {
 	}
 }
 
-// FIXME: Implement this!
+// Add or remove the connection of a client.
+func (fakeNUTServer *FakeNUTServer) trackConnection(conn net.Conn, open bool) {
+	fakeNUTServer.connectionsMutex.Lock()
+	defer fakeNUTServer.connectionsMutex.Unlock()
+	if fakeNUTServer.connections == nil {
+		fakeNUTServer.connections = map[net.Conn]struct{}{}
+	}
+	if open {
+		select {
+		case <-fakeNUTServer.stop:
+			// Accepted while stopping, after the other clients were disconnected.
+			conn.Close()
+			return
+		default:
+		}
+		fakeNUTServer.connections[conn] = struct{}{}
+	} else {
+		delete(fakeNUTServer.connections, conn)
+	}
+}
+
+// Close the connections of all clients, eg. to simulate a restart of upsd.
+func (fakeNUTServer *FakeNUTServer) DisconnectClients() {
+	fakeNUTServer.connectionsMutex.Lock()
+	defer fakeNUTServer.connectionsMutex.Unlock()
+	for conn := range fakeNUTServer.connections {
+		conn.Close()
+	}
+	log.Printf("Fake NUT server disconnected %d clients", len(fakeNUTServer.connections))
+}
+
+// Advance the simulation of the devices in the background, at the rate of the server.
+func (fakeNUTServer *FakeNUTServer) simulate() {
+	ticker := time.NewTicker(fakeNUTTickInterval)
+	defer ticker.Stop()
+	elapsed := time.Duration(float64(fakeNUTTickInterval) * fakeNUTServer.Rate)
+	for {
+		select {
+		case <-ticker.C:
+			for _, device := range fakeNUTServer.Devices {
+				device.tick(elapsed)
+			}
+		case <-fakeNUTServer.stop:
+			return
+		}
+	}
+}
+
+// Stop listening, the simulation and the scenario, and disconnect the clients.
 func (fakeNUTServer *FakeNUTServer) Stop() error {
-	log.Println("NOTICE: Fake NUT server graceful shutdown not implemented yet!")
+	fakeNUTServer.stopOnce.Do(func() {
+		close(fakeNUTServer.stop)
+		fakeNUTServer.DisconnectClients()
+	})
 	return nil
 }
 
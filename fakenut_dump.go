@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Load a device from a upsc dump, eg. the output of `upsc rack1@localhost`, with a "<variable>: <value>" line for each variable.
+// The device has exactly the variables of the dump with their values as they were dumped, and its battery isn't simulated.
+func LoadFakeNUTDump(path string) (*FakeNUTDevice, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upsc dump: %w", err)
+	}
+	defer file.Close()
+
+	device := &FakeNUTDevice{
+		Writable: append([]string{}, fakeNUTWritableVariables...),
+		static:   true,
+		dumped:   []string{},
+		raw:      map[string]string{},
+	}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		// Skip what upsc writes besides the variables, eg. "Init SSL without certificate database".
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			log.Warnf("Fake NUT server skips line %d of upsc dump %s: %q", lineNumber, path, line)
+			continue
+		}
+		if _, exists := device.raw[name]; exists {
+			return nil, fmt.Errorf("upsc dump %s has variable %s twice, on line %d", path, name, lineNumber)
+		}
+		device.dumped = append(device.dumped, name)
+		device.raw[name] = strings.TrimPrefix(value, " ")
+
+		// Variables with a field are also set on the field, so the commands and the scenario work with them.
+		if field, ok := device.field(name); ok {
+			parsed, _ := parseFakeNUTValue(field.Kind(), device.raw[name])
+			field.Set(parsed)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read upsc dump %s: %w", path, err)
+	}
+	if len(device.dumped) == 0 {
+		return nil, fmt.Errorf("upsc dump %s has no variables", path)
+	}
+	device.mainsVoltage = device.InputVoltage
+	return device, nil
+}
+
+// Load a device from each upsc dump in a directory, named after the file without its extension, eg. "rack1" for rack1.txt.
+func LoadFakeNUTDumps(dir string) (map[string]*FakeNUTDevice, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upsc dumps: %w", err)
+	}
+
+	devices := map[string]*FakeNUTDevice{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		if name == "" || strings.ContainsAny(name, " \t") {
+			return nil, fmt.Errorf("upsc dump %s has no valid UPS name, eg. rack1.txt", filepath.Join(dir, entry.Name()))
+		}
+		if _, exists := devices[name]; exists {
+			return nil, fmt.Errorf("upsc dumps in %s have more than one file for %s", dir, name)
+		}
+		device, err := LoadFakeNUTDump(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		devices[name] = device
+	}
+	if len(devices) == 0 {
+		return nil, fmt.Errorf("%s has no upsc dumps", dir)
+	}
+	return devices, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FakeNUTScenario is a timeline of changes to the devices of the fake NUT server, eg. to play out a power outage.
+type FakeNUTScenario struct {
+	// Start over after the last step, instead of keeping the state of the last step. Defaults to false.
+	Loop bool `yaml:"loop"`
+
+	// Steps of each device by its name, eg. "FakeUPS".
+	Devices map[string][]FakeNUTScenarioStep `yaml:"devices"`
+}
+
+// FakeNUTScenarioStep changes a device of the fake NUT server, and then waits before the next step.
+type FakeNUTScenarioStep struct {
+	// Variables to set, eg. "battery.charge: 15".
+	Set map[string]string `yaml:"set"`
+
+	// ups.status to set, eg. "OB DISCHRG LB".
+	Status *string `yaml:"status"`
+
+	// Fail or restore the mains power, either "failed" or "restored", like the fake.power.fail and fake.power.restore
+	// instant commands, after the variables have been set.
+	Power string `yaml:"power"`
+
+	// Error to answer the commands for the device with from now on, eg. "DATA-STALE", or "" to stop answering with an error.
+	Error *string `yaml:"error"`
+
+	// Close the connections of all clients, after the variables have been set.
+	Disconnect bool `yaml:"disconnect"`
+
+	// Simulated time to wait before the next step, eg. "60s", which is shortened by the rate of the server.
+	For time.Duration `yaml:"for"`
+}
+
+// Load a scenario from a YAML or JSON file.
+func LoadFakeNUTScenario(path string) (*FakeNUTScenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fake NUT scenario: %w", err)
+	}
+
+	// JSON is valid YAML, so both are parsed the same way. Unknown fields are rejected, so typos don't go unnoticed.
+	scenario := &FakeNUTScenario{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(scenario); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse fake NUT scenario %s: %w", path, err)
+	}
+
+	if len(scenario.Devices) == 0 {
+		return nil, fmt.Errorf("fake NUT scenario %s has no devices", path)
+	}
+	for name, steps := range scenario.Devices {
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("fake NUT scenario %s has no steps for %s", path, name)
+		}
+		var duration time.Duration
+		for i, step := range steps {
+			if step.For < 0 {
+				return nil, fmt.Errorf("fake NUT scenario %s has a negative duration in step %d of %s", path, i+1, name)
+			}
+			if step.Power != "" && step.Power != "failed" && step.Power != "restored" {
+				return nil, fmt.Errorf("fake NUT scenario %s has an unknown power %q in step %d of %s, use failed or restored", path, step.Power, i+1, name)
+			}
+			duration += step.For
+		}
+		// A loop without any waiting would keep the device busy.
+		if scenario.Loop && duration == 0 {
+			return nil, fmt.Errorf("fake NUT scenario %s loops without waiting for %s", path, name)
+		}
+	}
+	return scenario, nil
+}
+
+// Check that the devices and variables of the scenario exist on the server.
+func (fakeNUTServer *FakeNUTServer) checkScenario() error {
+	for name, steps := range fakeNUTServer.Scenario.Devices {
+		device, ok := fakeNUTServer.Devices[name]
+		if !ok {
+			return fmt.Errorf("Fake NUT server has no device %s for its scenario", name)
+		}
+		for i, step := range steps {
+			for variable := range step.Set {
+				if _, ok := device.GetVariable(variable); !ok {
+					return fmt.Errorf("Fake NUT server device %s has no variable %s for step %d of its scenario", name, variable, i+1)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Play the scenario of a device, looping over its steps if the scenario loops. Unless the scenario fails the power,
+// the battery of the device isn't simulated, so its variables only change with the scenario, SET VAR and instant commands.
+func (fakeNUTServer *FakeNUTServer) playScenario(name string, steps []FakeNUTScenarioStep) {
+	device := fakeNUTServer.Devices[name]
+	simulated := false
+	for _, step := range steps {
+		simulated = simulated || step.Power != ""
+	}
+	device.mutex.Lock()
+	device.static = device.static || !simulated
+	device.mutex.Unlock()
+
+	for {
+		for _, step := range steps {
+			fakeNUTServer.playScenarioStep(name, device, step)
+			select {
+			case <-time.After(time.Duration(float64(step.For) / fakeNUTServer.Rate)):
+			case <-fakeNUTServer.stop:
+				return
+			}
+		}
+		if !fakeNUTServer.Scenario.Loop {
+			log.Printf("Fake NUT server finished the scenario of %s", name)
+			return
+		}
+	}
+}
+
+// Apply a step of the scenario to a device.
+func (fakeNUTServer *FakeNUTServer) playScenarioStep(name string, device *FakeNUTDevice, step FakeNUTScenarioStep) {
+	// Set the variables in order, so the step plays out the same way every time.
+	variables := make([]string, 0, len(step.Set))
+	for variable := range step.Set {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+	for _, variable := range variables {
+		if err := device.SetVariable(variable, step.Set[variable]); err != nil {
+			log.Warnf("Fake NUT server failed to set variable %s of %s to %q for its scenario: %v", variable, name, step.Set[variable], err)
+		}
+	}
+	if step.Status != nil {
+		_ = device.SetVariable("ups.status", strings.Join(strings.Fields(*step.Status), " "))
+	}
+	if step.Power != "" {
+		device.SetPowerFailure(step.Power == "failed")
+	}
+	if step.Error != nil {
+		device.InjectError(*step.Error)
+	}
+	if step.Disconnect {
+		fakeNUTServer.DisconnectClients()
+	}
+}
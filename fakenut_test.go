@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Send commands to the fake NUT server over a single connection, and get the first line of each response.
+func fakeNUTExchange(t *testing.T, port int, commands ...string) []string {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	responses := []string{}
+	for _, command := range commands {
+		fmt.Fprintln(conn, command)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		responses = append(responses, strings.TrimSpace(line))
+	}
+	return responses
+}
+
+func TestFakeNUTServerSetVar(t *testing.T) {
+	port := startTestFakeNUTServer(t)
+
+	tests := []struct {
+		command  string
+		response string
+	}{
+		{`SET VAR FakeUPS battery.charge.low "30"`, "ERR USERNAME-REQUIRED"},
+		{"USERNAME fakeuser", "OK"},
+		{"PASSWORD fakepass", "OK"},
+		{`SET VAR FakeUPS battery.charge.low "30"`, "OK"},
+		{"GET VAR FakeUPS battery.charge.low", `VAR FakeUPS battery.charge.low "30"`},
+		{`SET VAR FakeUPS battery.charge.low "thirty"`, "ERR INVALID-VALUE"},
+		{`SET VAR FakeUPS battery.charge "50"`, "ERR READONLY"},
+		{`SET VAR FakeUPS battery.charge.high "50"`, "ERR VAR-NOT-SUPPORTED"},
+		{`SET VAR OtherUPS battery.charge.low "30"`, "ERR UNKNOWN-UPS"},
+		{"GET TYPE FakeUPS battery.charge.low", "TYPE FakeUPS battery.charge.low RW NUMBER"},
+		{"GET TYPE FakeUPS device.model", "TYPE FakeUPS device.model STRING:64"},
+		{"GET VAR FakeUPS input.frequency", `VAR FakeUPS input.frequency "50.0"`},
+	}
+	commands := []string{}
+	for _, test := range tests {
+		commands = append(commands, test.command)
+	}
+	for i, response := range fakeNUTExchange(t, port, commands...) {
+		if response != tests[i].response {
+			t.Errorf("%s = %q, want %q", tests[i].command, response, tests[i].response)
+		}
+	}
+
+	// The bridge writes the variable and reads the new value back, which later polls see too.
+	server := NewNUTServer(NUTServerConfig{Host: "127.0.0.1", Port: port, User: "fakeuser", Pass: "fakepass", AllowCleartextAuth: true})
+	defer server.Close()
+	if newValue, err := server.SetVariable("FakeUPS", "ups.delay.shutdown", "45"); err != nil || newValue != "45" {
+		t.Errorf("SetVariable() = %q, %v, want 45", newValue, err)
+	}
+	if _, err := server.SetVariable("FakeUPS", "ups.load", "50"); NUTErrorCode(err) != "READONLY" {
+		t.Errorf("SetVariable() of a read-only variable = %v, want READONLY", err)
+	}
+	variables, err := server.ListVariables("FakeUPS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, variable := range variables {
+		values[variable.Name] = variable.Value
+	}
+	if values["ups.delay.shutdown"] != "45" || values["battery.charge"] != "100" {
+		t.Errorf("LIST VAR has ups.delay.shutdown %q and battery.charge %q, want 45 and 100", values["ups.delay.shutdown"], values["battery.charge"])
+	}
+}
+
+func TestSplitFakeNUTCommand(t *testing.T) {
+	args := splitFakeNUTCommand(`SET VAR FakeUPS device.location "Rack \"1\", row 2"`)
+	want := []string{"SET", "VAR", "FakeUPS", "device.location", `Rack "1", row 2`}
+	if fmt.Sprint(args) != fmt.Sprint(want) || len(args) != len(want) {
+		t.Errorf("splitFakeNUTCommand() = %q, want %q", args, want)
+	}
+	if args := splitFakeNUTCommand(`SET VAR FakeUPS ups.id ""`); len(args) != 5 || args[4] != "" {
+		t.Errorf("splitFakeNUTCommand() with an empty value = %q, want 5 arguments", args)
+	}
+}
+
+func TestFakeNUTServerInstCmd(t *testing.T) {
+	port := startTestFakeNUTServer(t)
+
+	tests := []struct {
+		command  string
+		response string
+	}{
+		{"INSTCMD FakeUPS beeper.enable", "ERR USERNAME-REQUIRED"},
+		{"USERNAME fakeuser", "OK"},
+		{"PASSWORD fakepass", "OK"},
+		{"INSTCMD FakeUPS beeper.enable", "OK"},
+		{"GET VAR FakeUPS ups.beeper.status", `VAR FakeUPS ups.beeper.status "enabled"`},
+		{"INSTCMD FakeUPS test.battery.start.quick", "OK"},
+		{"GET VAR FakeUPS ups.status", `VAR FakeUPS ups.status "OL TEST"`},
+		{"INSTCMD FakeUPS shutdown.return", "OK"},
+		{"GET VAR FakeUPS ups.timer.shutdown", `VAR FakeUPS ups.timer.shutdown "20"`},
+		{"INSTCMD FakeUPS fake.power.fail", "OK"},
+		{"GET VAR FakeUPS input.voltage", `VAR FakeUPS input.voltage "0.0"`},
+		{"INSTCMD FakeUPS fake.power.restore", "OK"},
+		{"GET VAR FakeUPS input.voltage", `VAR FakeUPS input.voltage "232.6"`},
+		{"INSTCMD FakeUPS calibrate.start", "ERR CMD-NOT-SUPPORTED"},
+		{"INSTCMD OtherUPS beeper.enable", "ERR UNKNOWN-UPS"},
+	}
+	commands := []string{}
+	for _, test := range tests {
+		commands = append(commands, test.command)
+	}
+	for i, response := range fakeNUTExchange(t, port, commands...) {
+		if response != tests[i].response {
+			t.Errorf("%s = %q, want %q", tests[i].command, response, tests[i].response)
+		}
+	}
+
+	// The bridge sends instant commands with its credentials.
+	server := NewNUTServer(NUTServerConfig{Host: "127.0.0.1", Port: port, User: "fakeuser", Pass: "fakepass", AllowCleartextAuth: true})
+	defer server.Close()
+	if err := server.SendCommand("FakeUPS", "beeper.disable"); err != nil {
+		t.Errorf("SendCommand() = %v, want nil", err)
+	}
+	if err := server.SendCommand("FakeUPS", "calibrate.start"); NUTErrorCode(err) != "CMD-NOT-SUPPORTED" {
+		t.Errorf("SendCommand() of an unknown command = %v, want CMD-NOT-SUPPORTED", err)
+	}
+}
+
+func TestFakeNUTDeviceCommands(t *testing.T) {
+	device := NewFakeNUTServer().Devices["FakeUPS"]
+	expect := func(step string, status string, timerShutdown int, timerStart int) {
+		t.Helper()
+		if device.UPSStatus != status || device.UPSTimerShutdown != timerShutdown || device.UPSTimerStart != timerStart {
+			t.Errorf("%s: status %q with timers %d and %d, want %q with %d and %d",
+				step, device.UPSStatus, device.UPSTimerShutdown, device.UPSTimerStart, status, timerShutdown, timerStart)
+		}
+	}
+
+	// The battery test ends by itself.
+	_ = device.RunCommand("test.battery.start.quick")
+	device.tick(fakeNUTQuickTestDuration)
+	expect("quick test", "OL", fakeNUTTimerIdle, fakeNUTTimerIdle)
+
+	// The load is turned off after ups.delay.shutdown (20s), and back on after ups.delay.start (30s) as the UPS is on line power.
+	_ = device.RunCommand("shutdown.return")
+	device.tick(5500 * time.Millisecond)
+	expect("shutdown timer", "OL", 15, fakeNUTTimerIdle)
+	device.tick(15 * time.Second)
+	expect("shutdown", "OL OFF", fakeNUTTimerIdle, 30)
+	device.tick(30 * time.Second)
+	expect("return", "OL", fakeNUTTimerIdle, fakeNUTTimerIdle)
+
+	// The shutdown can be stopped before the timer expires, while shutdown.stayoff doesn't return.
+	_ = device.RunCommand("shutdown.stayoff")
+	device.tick(10 * time.Second)
+	_ = device.RunCommand("shutdown.stop")
+	expect("stopped shutdown", "OL", fakeNUTTimerIdle, fakeNUTTimerIdle)
+	_ = device.RunCommand("shutdown.stayoff")
+	device.tick(time.Minute)
+	expect("stay off", "OL OFF", fakeNUTTimerIdle, fakeNUTTimerIdle)
+	_ = device.RunCommand("load.on")
+	expect("load on", "OL", fakeNUTTimerIdle, fakeNUTTimerIdle)
+}
+
+func TestFakeNUTDevicePowerFailure(t *testing.T) {
+	// The battery lasts 1620 seconds at a load of 12% of 1320W.
+	device := NewFakeNUTServer().Devices["FakeUPS"]
+	expect := func(step string, status string, charge int, runtime int) {
+		t.Helper()
+		if device.UPSStatus != status || device.BatteryCharge != charge || device.BatteryRuntime != runtime {
+			t.Errorf("%s: status %q with battery.charge %d and battery.runtime %d, want %q with %d and %d",
+				step, device.UPSStatus, device.BatteryCharge, device.BatteryRuntime, status, charge, runtime)
+		}
+	}
+
+	device.SetPowerFailure(true)
+	expect("power failure", "OB DISCHRG", 100, 1620)
+	if device.InputVoltage != 0 {
+		t.Errorf("input.voltage = %v during a power failure, want 0", device.InputVoltage)
+	}
+	device.tick(10 * time.Minute)
+	expect("discharging", "OB DISCHRG", 63, 1020)
+
+	// Low battery is raised at battery.charge.low (20%), and the load is turned off once the battery is empty.
+	device.tick(700 * time.Second)
+	expect("low battery", "OB DISCHRG LB", 20, 320)
+	device.tick(10 * time.Minute)
+	expect("empty battery", "OB LB OFF", 0, 0)
+
+	// The battery recharges once the power is back, and the load is turned back on after ups.delay.start.
+	device.SetPowerFailure(false)
+	expect("power restored", "OFF OL CHRG", 0, 0)
+	if device.InputVoltage != 232.6 || device.UPSTimerStart != 30 {
+		t.Errorf("input.voltage = %v and ups.timer.start = %d after the power failure, want 232.6 and 30", device.InputVoltage, device.UPSTimerStart)
+	}
+	device.tick(time.Hour)
+	expect("recharging", "OL CHRG", 50, 810)
+	device.tick(time.Hour)
+	expect("recharged", "OL", 100, 1620)
+
+	// A battery.charge that was set in the meantime is taken over.
+	_ = device.SetVariable("battery.charge", "50")
+	device.SetPowerFailure(true)
+	expect("power failure at 50%", "OB DISCHRG", 50, 810)
+}
+
+func TestFakeNUTServerRate(t *testing.T) {
+	var device *FakeNUTDevice
+	port := startTestFakeNUTServer(t, func(server *FakeNUTServer) {
+		server.Rate = 600
+		device = server.Devices["FakeUPS"]
+	})
+	device.SetPowerFailure(true)
+
+	// At 600 simulated seconds per second, the battery runs low after about 2 seconds.
+	for i := 0; i < 50; i++ {
+		if response := fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status")[0]; strings.Contains(response, "LB") {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("ups.status = %q after 5 seconds of a power failure at a rate of 600, want LB", fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status")[0])
+}
+
+func TestLoadFakeNUTScenario(t *testing.T) {
+	scenario, err := LoadFakeNUTScenario("samples/scenarios/outage.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := scenario.Devices["FakeUPS"]
+	if scenario.Loop || len(steps) != 6 || *steps[1].Status != "OB DISCHRG" || steps[1].For != time.Minute || steps[2].Set["battery.charge"] != "15" {
+		t.Errorf("LoadFakeNUTScenario() = %+v, want the 6 steps of the power outage", scenario)
+	}
+
+	dir := t.TempDir()
+	write := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	scenario, err = LoadFakeNUTScenario(write("scenario.json", `{"loop": true, "devices": {"FakeUPS": [{"error": "DATA-STALE", "for": "5s"}, {"error": "", "disconnect": true, "for": "1m"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if steps := scenario.Devices["FakeUPS"]; !scenario.Loop || len(steps) != 2 || *steps[0].Error != "DATA-STALE" || *steps[1].Error != "" || !steps[1].Disconnect {
+		t.Errorf("LoadFakeNUTScenario() of JSON = %+v, want a loop of 2 steps", scenario)
+	}
+
+	for name, data := range map[string]string{
+		"typo.yml":     "devices:\n  FakeUPS:\n    - stauts: OB\n",
+		"empty.yml":    "loop: true\n",
+		"busy.yml":     "loop: true\ndevices:\n  FakeUPS:\n    - status: OB\n",
+		"negative.yml": "devices:\n  FakeUPS:\n    - status: OB\n      for: -1s\n",
+		"power.yml":    "devices:\n  FakeUPS:\n    - power: off\n",
+	} {
+		if _, err := LoadFakeNUTScenario(write(name, data)); err == nil {
+			t.Errorf("LoadFakeNUTScenario() of %s = nil, want an error", name)
+		}
+	}
+
+	// Devices and variables that don't exist are rejected when the server starts.
+	server := NewFakeNUTServer()
+	server.Scenario = &FakeNUTScenario{Devices: map[string][]FakeNUTScenarioStep{"FakeUPS": {{Set: map[string]string{"battery.charge.high": "90"}}}}}
+	if err := server.Start(); err == nil || !strings.Contains(err.Error(), "battery.charge.high") {
+		t.Errorf("Start() with an unknown variable = %v, want an error", err)
+	}
+}
+
+func TestFakeNUTServerScenario(t *testing.T) {
+	status := "OB DISCHRG LB"
+	stale := "DATA-STALE"
+	port := startTestFakeNUTServer(t, func(server *FakeNUTServer) {
+		server.Rate = 100
+		server.Scenario = &FakeNUTScenario{Devices: map[string][]FakeNUTScenarioStep{"FakeUPS": {
+			{Status: &status, Set: map[string]string{"battery.charge": "15", "input.voltage": "0"}, For: 50 * time.Second},
+			{Error: &stale},
+		}}}
+	})
+
+	// The battery isn't simulated while the scenario plays, so the status and the battery.charge stay as they were set.
+	time.Sleep(200 * time.Millisecond)
+	want := []string{`VAR FakeUPS ups.status "OB DISCHRG LB"`, `VAR FakeUPS battery.charge "15"`, `VAR FakeUPS input.voltage "0.0"`}
+	if responses := fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status", "GET VAR FakeUPS battery.charge", "GET VAR FakeUPS input.voltage"); fmt.Sprint(responses) != fmt.Sprint(want) {
+		t.Errorf("first step = %q, want %q", responses, want)
+	}
+
+	// After 50 simulated seconds, the commands for the device fail, including LIST commands.
+	time.Sleep(time.Second)
+	want = []string{"ERR DATA-STALE", "ERR DATA-STALE", "ERR DATA-STALE", "ERR DATA-STALE"}
+	if responses := fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status", "GET UPSDESC FakeUPS", "LIST VAR FakeUPS", "LIST UPS"); fmt.Sprint(responses) != fmt.Sprint(want) {
+		t.Errorf("second step = %q, want %q", responses, want)
+	}
+	server := NewNUTServer(NUTServerConfig{Host: "127.0.0.1", Port: port})
+	defer server.Close()
+	if _, err := server.GetUPSList(); NUTErrorCode(err) != "DATA-STALE" {
+		t.Errorf("GetUPSList() = %v, want DATA-STALE", err)
+	}
+}
+
+func TestFakeNUTServerScenarioPower(t *testing.T) {
+	port := startTestFakeNUTServer(t, func(server *FakeNUTServer) {
+		server.Rate = 1000
+		server.Scenario = &FakeNUTScenario{Devices: map[string][]FakeNUTScenarioStep{"FakeUPS": {
+			{Power: "failed", For: 10 * time.Minute},
+			{Power: "restored"},
+		}}}
+	})
+
+	// The battery is simulated while the power has failed, so it drains.
+	time.Sleep(300 * time.Millisecond)
+	responses := fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status", "GET VAR FakeUPS input.voltage", "GET VAR FakeUPS battery.charge")
+	if !strings.Contains(responses[0], `"OB`) || responses[1] != `VAR FakeUPS input.voltage "0.0"` || responses[2] == `VAR FakeUPS battery.charge "100"` {
+		t.Errorf("power failure = %q, want the UPS on a draining battery", responses)
+	}
+
+	// After 10 simulated minutes, the power is back.
+	time.Sleep(600 * time.Millisecond)
+	responses = fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status", "GET VAR FakeUPS input.voltage")
+	if !strings.Contains(responses[0], `"OL`) || responses[1] != `VAR FakeUPS input.voltage "232.6"` {
+		t.Errorf("power restored = %q, want the UPS online", responses)
+	}
+}
+
+func TestFakeNUTServerScenarioDisconnect(t *testing.T) {
+	port := startTestFakeNUTServer(t, func(server *FakeNUTServer) {
+		server.Scenario = &FakeNUTScenario{Loop: true, Devices: map[string][]FakeNUTScenarioStep{"FakeUPS": {
+			{For: 500 * time.Millisecond},
+			{Disconnect: true},
+		}}}
+	})
+
+	// The scenario loops, so the clients are disconnected every half a second.
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("reading from the connection = %v, want it closed by the scenario", err)
+	}
+	if response := fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status")[0]; response != `VAR FakeUPS ups.status "OL"` {
+		t.Errorf("GET VAR after reconnecting = %q, want OL", response)
+	}
+}
+
+func TestFakeNUTServerStop(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	server := NewFakeNUTServer()
+	server.Host, server.Port = "127.0.0.1", fmt.Sprint(port)
+	server.Scenario = &FakeNUTScenario{Loop: true, Devices: map[string][]FakeNUTScenarioStep{"FakeUPS": {{For: time.Hour}}}}
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.Start() }()
+
+	var conn net.Conn
+	for i := 0; i < 50 && conn == nil; i++ {
+		if conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if conn == nil {
+		t.Fatal("fake NUT server didn't start")
+	}
+	defer conn.Close()
+	fakeNUTExchange(t, port, "GET VAR FakeUPS ups.status")
+
+	// Start only returns once the simulation and the scenario, which waits for an hour, have stopped.
+	if err := server.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("Start() = %v, want nil after Stop()", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Start() didn't return after Stop()")
+	}
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("reading from the connection = %v, want it closed by Stop()", err)
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port)); err == nil {
+		conn.Close()
+		t.Error("fake NUT server still accepts connections after Stop()")
+	}
+	if err := server.Stop(); err != nil {
+		t.Errorf("second Stop() = %v, want nil", err)
+	}
+}
+
+func TestLoadFakeNUTDumps(t *testing.T) {
+	// The sample dump is served with every variable as it was dumped, including the trailing spaces.
+	devices, err := LoadFakeNUTDumps("samples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile("samples/sample.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{}
+	for _, variable := range devices["sample"].ListVariables() {
+		lines = append(lines, variable.Name+": "+variable.Value)
+	}
+	if len(devices) != 1 || strings.Join(lines, "\n")+"\n" != string(data) {
+		t.Errorf("LoadFakeNUTDumps() = %d devices with sample variables\n%s\nwant the variables of samples/sample.txt", len(devices), strings.Join(lines, "\n"))
+	}
+
+	dir := t.TempDir()
+	write := func(name string, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("empty.txt", "Init SSL without certificate database\n")
+	if _, err := LoadFakeNUTDumps(dir); err == nil {
+		t.Error("LoadFakeNUTDumps() with a dump without variables = nil, want an error")
+	}
+	write("empty.txt", "ups.status: OL\nups.status: OB\n")
+	if _, err := LoadFakeNUTDumps(dir); err == nil {
+		t.Error("LoadFakeNUTDumps() with a variable twice = nil, want an error")
+	}
+}
+
+func TestNewFakeNUTServerFromConfig(t *testing.T) {
+	t.Setenv("NUT_SERVER", "nut.env")
+	cfg := DefaultConfig()
+	cfg.NUTServers[0].Host, cfg.NUTServers[0].Port = "127.0.0.1", 3499
+	cfg.NUTFakeRate, cfg.NUTFakeDumps = 0.5, "samples"
+	server, err := NewFakeNUTServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Host != "127.0.0.1" || server.Port != "3499" || server.Rate != 0.5 || len(server.Devices) != 1 || server.Devices["sample"] == nil {
+		t.Errorf("fake NUT server = %s:%s at rate %g with %d devices, want the settings of the configuration", server.Host, server.Port, server.Rate, len(server.Devices))
+	}
+
+	cfg.NUTFakeDumps = filepath.Join(t.TempDir(), "missing")
+	if _, err := NewFakeNUTServerFromConfig(cfg); err == nil {
+		t.Error("NewFakeNUTServerFromConfig() with missing upsc dumps = nil, want an error")
+	}
+}
+
+func TestFakeNUTDumpsLoadedOnce(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rack1.txt"), []byte("Init SSL without certificate database\nups.status: OL\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NUT_FAKE", "true")
+	t.Setenv("NUT_FAKE_DUMPS", dir)
+
+	var output bytes.Buffer
+	defer log.SetOutput(log.Out)
+	log.SetOutput(&output)
+	config, err := LoadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewFakeNUTServerFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := strings.Count(output.String(), "skips line 1"); count != 1 || server.Devices["rack1"] == nil {
+		t.Errorf("logged the skipped line %d times, want the upsc dumps to be loaded once", count)
+	}
+
+	t.Setenv("NUT_FAKE_DUMPS", filepath.Join(dir, "rack1.txt"))
+	if _, err := LoadConfig("", nil); err == nil || !strings.Contains(err.Error(), "is not a directory") {
+		t.Errorf("LoadConfig() with a file as upsc dumps = %v, want an error", err)
+	}
+}
+
+func TestFakeNUTServerDumps(t *testing.T) {
+	dir := t.TempDir()
+	dump := "Init SSL without certificate database\r\n" +
+		"battery.charge.low: 20\r\n" +
+		"battery.voltage: 27.1\r\n" +
+		"input.voltage: 230\r\n" +
+		"ups.firmware: 02.00.0015\r\n" +
+		"ups.id:\r\n" +
+		"ups.status: OL\r\n" +
+		"ups.timer.shutdown: 0\r\n"
+	if err := os.WriteFile(filepath.Join(dir, "rack1.txt"), []byte(dump), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	port := startTestFakeNUTServer(t, func(server *FakeNUTServer) {
+		devices, err := LoadFakeNUTDumps(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Devices = devices
+	})
+
+	// Values that don't fit the fields of FakeNUTDevice, and variables without a field, are served as they are.
+	time.Sleep(200 * time.Millisecond)
+	tests := []struct {
+		command  string
+		response string
+	}{
+		{"GET VAR FakeUPS ups.status", "ERR UNKNOWN-UPS"},
+		{"GET VAR rack1 input.voltage", `VAR rack1 input.voltage "230"`},
+		{"GET VAR rack1 battery.voltage", `VAR rack1 battery.voltage "27.1"`},
+		{"GET TYPE rack1 battery.voltage", "TYPE rack1 battery.voltage NUMBER"},
+		{"GET VAR rack1 ups.firmware", `VAR rack1 ups.firmware "02.00.0015"`},
+		{"GET TYPE rack1 ups.firmware", "TYPE rack1 ups.firmware STRING:64"},
+		{"GET VAR rack1 ups.id", `VAR rack1 ups.id ""`},
+		{"GET VAR rack1 ups.timer.shutdown", `VAR rack1 ups.timer.shutdown "0"`},
+		{"GET VAR rack1 ups.model", "ERR VAR-NOT-SUPPORTED"},
+		{"USERNAME fakeuser", "OK"},
+		{"PASSWORD fakepass", "OK"},
+		{`SET VAR rack1 battery.charge.low "30"`, "OK"},
+		{"GET VAR rack1 battery.charge.low", `VAR rack1 battery.charge.low "30"`},
+		{"INSTCMD rack1 load.off", "OK"},
+		{"GET VAR rack1 ups.status", `VAR rack1 ups.status "OL OFF"`},
+	}
+	commands := []string{}
+	for _, test := range tests {
+		commands = append(commands, test.command)
+	}
+	for i, response := range fakeNUTExchange(t, port, commands...) {
+		if response != tests[i].response {
+			t.Errorf("%s = %q, want %q", tests[i].command, response, tests[i].response)
+		}
+	}
+
+	// The bridge sees the device with exactly the variables of the dump.
+	server := NewNUTServer(NUTServerConfig{Host: "127.0.0.1", Port: port})
+	defer server.Close()
+	upsList, err := server.GetUPSList()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upsList) != 1 || upsList[0].Name != "rack1" || len(upsList[0].Variables) != 7 {
+		t.Errorf("GetUPSList() = %+v, want rack1 with 7 variables", upsList)
+	}
+}
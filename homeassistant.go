@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+// HomeAssistantDevice is the device block of a Home Assistant MQTT discovery config.
+type HomeAssistantDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+	SerialNumber string   `json:"serial_number,omitempty"`
+	SWVersion    string   `json:"sw_version,omitempty"`
+}
+
+// HomeAssistantAvailability is an availability topic of a Home Assistant MQTT discovery config.
+type HomeAssistantAvailability struct {
+	Topic         string `json:"topic"`
+	ValueTemplate string `json:"value_template,omitempty"`
+}
+
+// HomeAssistantConfig is a Home Assistant MQTT discovery config for a single sensor or binary sensor.
+type HomeAssistantConfig struct {
+	Name              string                      `json:"name"`
+	UniqueID          string                      `json:"unique_id"`
+	ObjectID          string                      `json:"object_id"`
+	StateTopic        string                      `json:"state_topic"`
+	ValueTemplate     string                      `json:"value_template"`
+	DeviceClass       string                      `json:"device_class,omitempty"`
+	UnitOfMeasurement string                      `json:"unit_of_measurement,omitempty"`
+	StateClass        string                      `json:"state_class,omitempty"`
+	EntityCategory    string                      `json:"entity_category,omitempty"`
+	PayloadOn         string                      `json:"payload_on,omitempty"`
+	PayloadOff        string                      `json:"payload_off,omitempty"`
+	Availability      []HomeAssistantAvailability `json:"availability"`
+	AvailabilityMode  string                      `json:"availability_mode"`
+	Device            HomeAssistantDevice         `json:"device"`
+}
+
+// homeAssistantSensorClass describes how Home Assistant should present a numeric NUT variable.
+type homeAssistantSensorClass struct {
+	DeviceClass       string
+	UnitOfMeasurement string
+}
+
+// Home Assistant sensor classes by NUT variable name component, eg. "voltage" in "input.voltage.nominal".
+var homeAssistantSensorClasses = map[string]homeAssistantSensorClass{
+	"charge":      {"battery", "%"},
+	"current":     {"current", "A"},
+	"delay":       {"duration", "s"},
+	"frequency":   {"frequency", "Hz"},
+	"humidity":    {"humidity", "%"},
+	"load":        {"", "%"},
+	"power":       {"apparent_power", "VA"},
+	"realpower":   {"power", "W"},
+	"runtime":     {"duration", "s"},
+	"temperature": {"temperature", "°C"},
+	"timer":       {"duration", "s"},
+	"transfer":    {"voltage", "V"},
+	"voltage":     {"voltage", "V"},
+}
+
+// homeAssistantStatusFlag describes a binary sensor derived from a "ups.status" flag.
+type homeAssistantStatusFlag struct {
+	Flag        string
+	Name        string
+	DeviceClass string
+}
+
+// Binary sensors derived from the "ups.status" variable.
+var homeAssistantStatusFlags = []homeAssistantStatusFlag{
+	{"OL", "Online", "power"},
+	{"OB", "On Battery", ""},
+	{"LB", "Low Battery", "battery"},
+	{"RB", "Replace Battery", "problem"},
+	{"OVER", "Overload", "problem"},
+}
+
+var (
+	// Matches characters that aren't allowed in Home Assistant node and object IDs.
+	homeAssistantInvalidIDChars = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+	// Retained discovery configs that have been published, by NUT server and topic,
+	// so they can be removed again when a UPS device or variable disappears.
+	homeAssistantConfigs      = map[*NUTServer]map[string][]byte{}
+	homeAssistantConfigsMutex sync.Mutex
+)
+
+// Convert a string to a valid Home Assistant node or object ID.
+func homeAssistantID(value string) string {
+	return strings.Trim(homeAssistantInvalidIDChars.ReplaceAllString(value, "_"), "_")
+}
+
+// Convert a NUT variable name to a human readable name, eg. "battery.charge" to "Battery Charge".
+func homeAssistantName(variableName string) string {
+	words := strings.FieldsFunc(variableName, func(r rune) bool { return r == '.' || r == '_' })
+	for i, word := range words {
+		words[i] = strings.ToUpper(word[:1]) + word[1:]
+	}
+	return strings.Join(words, " ")
+}
+
+// Get the value of a UPS variable as a string, with identifiers as the NUT server sent them,
+// or an empty string if it doesn't exist.
+func upsVariableString(ups nut.UPS, name string) string {
+	for _, variable := range ups.Variables {
+		if variable.Name == name {
+			return NUTVariableString(variable)
+		}
+	}
+	return ""
+}
+
+// Get the value of the first of the UPS variables that exists, eg. "device.model" or else "ups.model".
+func upsVariableFirstString(ups nut.UPS, names ...string) string {
+	for _, name := range names {
+		if value := upsVariableString(ups, name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Get the state topic and the Home Assistant template expression (without the braces)
+// for the value of a UPS variable, depending on the MQTT publish mode.
+func homeAssistantState(upsTopic string, variable nut.Variable) (string, string) {
+	if CurrentConfig().MQTTPublishMode == MQTTPublishModeJSON {
+		expression := fmt.Sprintf("value_json.variables['%s']", variable.Name)
+		return upsTopic, expression
+	}
+	if _, ok := variable.Value.(bool); ok {
+		return MQTTVariableTopic(upsTopic, variable.Name), "value == 'true'"
+	}
+	return MQTTVariableTopic(upsTopic, variable.Name), "value"
+}
+
+// Build the Home Assistant discovery configs for a UPS device, by discovery topic.
+func HomeAssistantConfigs(server *NUTServer, ups nut.UPS) (map[string]HomeAssistantConfig, error) {
+	upsTopic, err := server.UPSTopic(ups.Name)
+	if err != nil {
+		return nil, err
+	}
+	nodeID := homeAssistantID(upsTopic)
+
+	device := HomeAssistantDevice{
+		Identifiers:  []string{nodeID},
+		Name:         ups.Name,
+		Manufacturer: upsVariableFirstString(ups, "ups.mfr", "device.mfr"),
+		Model:        upsVariableFirstString(ups, "device.model", "ups.model"),
+		SerialNumber: upsVariableFirstString(ups, "device.serial", "ups.serial"),
+		SWVersion:    upsVariableString(ups, "driver.version"),
+	}
+	availability := []HomeAssistantAvailability{
+		{Topic: MQTTAvailabilityTopic()},
+		{Topic: server.StateTopic(), ValueTemplate: "{{ 'online' if value_json.state == 'online' else 'offline' }}"},
+	}
+	newConfig := func(component string, objectID string, name string, stateTopic string) (string, HomeAssistantConfig) {
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", CurrentConfig().HADiscoveryPrefix, component, nodeID, objectID)
+		return topic, HomeAssistantConfig{
+			Name:             name,
+			UniqueID:         fmt.Sprintf("%s_%s", nodeID, objectID),
+			ObjectID:         fmt.Sprintf("%s_%s", nodeID, objectID),
+			StateTopic:       stateTopic,
+			Availability:     availability,
+			AvailabilityMode: "all",
+			Device:           device,
+		}
+	}
+
+	configs := map[string]HomeAssistantConfig{}
+	for _, variable := range ups.Variables {
+		objectID := homeAssistantID(variable.Name)
+		stateTopic, valueExpression := homeAssistantState(upsTopic, variable)
+		valueTemplate := fmt.Sprintf("{{ %s }}", valueExpression)
+
+		switch variable.Value.(type) {
+		case bool:
+			topic, haConfig := newConfig("binary_sensor", objectID, homeAssistantName(variable.Name), stateTopic)
+			haConfig.ValueTemplate = fmt.Sprintf("{{ 'ON' if %s else 'OFF' }}", valueExpression)
+			haConfig.PayloadOn, haConfig.PayloadOff = "ON", "OFF"
+			configs[topic] = haConfig
+		case int64, float64:
+			topic, haConfig := newConfig("sensor", objectID, homeAssistantName(variable.Name), stateTopic)
+			haConfig.ValueTemplate = valueTemplate
+			haConfig.StateClass = "measurement"
+			for _, component := range strings.Split(variable.Name, ".") {
+				if sensorClass, ok := homeAssistantSensorClasses[component]; ok {
+					haConfig.DeviceClass = sensorClass.DeviceClass
+					haConfig.UnitOfMeasurement = sensorClass.UnitOfMeasurement
+					break
+				}
+			}
+			if strings.HasPrefix(variable.Name, "driver.") {
+				haConfig.EntityCategory = "diagnostic"
+				haConfig.DeviceClass, haConfig.UnitOfMeasurement, haConfig.StateClass = "", "", ""
+			}
+			configs[topic] = haConfig
+		default:
+			topic, haConfig := newConfig("sensor", objectID, homeAssistantName(variable.Name), stateTopic)
+			haConfig.ValueTemplate = valueTemplate
+			if !strings.HasPrefix(variable.Name, "ups.status") && !strings.HasPrefix(variable.Name, "ups.alarm") {
+				haConfig.EntityCategory = "diagnostic"
+			}
+			configs[topic] = haConfig
+		}
+
+		// Add a binary sensor for each of the interesting status flags.
+		if variable.Name == "ups.status" {
+			for _, statusFlag := range homeAssistantStatusFlags {
+				topic, haConfig := newConfig("binary_sensor", homeAssistantID("status_"+strings.ToLower(statusFlag.Flag)), statusFlag.Name, stateTopic)
+				haConfig.ValueTemplate = fmt.Sprintf("{{ 'ON' if '%s' in (%s).split() else 'OFF' }}", statusFlag.Flag, valueExpression)
+				haConfig.PayloadOn, haConfig.PayloadOff = "ON", "OFF"
+				haConfig.DeviceClass = statusFlag.DeviceClass
+				configs[topic] = haConfig
+			}
+		}
+	}
+	return configs, nil
+}
+
+// Publish the Home Assistant discovery configs for the UPS devices of a NUT server,
+// and remove the configs of any UPS devices or variables that have since disappeared.
+func PublishHomeAssistantDiscovery(server *NUTServer, upsList []nut.UPS) {
+	if !CurrentConfig().HADiscovery {
+		return
+	}
+
+	// Build the discovery configs for all UPS devices.
+	payloads := map[string][]byte{}
+	for _, ups := range upsList {
+		haConfigs, err := HomeAssistantConfigs(server, ups)
+		if err != nil {
+			log.Warn("Failed to build Home Assistant discovery configs for UPS device ", ups.Name, ": ", err)
+			continue
+		}
+		for topic, haConfig := range haConfigs {
+			payload, jsonErr := json.Marshal(haConfig)
+			if jsonErr != nil {
+				log.Warn("Failed to serialize Home Assistant discovery config to JSON: ", jsonErr)
+				continue
+			}
+			payloads[topic] = payload
+		}
+	}
+
+	homeAssistantConfigsMutex.Lock()
+	defer homeAssistantConfigsMutex.Unlock()
+	published := homeAssistantConfigs[server]
+	if published == nil {
+		published = map[string][]byte{}
+		homeAssistantConfigs[server] = published
+	}
+
+	// Only publish the configs that have changed, as they are retained by the broker.
+	for topic, payload := range payloads {
+		if bytes.Equal(published[topic], payload) {
+			continue
+		}
+		log.Debug("Publishing Home Assistant discovery config to ", topic, " ...")
+		if err := PublishMQTT(topic, 1, true, payload); err != nil {
+			log.Warn("Failed to publish Home Assistant discovery config: ", err)
+			continue
+		}
+		published[topic] = payload
+	}
+
+	// Remove the retained configs that are no longer valid, which also removes the entities from Home Assistant.
+	for topic := range published {
+		if _, ok := payloads[topic]; ok {
+			continue
+		}
+		log.Debug("Removing Home Assistant discovery config from ", topic, " ...")
+		if err := PublishMQTT(topic, 1, true, []byte{}); err != nil {
+			log.Warn("Failed to remove Home Assistant discovery config: ", err)
+			continue
+		}
+		delete(published, topic)
+	}
+}
+
+// Remove the Home Assistant discovery configs that have been published for a NUT server,
+// eg. when the NUT server has been removed from the configuration.
+func RemoveHomeAssistantDiscovery(server *NUTServer) {
+	homeAssistantConfigsMutex.Lock()
+	defer homeAssistantConfigsMutex.Unlock()
+	for topic := range homeAssistantConfigs[server] {
+		log.Debug("Removing Home Assistant discovery config from ", topic, " ...")
+		if err := PublishMQTT(topic, 1, true, []byte{}); err != nil {
+			log.Warn("Failed to remove Home Assistant discovery config: ", err)
+		}
+	}
+	delete(homeAssistantConfigs, server)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+func TestHomeAssistantConfigs(t *testing.T) {
+	server := NewNUTServer(NUTServerConfig{Name: "site-a", Host: "localhost", Port: 3493, TopicPrefix: "site-a"})
+	ups := nut.UPS{
+		Name: "rack1",
+		Variables: []nut.Variable{
+			{Name: "battery.charge", Value: int64(100)},
+			{Name: "input.voltage", Value: 232.6},
+			{Name: "ups.beeper.status", Value: false},
+			{Name: "ups.status", Value: "OL CHRG"},
+			{Name: "device.model", Value: "Powerwalker VI 2200 RLE"},
+			{Name: "device.serial", Value: "000000000000"},
+			{Name: "ups.mfr", Value: "Powerwalker"},
+			{Name: "driver.version", Value: "2.8.0"},
+		},
+	}
+
+	configs, err := HomeAssistantConfigs(server, ups)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batteryCharge, ok := configs["homeassistant/sensor/nuttyqt_site-a_rack1/battery_charge/config"]
+	if !ok {
+		t.Fatalf("missing battery.charge sensor, got %v", configs)
+	}
+	if batteryCharge.DeviceClass != "battery" || batteryCharge.UnitOfMeasurement != "%" || batteryCharge.StateClass != "measurement" {
+		t.Errorf("battery.charge sensor = %+v, want battery device class in percent", batteryCharge)
+	}
+	if batteryCharge.StateTopic != "nuttyqt/site-a/rack1" {
+		t.Errorf("battery.charge state topic = %q, want %q", batteryCharge.StateTopic, "nuttyqt/site-a/rack1")
+	}
+	if batteryCharge.Device.Model != "Powerwalker VI 2200 RLE" || batteryCharge.Device.Manufacturer != "Powerwalker" ||
+		batteryCharge.Device.SerialNumber != "000000000000" || batteryCharge.Device.SWVersion != "2.8.0" {
+		t.Errorf("device = %+v, want it built from the UPS variables", batteryCharge.Device)
+	}
+
+	if inputVoltage := configs["homeassistant/sensor/nuttyqt_site-a_rack1/input_voltage/config"]; inputVoltage.DeviceClass != "voltage" || inputVoltage.UnitOfMeasurement != "V" {
+		t.Errorf("input.voltage sensor = %+v, want voltage device class in volts", inputVoltage)
+	}
+	if _, ok := configs["homeassistant/binary_sensor/nuttyqt_site-a_rack1/ups_beeper_status/config"]; !ok {
+		t.Error("missing ups.beeper.status binary sensor")
+	}
+	if online, ok := configs["homeassistant/binary_sensor/nuttyqt_site-a_rack1/status_ol/config"]; !ok || online.DeviceClass != "power" {
+		t.Errorf("status_ol binary sensor = %+v, want power device class", online)
+	}
+	if model := configs["homeassistant/sensor/nuttyqt_site-a_rack1/device_model/config"]; model.StateClass != "" || model.EntityCategory != "diagnostic" {
+		t.Errorf("device.model sensor = %+v, want a diagnostic sensor without state class", model)
+	}
+}
+
+func TestHomeAssistantConfigsDevice(t *testing.T) {
+	server := NewNUTServer(NUTServerConfig{Host: "localhost", Port: 3493})
+	ups := nut.UPS{
+		Name: "rack1",
+		Variables: []nut.Variable{
+			newNUTVariable("device.mfr", "EATON", "", nil),
+			newNUTVariable("ups.model", "1500", "", nil),
+			newNUTVariable("ups.serial", "000000000000", "", nil),
+			newNUTVariable("driver.version", "2.8.0", "", nil),
+		},
+	}
+
+	// The device falls back to the ups.* variables, and keeps identifiers as the NUT server sent them.
+	configs, err := HomeAssistantConfigs(server, ups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := configs["homeassistant/sensor/nuttyqt_rack1/ups_serial/config"].Device
+	if device.Manufacturer != "EATON" || device.Model != "1500" || device.SerialNumber != "000000000000" || device.SWVersion != "2.8.0" {
+		t.Errorf("device = %+v, want it built from the raw ups.* variables", device)
+	}
+}
+
+func TestHomeAssistantConfigsVariablesMode(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	config := *CurrentConfig()
+	config.MQTTPublishMode = MQTTPublishModeVariables
+	SetConfig(config)
+
+	server := NewNUTServer(NUTServerConfig{Host: "localhost", Port: 3493})
+	ups := nut.UPS{
+		Name: "rack1",
+		Variables: []nut.Variable{
+			{Name: "battery.charge", Value: int64(100)},
+			{Name: "ups.beeper.status", Value: false},
+		},
+	}
+
+	configs, err := HomeAssistantConfigs(server, ups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if batteryCharge := configs["homeassistant/sensor/nuttyqt_rack1/battery_charge/config"]; batteryCharge.StateTopic != "nuttyqt/rack1/battery/charge" || batteryCharge.ValueTemplate != "{{ value }}" {
+		t.Errorf("battery.charge sensor = %+v, want the variable topic as state topic", batteryCharge)
+	}
+	if beeper := configs["homeassistant/binary_sensor/nuttyqt_rack1/ups_beeper_status/config"]; beeper.StateTopic != "nuttyqt/rack1/ups/beeper/status" {
+		t.Errorf("ups.beeper.status binary sensor = %+v, want the variable topic as state topic", beeper)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+const (
+	// Timeout of a single write to InfluxDB.
+	influxDBTimeout = 10 * time.Second
+
+	// Maximum size of a UDP datagram, below the usual MTU so datagrams aren't fragmented.
+	influxDBUDPPayloadSize = 1400
+)
+
+// influxDBRejectedError is returned when InfluxDB rejects a batch of lines, eg. because of a field type conflict,
+// so retrying the same batch would never succeed.
+type influxDBRejectedError struct {
+	Status  string
+	Message string
+}
+
+func (err *influxDBRejectedError) Error() string {
+	return fmt.Sprintf("InfluxDB rejected the write with %s: %s", err.Status, err.Message)
+}
+
+// InfluxDBWriter writes line protocol to InfluxDB in the background. Lines that fail to be written are kept and retried
+// in batches with exponential backoff, until the buffer is full, after which the oldest lines are dropped.
+type InfluxDBWriter struct {
+	url         *url.URL
+	measurement string
+
+	// InfluxDB 1.x database and credentials.
+	database string
+	user     string
+	pass     string
+
+	// InfluxDB 2.x organization, bucket and API token.
+	org    string
+	bucket string
+	token  string
+
+	// Maximum number of lines per write, and maximum number of lines to keep while InfluxDB is unreachable.
+	batchSize  int
+	bufferSize int
+
+	// Delays before retrying a failed write, doubling from the minimum to the maximum.
+	retryMinDelay time.Duration
+	retryMaxDelay time.Duration
+
+	httpClient *http.Client
+
+	// Guards the pending lines, the number of dropped lines and the error of the last write.
+	mutex   sync.Mutex
+	pending []string
+	dropped int
+	lastErr error
+
+	// Wakes up the background writer after new lines have been added.
+	wake chan struct{}
+
+	// Closed to stop the background writer, which closes done when it has stopped.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Create an InfluxDB writer from the configuration.
+func NewInfluxDBWriter(cfg Config) (*InfluxDBWriter, error) {
+	u, err := url.Parse(cfg.InfluxDBURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	return &InfluxDBWriter{
+		url:           u,
+		measurement:   cfg.InfluxDBMeasurement,
+		database:      cfg.InfluxDBDatabase,
+		user:          cfg.InfluxDBUser,
+		pass:          cfg.InfluxDBPass,
+		org:           cfg.InfluxDBOrg,
+		bucket:        cfg.InfluxDBBucket,
+		token:         cfg.InfluxDBToken,
+		batchSize:     cfg.InfluxDBBatchSize,
+		bufferSize:    cfg.InfluxDBBufferSize,
+		retryMinDelay: time.Second,
+		retryMaxDelay: time.Minute,
+		httpClient:    &http.Client{Timeout: influxDBTimeout},
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}, nil
+}
+
+// Start writing in the background.
+func (writer *InfluxDBWriter) Start() {
+	log.Info("Writing UPS devices to InfluxDB at ", writer.url.Redacted(), " ...")
+	go writer.run()
+}
+
+// Add lines to be written, dropping the oldest lines if the buffer is full.
+func (writer *InfluxDBWriter) Write(lines []string) {
+	writer.mutex.Lock()
+	writer.pending = append(writer.pending, lines...)
+	if overflow := len(writer.pending) - writer.bufferSize; overflow > 0 {
+		log.Warn("InfluxDB buffer is full, dropping the oldest ", overflow, " lines ...")
+		writer.pending = writer.pending[overflow:]
+		writer.dropped += overflow
+	}
+	writer.mutex.Unlock()
+
+	select {
+	case writer.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add the UPS devices of a NUT server as lines to be written, one line per UPS device.
+func (writer *InfluxDBWriter) WriteUPSList(server *NUTServer, upsList []nut.UPS, timestamp time.Time) {
+	lines := []string{}
+	for _, ups := range upsList {
+		if line, ok := InfluxDBLine(writer.measurement, server, ups, timestamp); ok {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > 0 {
+		log.Debug("Writing ", len(lines), " UPS devices of ", server.Config.Name, " to InfluxDB ...")
+		writer.Write(lines)
+	}
+}
+
+// Number of lines that are waiting to be written.
+func (writer *InfluxDBWriter) Pending() int {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return len(writer.pending)
+}
+
+// Error of the last write, or nil if it succeeded.
+func (writer *InfluxDBWriter) Err() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.lastErr
+}
+
+// Stop writing in the background, and make a last attempt to write the pending lines.
+func (writer *InfluxDBWriter) Close() error {
+	close(writer.stop)
+	<-writer.done
+	if err := writer.flush(); err != nil {
+		return fmt.Errorf("failed to write %d lines to InfluxDB: %w", writer.Pending(), err)
+	}
+	return nil
+}
+
+// InfluxDBSink writes the UPS devices to InfluxDB.
+type InfluxDBSink struct {
+	writer *InfluxDBWriter
+}
+
+// Start writing the UPS devices to InfluxDB with the InfluxDB settings of a configuration.
+func NewInfluxDBSink(cfg Config) (*InfluxDBSink, error) {
+	writer, err := NewInfluxDBWriter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	writer.Start()
+	return &InfluxDBSink{writer}, nil
+}
+
+func (sink *InfluxDBSink) Name() string {
+	return "influxdb"
+}
+
+// Add the UPS devices of a successful poll to the writer, and report whether InfluxDB is currently failing,
+// as the lines are written and retried in the background.
+func (sink *InfluxDBSink) WritePoll(poll Poll) error {
+	if poll.Err == nil {
+		sink.writer.WriteUPSList(poll.Server, poll.UPSList, poll.Timestamp)
+	}
+	return sink.writer.Err()
+}
+
+// Events are not written to InfluxDB, which only stores the numeric variables of the UPS devices.
+func (sink *InfluxDBSink) WriteEvent(server *NUTServer, event UPSEvent) error {
+	return nil
+}
+
+func (sink *InfluxDBSink) Close() error {
+	return sink.writer.Close()
+}
+
+// Write the pending lines whenever new lines are added, and retry failed writes with exponential backoff.
+func (writer *InfluxDBWriter) run() {
+	defer close(writer.done)
+	attempt := 0
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-writer.stop:
+			return
+		case <-writer.wake:
+			if attempt > 0 {
+				// New lines wait for the retry of the failed ones.
+				continue
+			}
+		case <-retry:
+		}
+
+		err := writer.flush()
+		writer.mutex.Lock()
+		writer.lastErr = err
+		writer.mutex.Unlock()
+		if err != nil {
+			attempt++
+			delay := writer.retryMinDelay
+			for i := 1; i < attempt && delay < writer.retryMaxDelay; i++ {
+				delay *= 2
+			}
+			if delay > writer.retryMaxDelay {
+				delay = writer.retryMaxDelay
+			}
+			log.Warn("Failed to write to InfluxDB, retrying ", writer.Pending(), " lines in ", delay, ": ", err)
+			retry = time.After(delay)
+			continue
+		}
+		if attempt > 0 {
+			log.Info("Writing to InfluxDB succeeded again after ", attempt, " failed attempts")
+		}
+		attempt, retry = 0, nil
+	}
+}
+
+// Write all pending lines in batches, and stop at the first batch that fails.
+// Batches that InfluxDB rejects are dropped, as they would never succeed.
+func (writer *InfluxDBWriter) flush() error {
+	for {
+		writer.mutex.Lock()
+		count := len(writer.pending)
+		if count > writer.batchSize {
+			count = writer.batchSize
+		}
+		batch := append([]string{}, writer.pending[:count]...)
+		dropped := writer.dropped
+		writer.mutex.Unlock()
+		if count == 0 {
+			return nil
+		}
+
+		err := writer.send(batch)
+		var rejectedErr *influxDBRejectedError
+		if errors.As(err, &rejectedErr) {
+			log.Error("Dropping ", count, " lines: ", err)
+		} else if err != nil {
+			return err
+		}
+
+		// The oldest lines may have been dropped while sending, in which case they were part of the batch.
+		writer.mutex.Lock()
+		if written := count - (writer.dropped - dropped); written > 0 {
+			writer.pending = writer.pending[written:]
+		}
+		writer.mutex.Unlock()
+	}
+}
+
+// Send a batch of lines to InfluxDB.
+func (writer *InfluxDBWriter) send(lines []string) error {
+	if writer.url.Scheme == "udp" {
+		return writer.sendUDP(lines)
+	}
+	return writer.sendHTTP(lines)
+}
+
+// Get the URL of the write API, which is "/api/v2/write" for InfluxDB 2.x and "/write" for InfluxDB 1.x.
+func (writer *InfluxDBWriter) writeURL() string {
+	u := *writer.url
+	query := url.Values{"precision": {"ns"}}
+	if writer.bucket != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v2/write"
+		query.Set("org", writer.org)
+		query.Set("bucket", writer.bucket)
+	} else {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+		query.Set("db", writer.database)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Send a batch of lines to the HTTP write API, with a token for InfluxDB 2.x or basic auth for InfluxDB 1.x.
+func (writer *InfluxDBWriter) sendHTTP(lines []string) error {
+	request, err := http.NewRequest(http.MethodPost, writer.writeURL(), strings.NewReader(strings.Join(lines, "\n")+"\n"))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if writer.token != "" {
+		request.Header.Set("Authorization", "Token "+writer.token)
+	} else if writer.user != "" {
+		request.SetBasicAuth(writer.user, writer.pass)
+	}
+
+	response, err := writer.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+	switch {
+	case response.StatusCode >= 200 && response.StatusCode < 300:
+		return nil
+	case response.StatusCode >= 400 && response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests &&
+		response.StatusCode != http.StatusUnauthorized && response.StatusCode != http.StatusForbidden:
+		return &influxDBRejectedError{response.Status, strings.TrimSpace(string(body))}
+	default:
+		return fmt.Errorf("InfluxDB responded with %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// Send a batch of lines as UDP datagrams, each with as many whole lines as fit.
+func (writer *InfluxDBWriter) sendUDP(lines []string) error {
+	conn, err := net.DialTimeout("udp", writer.url.Host, influxDBTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var datagram strings.Builder
+	for i, line := range lines {
+		datagram.WriteString(line)
+		datagram.WriteByte('\n')
+		if i+1 < len(lines) && datagram.Len()+len(lines[i+1])+1 <= influxDBUDPPayloadSize {
+			continue
+		}
+		if _, err := conn.Write([]byte(datagram.String())); err != nil {
+			return err
+		}
+		datagram.Reset()
+	}
+	return nil
+}
+
+// Escape a measurement name of line protocol.
+var influxDBMeasurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+
+// Escape a tag key, tag value or field key of line protocol.
+var influxDBKeyEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+
+// Format a UPS device of a NUT server as a line of InfluxDB line protocol, with the UPS, NUT server, model and serial number as tags,
+// and every numeric variable as a field, eg. "ups,server=site-a,ups=rack1 battery.charge=100,input.voltage=232.6 1672628645000000000".
+// Fields are always floats, as InfluxDB rejects a field that changes between integers and floats, eg. "230" and "230.5".
+// There is no line if the UPS device doesn't have any numeric variables.
+func InfluxDBLine(measurement string, server *NUTServer, ups nut.UPS, timestamp time.Time) (string, bool) {
+	fields := [][2]string{}
+	for _, variable := range ups.Variables {
+		value, ok := NUTVariableNumber(variable)
+		if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		fields = append(fields, [2]string{influxDBKeyEscaper.Replace(variable.Name), strconv.FormatFloat(value, 'f', -1, 64)})
+	}
+	if len(fields) == 0 {
+		return "", false
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i][0] < fields[j][0] })
+
+	var line strings.Builder
+	line.WriteString(influxDBMeasurementEscaper.Replace(measurement))
+	// Tags are sorted by key, as InfluxDB recommends, and left out when empty, as InfluxDB doesn't allow empty tag values.
+	for _, tag := range [][2]string{
+		{"model", upsVariableFirstString(ups, "device.model", "ups.model")},
+		{"serial", upsVariableFirstString(ups, "device.serial", "ups.serial")},
+		{"server", server.Config.Name},
+		{"ups", ups.Name},
+	} {
+		if tag[1] != "" {
+			fmt.Fprintf(&line, ",%s=%s", tag[0], influxDBKeyEscaper.Replace(tag[1]))
+		}
+	}
+	for i, field := range fields {
+		separator := ","
+		if i == 0 {
+			separator = " "
+		}
+		fmt.Fprintf(&line, "%s%s=%s", separator, field[0], field[1])
+	}
+	fmt.Fprintf(&line, " %d", timestamp.UnixNano())
+	return line.String(), true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+func TestInfluxDBLine(t *testing.T) {
+	server := NewNUTServer(NUTServerConfig{Name: "site a", Host: "localhost", Port: 3493})
+	timestamp := time.Unix(1672628645, 0)
+	ups := nut.UPS{
+		Name: "rack1",
+		Variables: []nut.Variable{
+			{Name: "input.voltage", Value: 232.6},
+			{Name: "battery.charge", Value: int64(100)},
+			{Name: "battery.charge.low", Value: int64(20)},
+			{Name: "ups.beeper.status", Value: false},
+			{Name: "ups.status", Value: "OL CHRG"},
+			{Name: "device.model", Value: "VI 2200, RLE"},
+			{Name: "ups.serial", Value: int64(123)},
+		},
+	}
+	want := `ups,model=VI\ 2200\,\ RLE,serial=123,server=site\ a,ups=rack1 battery.charge=100,battery.charge.low=20,input.voltage=232.6 1672628645000000000`
+	if line, ok := InfluxDBLine("ups", server, ups, timestamp); !ok || line != want {
+		t.Errorf("InfluxDBLine() = %q, %v, want %q", line, ok, want)
+	}
+
+	if line, ok := InfluxDBLine("ups", server, nut.UPS{Name: "empty"}, timestamp); ok {
+		t.Errorf("InfluxDBLine() without numeric variables = %q, want no line", line)
+	}
+}
+
+// influxDBTestServer is an InfluxDB HTTP write API that records the requests,
+// and responds with the given status codes in order, followed by 204 No Content.
+type influxDBTestServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newInfluxDBTestServer(t *testing.T, statuses ...int) *influxDBTestServer {
+	server := &influxDBTestServer{statuses: statuses}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+		server.requests = append(server.requests, r)
+		server.bodies = append(server.bodies, string(body))
+		if len(server.statuses) > 0 {
+			w.WriteHeader(server.statuses[0])
+			server.statuses = server.statuses[1:]
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Wait until the server has received a number of requests.
+func (server *influxDBTestServer) wait(t *testing.T, count int) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		server.mutex.Lock()
+		received := len(server.requests)
+		server.mutex.Unlock()
+		if received >= count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("InfluxDB received %d requests, want %d", len(server.requests), count)
+}
+
+func newTestInfluxDBWriter(t *testing.T, cfg Config) *InfluxDBWriter {
+	t.Helper()
+	cfg.InfluxDBMeasurement, cfg.InfluxDBBatchSize, cfg.InfluxDBBufferSize = "ups", 2, 3
+	writer, err := NewInfluxDBWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.retryMinDelay, writer.retryMaxDelay = 50*time.Millisecond, 100*time.Millisecond
+	writer.Start()
+	return writer
+}
+
+func TestInfluxDBWriterHTTP(t *testing.T) {
+	v1 := newInfluxDBTestServer(t)
+	writer := newTestInfluxDBWriter(t, Config{InfluxDBURL: v1.URL + "/influx/", InfluxDBDatabase: "nut", InfluxDBUser: "nuttyqt", InfluxDBPass: "secret"})
+	writer.Write([]string{"ups a=1 1"})
+	v1.wait(t, 1)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	request := v1.requests[0]
+	user, pass, _ := request.BasicAuth()
+	if request.URL.Path != "/influx/write" || request.URL.Query().Get("db") != "nut" || user != "nuttyqt" || pass != "secret" || v1.bodies[0] != "ups a=1 1\n" {
+		t.Errorf("InfluxDB 1.x request = %s with %s:%s and %q, want /influx/write?db=nut with basic auth", request.URL, user, pass, v1.bodies[0])
+	}
+
+	v2 := newInfluxDBTestServer(t)
+	writer = newTestInfluxDBWriter(t, Config{InfluxDBURL: v2.URL, InfluxDBOrg: "home", InfluxDBBucket: "nut", InfluxDBToken: "token"})
+	writer.Write([]string{"ups a=1 1"})
+	v2.wait(t, 1)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	request = v2.requests[0]
+	if request.URL.Path != "/api/v2/write" || request.URL.Query().Get("org") != "home" || request.URL.Query().Get("bucket") != "nut" ||
+		request.Header.Get("Authorization") != "Token token" {
+		t.Errorf("InfluxDB 2.x request = %s with %q, want /api/v2/write?org=home&bucket=nut with the token", request.URL, request.Header.Get("Authorization"))
+	}
+}
+
+func TestInfluxDBWriterRetry(t *testing.T) {
+	// The first write fails and is retried along with the lines that were added in the meantime,
+	// in batches of 2 lines, of which the oldest is dropped as the buffer only holds 3 lines.
+	server := newInfluxDBTestServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	writer := newTestInfluxDBWriter(t, Config{InfluxDBURL: server.URL, InfluxDBDatabase: "nut"})
+	writer.Write([]string{"ups a=1 1"})
+	server.wait(t, 1)
+	writer.Write([]string{"ups a=2 2", "ups a=3 3", "ups a=4 4"})
+	server.wait(t, 4)
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(server.bodies[2:], "")
+	if want := "ups a=2 2\nups a=3 3\nups a=4 4\n"; got != want || writer.Pending() != 0 {
+		t.Errorf("written lines = %q with %d pending, want %q", got, writer.Pending(), want)
+	}
+
+	// Rejected lines are dropped instead of retried.
+	server = newInfluxDBTestServer(t, http.StatusBadRequest)
+	writer = newTestInfluxDBWriter(t, Config{InfluxDBURL: server.URL, InfluxDBDatabase: "nut"})
+	writer.Write([]string{"ups a=1i 1"})
+	server.wait(t, 1)
+	if err := writer.Close(); err != nil || writer.Pending() != 0 {
+		t.Errorf("Close() = %v with %d pending, want the rejected line dropped", err, writer.Pending())
+	}
+}
+
+func TestInfluxDBWriterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writer := newTestInfluxDBWriter(t, Config{InfluxDBURL: "udp://" + conn.LocalAddr().String()})
+	writer.Write([]string{"ups a=1 1", "ups a=2 2"})
+	buffer := make([]byte, influxDBUDPPayloadSize)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buffer[:n]); got != "ups a=1 1\nups a=2 2\n" {
+		t.Errorf("datagram = %q, want both lines", got)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -39,30 +42,98 @@ type Config struct {
 	// MQTT password. Defaults to "".
 	MQTTPass string
 
-	// NUT server host. Defaults to "localhost".
-	NUTServerHost string
+	// CA bundle to verify the MQTT broker with. Defaults to "", which uses the system roots.
+	MQTTTLSCA string
 
-	// NUT server port. Defaults to 3493.
-	NUTServerPort int
+	// Client certificate for mutual TLS with the MQTT broker. Defaults to "".
+	MQTTTLSCert string
 
-	// NUT username. Defaults to "".
-	NUTUser string
+	// Key of the client certificate. Defaults to "".
+	MQTTTLSKey string
 
-	// NUT password. Defaults to "".
-	NUTPass string
+	// Name to verify the certificate of the MQTT broker for. Defaults to "", which uses the MQTT broker host.
+	MQTTTLSServerName string
+
+	// Minimum TLS version of the MQTT connection. Defaults to "1.2".
+	MQTTTLSMinVersion string
+
+	// Skip verifying the certificate of the MQTT broker. Defaults to false.
+	MQTTTLSInsecure bool
+
+	// MQTT publish mode, either "json", "variables" or "both". Defaults to "json".
+	MQTTPublishMode string
+
+	// Home Assistant MQTT discovery should be published. Defaults to false.
+	HADiscovery bool
+
+	// Home Assistant MQTT discovery topic prefix. Defaults to "homeassistant".
+	HADiscoveryPrefix string
+
+	// NUT servers to monitor. Defaults to a single server at "localhost:3493".
+	NUTServers []NUTServerConfig
+
+	// Minimum delay in seconds before reconnecting to an unreachable NUT server. Defaults to 1.
+	NUTReconnectMinDelay int
+
+	// Maximum delay in seconds before reconnecting to an unreachable NUT server. Defaults to 300.
+	NUTReconnectMaxDelay int
 
 	// NUT fake server should be started. Defaults to false.
 	NUTFake bool
 
+	// Simulated seconds per second of the fake NUT server, eg. 60 to play out a 30-minute power outage in 30 seconds. Defaults to 1.
+	NUTFakeRate float64
+
+	// Scenario file (YAML or JSON) that the devices of the fake NUT server play, eg. a power outage. Defaults to none.
+	NUTFakeScenario string
+
+	// Directory of upsc dumps that the fake NUT server serves a device of each, named after the file, instead of FakeUPS. Defaults to none.
+	NUTFakeDumps string
+
 	// Update interval in seconds. Defaults to 60.
 	UpdateInterval int
 
+	// InfluxDB URL to write the UPS devices to, eg. "http://localhost:8086" or "udp://localhost:8089".
+	// Defaults to "", which disables InfluxDB.
+	InfluxDBURL string
+
+	// InfluxDB 1.x database. Defaults to "".
+	InfluxDBDatabase string
+
+	// InfluxDB 1.x username. Defaults to "".
+	InfluxDBUser string
+
+	// InfluxDB 1.x password. Defaults to "".
+	InfluxDBPass string
+
+	// InfluxDB 2.x organization. Defaults to "".
+	InfluxDBOrg string
+
+	// InfluxDB 2.x bucket. Defaults to "".
+	InfluxDBBucket string
+
+	// InfluxDB 2.x API token. Defaults to "".
+	InfluxDBToken string
+
+	// InfluxDB measurement of the UPS devices. Defaults to "ups".
+	InfluxDBMeasurement string
+
+	// Maximum number of lines per write to InfluxDB. Defaults to 5000.
+	InfluxDBBatchSize int
+
+	// Maximum number of lines to keep while InfluxDB is unreachable. Defaults to 100000.
+	InfluxDBBufferSize int
+
+	// Address to serve the Prometheus metrics on, eg. ":9199". Defaults to "", which disables the metrics.
+	MetricsListen string
+
 	// Verbose logging. Defaults to false.
 	Verbose bool
 }
 
-var (
-	config = Config{
+// Get the default configuration, which the config file, environment variables and flags are applied to.
+func DefaultConfig() Config {
+	return Config{
 		MQTTBrokerProtocol: "tcp",
 		MQTTBrokerHost:     "localhost",
 		MQTTBrokerPort:     1883,
@@ -70,24 +141,65 @@ var (
 		MQTTTopic:          "nuttyqt",
 		MQTTUser:           "",
 		MQTTPass:           "",
-
-		NUTServerHost: "localhost",
-		NUTServerPort: 3493,
-		NUTUser:       "",
-		NUTPass:       "",
-		NUTFake:       false,
+		MQTTTLSMinVersion:  "1.2",
+		MQTTPublishMode:    MQTTPublishModeJSON,
+
+		HADiscovery:       false,
+		HADiscoveryPrefix: "homeassistant",
+
+		NUTServers: []NUTServerConfig{
+			{
+				Host:         "localhost",
+				Port:         3493,
+				User:         "",
+				Pass:         "",
+				UPSInclude:   []string{},
+				UPSExclude:   []string{},
+				UPSCommands:  map[string][]string{},
+				UPSVariables: map[string][]string{},
+			},
+		},
+		NUTReconnectMinDelay: 1,
+		NUTReconnectMaxDelay: 300,
+		NUTFake:              false,
+		NUTFakeRate:          1,
+
+		InfluxDBMeasurement: "ups",
+		InfluxDBBatchSize:   5000,
+		InfluxDBBufferSize:  100000,
 
 		UpdateInterval: 60,
+		MetricsListen:  "",
 		Verbose:        false,
 	}
+}
+
+// Current configuration, which is only ever replaced as a whole, eg. by a reload,
+// so it can be read from any goroutine while the configuration is reloaded.
+var currentConfig atomic.Pointer[Config]
+
+func init() {
+	SetConfig(DefaultConfig())
+}
+
+// Get the current configuration, which must not be modified, as other goroutines may be reading it.
+func CurrentConfig() *Config {
+	return currentConfig.Load()
+}
 
+// Replace the current configuration.
+func SetConfig(cfg Config) {
+	currentConfig.Store(&cfg)
+}
+
+var (
 	// MQTT
 	// mqttClient *mqtt.Client
 	mqttClient mqtt.Client
 
 	// NUT
-	nutClient *nut.Client
-	upsDevice *nut.UPS
+	upsDevices      = map[*NUTServer][]nut.UPS{}
+	upsDevicesMutex sync.Mutex
 )
 
 // Logger for the application.
@@ -101,124 +213,60 @@ func GetEnv(key, fallback string) string {
 	return fallback
 }
 
-// Load the configuration from environment variables.
-func LoadConfig() {
-	// MQTT
-	config.MQTTBrokerProtocol = GetEnv("MQTT_BROKER_PROTOCOL", config.MQTTBrokerProtocol)
-	config.MQTTBrokerHost = GetEnv("MQTT_BROKER_HOST", config.MQTTBrokerHost)
-	config.MQTTBrokerPort, _ = strconv.Atoi(GetEnv("MQTT_BROKER_PORT", strconv.Itoa(config.MQTTBrokerPort)))
-	config.MQTTClient = GetEnv("MQTT_CLIENT", config.MQTTClient)
-	config.MQTTTopic = GetEnv("MQTT_TOPIC", config.MQTTTopic)
-	config.MQTTUser = GetEnv("MQTT_USER", config.MQTTUser)
-	config.MQTTPass = GetEnv("MQTT_PASS", config.MQTTPass)
-
-	// NUT
-	config.NUTServerHost = GetEnv("NUT_SERVER", config.NUTServerHost)
-	config.NUTServerPort, _ = strconv.Atoi(GetEnv("NUT_PORT", strconv.Itoa(config.NUTServerPort)))
-	config.NUTUser = GetEnv("NUT_USER", config.NUTUser)
-	config.NUTPass = GetEnv("NUT_PASS", config.NUTPass)
-	config.NUTFake, _ = strconv.ParseBool(GetEnv("NUT_FAKE", strconv.FormatBool(config.NUTFake)))
-
-	// Other
-	config.UpdateInterval, _ = strconv.Atoi(GetEnv("UPDATE_INTERVAL", strconv.Itoa(config.UpdateInterval)))
-	config.Verbose, _ = strconv.ParseBool(GetEnv("VERBOSE", strconv.FormatBool(config.Verbose)))
+// Get the value of an environment variable as a comma separated list or return a default value.
+func GetEnvList(key string, fallback []string) []string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	return ParseList(value)
 }
 
-// FIXME: Do we even need this at this point?!
-var mqttMessageHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
-	log.Debug("TOPIC: ", msg.Topic())
-	log.Debug("MSG: ", msg.Payload())
+// Get the value of an environment variable as a map of lists or return a default value.
+// The format is "<key>:<item>,<item>;<key>:<item>", where entries without a key use "*" as the key.
+func GetEnvMap(key string, fallback map[string][]string) map[string][]string {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return fallback
+	}
+	return ParseMap(value)
 }
 
-// Get the UPS device from NUT.
-func GetUPS() *nut.UPS {
-	// FIXME: Can we keep the connection open AND handle reconnects?
-	// Create a new NUT client and connect to the server.
-	var isNewClient bool
-	if nutClient == nil {
-		log.Info(fmt.Sprintf("Connecting to NUT server at %s:%d ...", config.NUTServerHost, config.NUTServerPort))
-		client, connectErr := nut.Connect(config.NUTServerHost, config.NUTServerPort)
-		if connectErr != nil {
-			log.Fatal("Failed to connect to NUT server: ", connectErr)
+// Parse a comma separated list, eg. "rack1,rack2".
+func ParseList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
 		}
-		nutClient = &client
-		isNewClient = true
-	} else {
-		log.Debug("Reusing existing NUT client ...")
 	}
+	return list
+}
 
-	// Authenticate with the NUT server.
-	if isNewClient {
-		log.Debug("Authenticating with NUT server ...")
-		if config.NUTUser != "" && config.NUTPass != "" {
-			_, authErr := nutClient.Authenticate(config.NUTUser, config.NUTPass)
-			if authErr != nil {
-				log.Fatal("Failed to authenticate with NUT server: ", authErr)
-			}
-		} else {
-			log.Debug("No NUT credentials provided. Skipping authentication ...")
+// Parse a map of lists, eg. "rack1:beeper.disable,beeper.enable;*:beeper.mute",
+// where entries without a key use "*" as the key.
+func ParseMap(value string) map[string][]string {
+	entries := map[string][]string{}
+	for _, entry := range strings.Split(value, ";") {
+		entryKey, items := "*", entry
+		if index := strings.Index(entry, ":"); index >= 0 {
+			entryKey, items = strings.TrimSpace(entry[:index]), entry[index+1:]
+		}
+		if list := ParseList(items); len(list) > 0 {
+			entries[entryKey] = append(entries[entryKey], list...)
 		}
 	}
-
-	// Get a list of all available UPS devices.
-	log.Debug("Getting a list of all UPS devices ...")
-	upsList, listErr := nutClient.GetUPSList()
-	if listErr != nil {
-		log.Fatal("Failed to get a list of UPS devices: ", listErr)
-	}
-
-	// Print the list of UPS devices.
-	// log.Debug("List of UPS devices:")
-	// for _, ups := range upsList {
-	// 	log.Debug(fmt.Sprintf("%s", ups))
-	// }
-
-	// TODO: Return all UPS devices instead and send them all to MQTT?
-	// Return the first UPS in the list.
-	log.Debug("Return the first UPS device ...")
-	return &upsList[0]
+	return entries
 }
 
-// Create a new MQTT client and connect to the MQTT broker.
-func CreateMQTTClient() {
-	//
-	// NOTE: Usage examples for the Paho MQTT client:
-	//
-	// https://github.com/eclipse/paho.mqtt.golang/tree/master/cmd
-	//
-
-	// FIXME: How can we catch runtime errors from the mqtt library? Eg. "error triggered" messages that it handles internally..
-
-	// mqtt.DEBUG = log.New(os.Stdout, "", 0)
-	// mqtt.ERROR = log.New(os.Stdout, "", 0)
-	mqtt.ERROR = logrus.New() // FIXME: Ideally redirect these to our existing logger, instead of a new one.
-
-	// TODO: Does this library handle reconnecting automatically?
-	// TODO: Set up LWT (Last Will and Testament) message.
-	log.Debug("Setting up MQTT client ...")
-	opts := mqtt.NewClientOptions()
-	opts.SetConnectRetry(false)
-	opts.SetAutoReconnect(true)
-	opts.AddBroker(fmt.Sprintf("%s://%s:%d", config.MQTTBrokerProtocol, config.MQTTBrokerHost, config.MQTTBrokerPort))
-	opts.SetClientID(config.MQTTClient)
-	opts.SetDefaultPublishHandler(mqttMessageHandler)
-	opts.SetKeepAlive(2 * time.Second)
-	opts.SetDefaultPublishHandler(mqttMessageHandler)
-	opts.SetPingTimeout(1 * time.Second)
-
-	// FIXME: If mqttClient can't be a pointer, how can we check if it's nil and not recreate it?
-	log.Debug("Creating MQTT client ...")
-	mqttClient = mqtt.NewClient(opts)
-
-	log.Info(fmt.Sprintf("Connecting to MQTT broker at %s://%s:%d ...", config.MQTTBrokerProtocol, config.MQTTBrokerHost, config.MQTTBrokerPort))
-	if token := mqttClient.Connect(); token.WaitTimeout(5*time.Second) && token.Error() != nil {
-		log.Fatal("Failed to connect to MQTT broker: ", token.Error())
-	}
+func main() {
+	RunCommand(os.Args[1:])
 }
 
-func main() {
-	// Load the configuration from the environment.
-	LoadConfig()
+// Relay the UPS devices of the NUT servers to the MQTT broker until SIGINT or SIGTERM.
+// The configuration is reloaded with the same flags on SIGHUP.
+func Run(flags *ConfigFlags) {
+	config := CurrentConfig()
 
 	// Setup logging.
 	log.Out = os.Stdout
@@ -229,16 +277,61 @@ func main() {
 	// Start the fake NUT server if enabled.
 	if config.NUTFake {
 		log.Info("Starting fake NUT server ...")
-		fakeNUTServer := NewFakeNUTServer()
-		go fakeNUTServer.Start()
+		fakeNUTServer, err := NewFakeNUTServerFromConfig(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			if err := fakeNUTServer.Start(); err != nil {
+				log.Fatal(err)
+			}
+		}()
 		defer fakeNUTServer.Stop()
 	}
 
-	// Create the MQTT client.
+	// Set up the NUT servers.
+	for _, serverConfig := range config.NUTServers {
+		nutServers = append(nutServers, NewNUTServer(serverConfig))
+	}
+
+	// Create the MQTT client, which is the first sink.
 	CreateMQTTClient()
+	ReplaceSink(context.Background(), "mqtt", NewSinkRunner(&MQTTSink{}))
+
+	// Write the UPS devices to InfluxDB if enabled.
+	if config.InfluxDBURL != "" {
+		sink, err := NewInfluxDBSink(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ReplaceSink(context.Background(), sink.Name(), NewSinkRunner(sink))
+	}
+
+	// Serve the Prometheus metrics if enabled.
+	if config.MetricsListen != "" {
+		sink, err := NewMetricsSink(config.MetricsListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ReplaceSink(context.Background(), sink.Name(), NewSinkRunner(sink))
+	}
 
-	// Start the update loop in a goroutine.
-	go Update()
+	// Start the update loop in a goroutine, which also reloads the configuration between updates.
+	reloads := make(chan struct{}, 1)
+	go Update(reloads, func() { ReloadConfig(flags) })
+
+	// Reload the configuration on SIGHUP.
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			select {
+			case reloads <- struct{}{}:
+			default:
+				log.Debug("Configuration reload is already pending, skipping ...")
+			}
+		}
+	}()
 
 	// Setup graceful shutdown and wait for SIGINT or SIGTERM.
 	gracefulShutdown := make(chan os.Signal, 1)
@@ -248,43 +341,106 @@ func main() {
 	// Create a context with a timeout of 5 seconds.
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
-	// TODO: Actually utilize both the context and cancel,
-	//       eg. in Close() but maybe in the Update() loop too?
-
-	// Disconnect from the NUT server and MQTT broker when we're done.
+	// Disconnect from the NUT servers and close the sinks when we're done.
 	defer Close(ctx, cancel)
 }
 
-// Update loop that runs at the configured interval, updating the UPS device
-// and sending the UPS device data to the MQTT broker.
-func Update() {
+// Update loop that runs at the configured interval, updating the UPS devices
+// and writing the result of each poll to the sinks, eg. the MQTT broker.
+// Reload requests are handled between updates, followed by an update with the new configuration.
+func Update(reloads <-chan struct{}, reload func()) {
 	for {
-		if !mqttClient.IsConnected() || !mqttClient.IsConnectionOpen() {
-			log.Debug("MQTT client is not connected, skipping update ...")
-		} else {
-			// Get the UPS device.
-			log.Debug("Updating UPS device ...")
-			upsDevice = GetUPS()
-
-			// Serialize the UPS device to JSON.
-			log.Debug("Serializing UPS device to JSON ...")
-			upsDeviceJSON, jsonErr := json.Marshal(upsDevice)
-			if jsonErr != nil {
-				log.Fatal("Failed to serialize UPS device to JSON: ", jsonErr)
-			}
+		// Update all NUT servers at the same time, so a slow or
+		// failing server doesn't hold back the others.
+		var wg sync.WaitGroup
+		for _, server := range nutServers {
+			wg.Add(1)
+			go func(server *NUTServer) {
+				defer wg.Done()
+				UpdateServer(server)
+			}(server)
+		}
+		wg.Wait()
+
+		// Wait for the update interval before updating again.
+		log.Debug("Sleeping for ", CurrentConfig().UpdateInterval, " seconds ...")
+		select {
+		case <-time.After(time.Duration(CurrentConfig().UpdateInterval) * time.Second):
+		case <-reloads:
+			reload()
+		}
+	}
+}
 
-			// Send the data to the MQTT broker.
-			log.Debug("Sending data to MQTT broker ...")
-			mqttMessageToken := mqttClient.Publish(config.MQTTTopic, 0, false, upsDeviceJSON)
-			mqttMessageToken.WaitTimeout(5 * time.Second)
-			if mqttMessageToken.Error() != nil {
-				log.Fatal("Failed to send data to MQTT broker: ", mqttMessageToken.Error())
+// Update the UPS devices of a single NUT server, and write the result of the poll
+// and the changes of the UPS status since the last poll to the sinks.
+func UpdateServer(server *NUTServer) {
+	// Get the UPS devices.
+	log.Debug("Updating UPS devices on ", server.Config.Name, " ...")
+	started := time.Now()
+	upsList, err := server.GetUPSList()
+	poll := Poll{Server: server, UPSList: upsList, Timestamp: time.Now(), Duration: time.Since(started), Err: err}
+	if errors.Is(err, ErrNUTServerUnreachable) {
+		log.Debug("NUT server ", server.Config.Name, " is unreachable, skipping update ...")
+	} else if err != nil {
+		log.Error(err)
+	} else {
+		upsDevicesMutex.Lock()
+		upsDevices[server] = upsList
+		upsDevicesMutex.Unlock()
+	}
+
+	// Failed polls are written to the sinks too, eg. for the metrics.
+	WritePollToSinks(poll)
+	if err != nil {
+		return
+	}
+
+	// Write the changes of the UPS status since the last update as discrete events.
+	for _, upsDevice := range upsList {
+		for _, event := range DetectUPSEvents(server, upsDevice, poll.Timestamp) {
+			if event.Event == upsStatusChangedEvent {
+				log.Info(fmt.Sprintf("Status of UPS device %s on %s changed from %q to %q", upsDevice.Name, server.Config.Name, event.PreviousStatus, event.Status))
 			}
+			WriteEventToSinks(server, event)
 		}
+	}
+}
+
+// NUTServerState is the connection state of a NUT server, published to the MQTT broker.
+type NUTServerState struct {
+	Server    string    `json:"server"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Publish the connection state of a NUT server to the MQTT broker as a retained message,
+// so subscribers can tell an unreachable NUT server apart from a stale UPS device.
+func PublishNUTServerState(server *NUTServer, connectionErr error, attempt int) {
+	state := NUTServerState{
+		Server:    server.Config.Name,
+		State:     "online",
+		Attempt:   attempt,
+		Timestamp: time.Now().UTC(),
+	}
+	if connectionErr != nil {
+		state.State = "unreachable"
+		state.Error = connectionErr.Error()
+	}
 
-		// Wait 15 seconds before updating again.
-		log.Debug("Sleeping for ", config.UpdateInterval, " seconds ...")
-		time.Sleep(time.Duration(config.UpdateInterval) * time.Second)
+	if mqttClient == nil || !mqttClient.IsConnectionOpen() {
+		log.Debug("MQTT client is not connected, skipping NUT server state ...")
+		return
+	}
+	stateJSON, jsonErr := json.Marshal(state)
+	if jsonErr != nil {
+		log.Warn("Failed to serialize NUT server state to JSON: ", jsonErr)
+		return
+	}
+	if err := PublishMQTT(server.StateTopic(), 0, true, stateJSON); err != nil {
+		log.Warn("Failed to send NUT server state to MQTT broker: ", err)
 	}
 }
 
@@ -292,13 +448,11 @@ func Update() {
 func Close(ctx context.Context, cancel context.CancelFunc) {
 	log.Info("Shutting down ...")
 
-	// Disconnect from the NUT server and MQTT broker.
+	// Disconnect from the NUT servers, and close the sinks after writing what is still queued for them, eg. to the MQTT broker.
 	if err := CloseNUT(); err != nil {
 		log.Warn("Failed to close NUT connection: ", err)
 	}
-	if err := CloseMQTT(); err != nil {
-		log.Warn("Failed to close MQTT connection: ", err)
-	}
+	CloseSinks(ctx)
 
 	// Cancel the context.
 	cancel()
@@ -306,28 +460,3 @@ func Close(ctx context.Context, cancel context.CancelFunc) {
 	log.Info("Shutdown complete, terminating ...")
 	os.Exit(0)
 }
-
-// Close the NUT client.
-func CloseNUT() error {
-	if nutClient != nil {
-		log.Debug("Disconnecting from NUT server ...")
-		_, err := nutClient.Disconnect()
-		if err != nil {
-			return err
-		}
-	} else {
-		log.Debug("No NUT client to disconnect from, skipping ...")
-	}
-	return nil
-}
-
-// Close the MQTT client.
-func CloseMQTT() error {
-	if mqttClient != nil {
-		log.Debug("Disconnecting from MQTT broker ...")
-		mqttClient.Disconnect(250)
-	} else {
-		log.Debug("No MQTT client to disconnect from, skipping ...")
-	}
-	return nil
-}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+// Path that the Prometheus metrics are served on.
+const metricsPath = "/metrics"
+
+// Content type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Prometheus unit suffixes by NUT variable name component, eg. "voltage" in "input.voltage.nominal",
+// in the base units that Prometheus recommends.
+var prometheusUnits = map[string]string{
+	"charge":      "percent",
+	"current":     "amperes",
+	"delay":       "seconds",
+	"frequency":   "hertz",
+	"humidity":    "percent",
+	"load":        "percent",
+	"power":       "voltamperes",
+	"realpower":   "watts",
+	"runtime":     "seconds",
+	"temperature": "celsius",
+	"timer":       "seconds",
+	"transfer":    "volts",
+	"voltage":     "volts",
+}
+
+// Status flags that are always exported, so they can be alerted on even while they aren't set.
+// Other flags are only exported while they are set.
+var prometheusStatusFlags = []string{"OL", "OB", "LB", "HB", "RB", "CHRG", "DISCHRG", "BYPASS", "CAL", "OFF", "OVER", "TRIM", "BOOST", "FSD"}
+
+// Matches characters that aren't allowed in Prometheus metric names.
+var prometheusInvalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_:]+`)
+
+// NUTServerMetrics are the statistics of polling a single NUT server.
+type NUTServerMetrics struct {
+	// Number of polls, including failed ones.
+	Polls uint64
+
+	// Number of failed polls, including those while the NUT server is unreachable.
+	Errors uint64
+
+	// Whether the last poll succeeded.
+	Up bool
+
+	// Duration of the last poll.
+	Duration time.Duration
+
+	// Time of the last successful poll.
+	LastSuccess time.Time
+}
+
+var (
+	// Poll statistics by NUT server.
+	nutServerMetrics      = map[*NUTServer]*NUTServerMetrics{}
+	nutServerMetricsMutex sync.Mutex
+
+	// MQTT publish statistics.
+	mqttPublishes      atomic.Uint64
+	mqttPublishErrors  atomic.Uint64
+	metricsStartedTime = time.Now()
+)
+
+// Record the outcome of polling a NUT server.
+func RecordNUTServerPoll(server *NUTServer, duration time.Duration, err error) {
+	nutServerMetricsMutex.Lock()
+	defer nutServerMetricsMutex.Unlock()
+	metrics := nutServerMetrics[server]
+	if metrics == nil {
+		metrics = &NUTServerMetrics{}
+		nutServerMetrics[server] = metrics
+	}
+	metrics.Polls++
+	metrics.Duration = duration
+	metrics.Up = err == nil
+	if err != nil {
+		metrics.Errors++
+	} else {
+		metrics.LastSuccess = time.Now()
+	}
+}
+
+// Forget the poll statistics of a NUT server, eg. when it has been removed from the configuration.
+func RemoveNUTServerMetrics(server *NUTServer) {
+	nutServerMetricsMutex.Lock()
+	delete(nutServerMetrics, server)
+	nutServerMetricsMutex.Unlock()
+}
+
+// Record the outcome of publishing a message to the MQTT broker.
+func RecordMQTTPublish(err error) {
+	mqttPublishes.Add(1)
+	if err != nil {
+		mqttPublishErrors.Add(1)
+	}
+}
+
+// MetricsSink records the outcome of every poll for the metrics, and serves them until it's closed.
+type MetricsSink struct {
+	server *http.Server
+}
+
+// Start serving the Prometheus metrics on an address, eg. ":9199".
+func NewMetricsSink(address string) (*MetricsSink, error) {
+	server, err := StartMetricsServer(address)
+	if err != nil {
+		return nil, err
+	}
+	return &MetricsSink{server}, nil
+}
+
+func (sink *MetricsSink) Name() string {
+	return "metrics"
+}
+
+func (sink *MetricsSink) WritePoll(poll Poll) error {
+	RecordNUTServerPoll(poll.Server, poll.Duration, poll.Err)
+	return nil
+}
+
+func (sink *MetricsSink) WriteEvent(server *NUTServer, event UPSEvent) error {
+	return nil
+}
+
+// Stop serving the metrics.
+func (sink *MetricsSink) Close() error {
+	if sink.server == nil {
+		return nil
+	}
+	return sink.server.Close()
+}
+
+// metricSample is a single sample of a metric family.
+type metricSample struct {
+	// Label names and values, in order.
+	Labels [][2]string
+	Value  float64
+}
+
+// metricFamily is a Prometheus metric with all of its samples.
+type metricFamily struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []metricSample
+}
+
+// metricFamilies collects metric families by name, so samples of the same metric from different UPS devices are written together.
+type metricFamilies map[string]*metricFamily
+
+// Add a sample to a metric family, creating it if needed.
+func (families metricFamilies) Add(name string, metricType string, help string, value float64, labels ...[2]string) {
+	family, ok := families[name]
+	if !ok {
+		family = &metricFamily{Name: name, Help: help, Type: metricType}
+		families[name] = family
+	}
+	family.Samples = append(family.Samples, metricSample{Labels: labels, Value: value})
+}
+
+// Write the metric families in the Prometheus text exposition format, sorted by name.
+func (families metricFamilies) WriteTo(w io.Writer) (int64, error) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		family := families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", family.Name, escapeMetricHelp(family.Help))
+		fmt.Fprintf(&b, "# TYPE %s %s\n", family.Name, family.Type)
+		for _, sample := range family.Samples {
+			b.WriteString(family.Name)
+			if len(sample.Labels) > 0 {
+				b.WriteByte('{')
+				for i, label := range sample.Labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(&b, "%s=\"%s\"", label[0], escapeMetricLabelValue(label[1]))
+				}
+				b.WriteByte('}')
+			}
+			b.WriteByte(' ')
+			b.WriteString(formatMetricValue(sample.Value))
+			b.WriteByte('\n')
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Escape the help text of a metric, eg. a NUT variable name.
+func escapeMetricHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+// Escape the value of a label, eg. a UPS description.
+func escapeMetricLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+// Format a sample value, eg. "232.6", "NaN" or "+Inf".
+func formatMetricValue(value float64) string {
+	if math.IsNaN(value) {
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Get the name of the metric for a numeric NUT variable, with its unit as a suffix,
+// eg. "battery.charge" to "nut_battery_charge_percent".
+func PrometheusMetricName(variableName string) string {
+	name := "nut_" + strings.Trim(prometheusInvalidNameChars.ReplaceAllString(variableName, "_"), "_")
+	for _, component := range strings.Split(variableName, ".") {
+		if unit, ok := prometheusUnits[component]; ok {
+			return name + "_" + unit
+		}
+	}
+	return name
+}
+
+// Add the metrics of a UPS device of a NUT server: its numeric variables, status flags and device metadata.
+func addUPSMetrics(families metricFamilies, server *NUTServer, ups nut.UPS) {
+	upsLabels := [][2]string{{"ups", ups.Name}, {"server", server.Config.Name}}
+	for _, variable := range ups.Variables {
+		value, ok := NUTVariableNumber(variable)
+		if !ok {
+			continue
+		}
+		families.Add(PrometheusMetricName(variable.Name), "gauge", "NUT variable "+variable.Name, value, upsLabels...)
+	}
+
+	if status := upsVariableString(ups, "ups.status"); status != "" {
+		flags := map[string]bool{}
+		for _, flag := range strings.Fields(status) {
+			flags[flag] = true
+		}
+		addFlag := func(flag string, set bool) {
+			value := 0.0
+			if set {
+				value = 1
+			}
+			families.Add("nut_ups_status", "gauge", "Whether a flag of the ups.status variable is set, eg. OL or OB",
+				value, append(upsLabels[:2:2], [2]string{"flag", flag})...)
+		}
+		for _, flag := range prometheusStatusFlags {
+			addFlag(flag, flags[flag])
+			delete(flags, flag)
+		}
+		others := make([]string, 0, len(flags))
+		for flag := range flags {
+			others = append(others, flag)
+		}
+		sort.Strings(others)
+		for _, flag := range others {
+			addFlag(flag, true)
+		}
+	}
+
+	families.Add("nut_device_info", "gauge", "Metadata of a UPS device, always 1", 1, append(upsLabels[:2:2],
+		[2]string{"description", ups.Description},
+		[2]string{"manufacturer", upsVariableFirstString(ups, "device.mfr", "ups.mfr")},
+		[2]string{"model", upsVariableFirstString(ups, "device.model", "ups.model")},
+		[2]string{"serial", upsVariableFirstString(ups, "device.serial", "ups.serial")},
+		[2]string{"type", upsVariableFirstString(ups, "device.type")},
+		[2]string{"firmware", upsVariableFirstString(ups, "ups.firmware")},
+		[2]string{"driver", upsVariableFirstString(ups, "driver.name")},
+		[2]string{"driver_version", upsVariableFirstString(ups, "driver.version")},
+	)...)
+}
+
+// Collect the metrics of the UPS devices from the last poll of each NUT server, and of nuttyqt itself.
+// The UPS devices of a NUT server are left out while its last poll failed, so stale values aren't reported.
+func CollectMetrics() metricFamilies {
+	families := metricFamilies{}
+
+	upsDevicesMutex.Lock()
+	servers := append([]*NUTServer{}, nutServers...)
+	devices := map[*NUTServer][]nut.UPS{}
+	for _, server := range servers {
+		devices[server] = upsDevices[server]
+	}
+	upsDevicesMutex.Unlock()
+
+	nutServerMetricsMutex.Lock()
+	defer nutServerMetricsMutex.Unlock()
+	for _, server := range servers {
+		serverLabel := [2]string{"server", server.Config.Name}
+		metrics := nutServerMetrics[server]
+		if metrics == nil {
+			metrics = &NUTServerMetrics{}
+		}
+		up := 0.0
+		if metrics.Up {
+			up = 1
+			for _, ups := range devices[server] {
+				addUPSMetrics(families, server, ups)
+			}
+		}
+		families.Add("nuttyqt_nut_server_up", "gauge", "Whether the last poll of the NUT server succeeded", up, serverLabel)
+		families.Add("nuttyqt_polls_total", "counter", "Number of polls of the NUT server", float64(metrics.Polls), serverLabel)
+		families.Add("nuttyqt_poll_errors_total", "counter", "Number of failed polls of the NUT server", float64(metrics.Errors), serverLabel)
+		families.Add("nuttyqt_poll_duration_seconds", "gauge", "Duration of the last poll of the NUT server", metrics.Duration.Seconds(), serverLabel)
+		if !metrics.LastSuccess.IsZero() {
+			families.Add("nuttyqt_last_poll_success_timestamp_seconds", "gauge", "Time of the last successful poll of the NUT server",
+				float64(metrics.LastSuccess.UnixNano())/1e9, serverLabel)
+		}
+	}
+
+	mqttConnected := 0.0
+	if mqttClient != nil && mqttClient.IsConnectionOpen() {
+		mqttConnected = 1
+	}
+	families.Add("nuttyqt_mqtt_connected", "gauge", "Whether the MQTT client is connected to the MQTT broker", mqttConnected)
+	families.Add("nuttyqt_mqtt_publishes_total", "counter", "Number of messages published to the MQTT broker", float64(mqttPublishes.Load()))
+	families.Add("nuttyqt_mqtt_publish_errors_total", "counter", "Number of messages that failed to publish to the MQTT broker", float64(mqttPublishErrors.Load()))
+	for _, runner := range currentSinks() {
+		health := runner.Health()
+		sinkUp := 0.0
+		if health.Healthy {
+			sinkUp = 1
+		}
+		label := [2]string{"sink", health.Name}
+		families.Add("nuttyqt_sink_up", "gauge", "Whether the last write to the sink succeeded", sinkUp, label)
+		families.Add("nuttyqt_sink_writes_total", "counter", "Number of polls and events written to the sink", float64(health.Writes), label)
+		families.Add("nuttyqt_sink_errors_total", "counter", "Number of polls and events that failed to be written to the sink", float64(health.Errors), label)
+		families.Add("nuttyqt_sink_dropped_total", "counter", "Number of polls and events dropped as the queue of the sink was full", float64(health.Dropped), label)
+		families.Add("nuttyqt_sink_queue_length", "gauge", "Number of polls and events waiting to be written to the sink", float64(health.Queued), label)
+	}
+	families.Add("nuttyqt_build_info", "gauge", "Version of nuttyqt, always 1", 1, [2]string{"version", Version})
+	families.Add("nuttyqt_start_time_seconds", "gauge", "Time nuttyqt was started", float64(metricsStartedTime.UnixNano())/1e9)
+	return families
+}
+
+// Serve the metrics in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	if _, err := CollectMetrics().WriteTo(w); err != nil {
+		log.Debug("Failed to write metrics: ", err)
+	}
+}
+
+// Start the HTTP listener for the Prometheus metrics in the background.
+func StartMetricsServer(address string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for metrics on %s: %w", address, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, metricsHandler)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Metrics server stopped: ", err)
+		}
+	}()
+	log.Info("Serving Prometheus metrics on http://", listener.Addr(), metricsPath)
+	return server, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+func TestPrometheusMetricName(t *testing.T) {
+	tests := []struct {
+		variable string
+		name     string
+	}{
+		{"battery.charge", "nut_battery_charge_percent"},
+		{"input.voltage.nominal", "nut_input_voltage_nominal_volts"},
+		{"battery.runtime", "nut_battery_runtime_seconds"},
+		{"ups.realpower", "nut_ups_realpower_watts"},
+		{"outlet.1.delay.shutdown", "nut_outlet_1_delay_shutdown_seconds"},
+		{"ups.efficiency", "nut_ups_efficiency"},
+		{"driver.parameter.pollinterval", "nut_driver_parameter_pollinterval"},
+	}
+	for _, test := range tests {
+		if name := PrometheusMetricName(test.variable); name != test.name {
+			t.Errorf("PrometheusMetricName(%q) = %q, want %q", test.variable, name, test.name)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	defer func(originalServers []*NUTServer) {
+		nutServers = originalServers
+	}(nutServers)
+
+	siteA := NewNUTServer(NUTServerConfig{Name: "site-a", Host: "localhost", Port: 3493})
+	siteB := NewNUTServer(NUTServerConfig{Name: "site-b", Host: "localhost", Port: 3494})
+	defer RemoveNUTServerMetrics(siteA)
+	defer RemoveNUTServerMetrics(siteB)
+
+	upsDevicesMutex.Lock()
+	nutServers = []*NUTServer{siteA, siteB}
+	upsDevices[siteA] = []nut.UPS{{
+		Name:        "rack1",
+		Description: `Rack "1"`,
+		Variables: []nut.Variable{
+			{Name: "battery.charge", Value: int64(100)},
+			{Name: "input.voltage", Value: 232.6},
+			{Name: "ups.beeper.status", Value: false},
+			{Name: "ups.status", Value: "OL CHRG TEST"},
+			{Name: "device.model", Value: "Powerwalker VI 2200 RLE"},
+			{Name: "ups.mfr", Value: "Powerwalker"},
+			{Name: "ups.serial", Value: int64(0)},
+		},
+	}}
+	upsDevices[siteB] = []nut.UPS{{Name: "stale", Variables: []nut.Variable{{Name: "battery.charge", Value: int64(5)}}}}
+	upsDevicesMutex.Unlock()
+	defer func() {
+		upsDevicesMutex.Lock()
+		delete(upsDevices, siteA)
+		delete(upsDevices, siteB)
+		upsDevicesMutex.Unlock()
+	}()
+
+	RecordNUTServerPoll(siteA, 250*time.Millisecond, nil)
+	RecordNUTServerPoll(siteB, time.Second, nil)
+	RecordNUTServerPoll(siteB, 2*time.Second, errors.New("connection refused"))
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != metricsContentType {
+		t.Errorf("Content-Type = %q, want %q", contentType, metricsContentType)
+	}
+	body, _ := io.ReadAll(recorder.Body)
+	text := string(body)
+
+	for _, line := range []string{
+		"# TYPE nut_battery_charge_percent gauge",
+		`nut_battery_charge_percent{ups="rack1",server="site-a"} 100`,
+		`nut_input_voltage_volts{ups="rack1",server="site-a"} 232.6`,
+		`nut_ups_status{ups="rack1",server="site-a",flag="OL"} 1`,
+		`nut_ups_status{ups="rack1",server="site-a",flag="OB"} 0`,
+		`nut_ups_status{ups="rack1",server="site-a",flag="TEST"} 1`,
+		`nut_device_info{ups="rack1",server="site-a",description="Rack \"1\"",manufacturer="Powerwalker",model="Powerwalker VI 2200 RLE",` +
+			`serial="0",type="",firmware="",driver="",driver_version=""} 1`,
+		`nuttyqt_nut_server_up{server="site-a"} 1`,
+		`nuttyqt_nut_server_up{server="site-b"} 0`,
+		`nuttyqt_polls_total{server="site-b"} 2`,
+		`nuttyqt_poll_errors_total{server="site-b"} 1`,
+		`nuttyqt_poll_duration_seconds{server="site-a"} 0.25`,
+		"# TYPE nuttyqt_mqtt_publishes_total counter",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("metrics are missing %q, got:\n%s", line, text)
+		}
+	}
+	if strings.Contains(text, "ups.beeper.status") || strings.Contains(text, "nut_ups_serial") || strings.Contains(text, `ups="stale"`) {
+		t.Errorf("metrics contain a boolean variable, an identifier or a UPS device of a failing NUT server, got:\n%s", text)
+	}
+	if strings.Count(text, "# TYPE nut_ups_status gauge") != 1 {
+		t.Errorf("metrics have more than one TYPE line for nut_ups_status, got:\n%s", text)
+	}
+
+	recorder = httptest.NewRecorder()
+	metricsHandler(recorder, httptest.NewRequest(http.MethodPost, metricsPath, nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST %s = %d, want %d", metricsPath, recorder.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	nut "github.com/robbiet480/go.nut"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Payload of the availability topic while nuttyqt is connected.
+	mqttAvailabilityOnline = "online"
+
+	// Payload of the availability topic after nuttyqt has disconnected or died.
+	mqttAvailabilityOffline = "offline"
+)
+
+const (
+	// Publish each UPS device as a single JSON document.
+	MQTTPublishModeJSON = "json"
+
+	// Publish each UPS variable to its own retained topic.
+	MQTTPublishModeVariables = "variables"
+
+	// Publish both the JSON document and the variables.
+	MQTTPublishModeBoth = "both"
+)
+
+// FIXME: Do we even need this at this point?!
+var mqttMessageHandler mqtt.MessageHandler = func(client mqtt.Client, msg mqtt.Message) {
+	log.Debug("TOPIC: ", msg.Topic())
+	log.Debug("MSG: ", msg.Payload())
+}
+
+// Get the MQTT topic for the availability of nuttyqt itself.
+func MQTTAvailabilityTopic() string {
+	return fmt.Sprintf("%s/status", CurrentConfig().MQTTTopic)
+}
+
+// Get the MQTT topic for the JSON Schema of the UPS payload.
+func MQTTSchemaTopic() string {
+	return fmt.Sprintf("%s/schema", CurrentConfig().MQTTTopic)
+}
+
+// Topic levels under the MQTT topic that nuttyqt publishes its own state to, eg. its availability to "<topic>/status",
+// and the connection state of the NUT servers to "<topic>/nut/<server>".
+var mqttReservedTopicLevels = map[string]bool{
+	"nut":    true,
+	"schema": true,
+	"status": true,
+}
+
+// Check that the topic of a UPS device isn't one of the topics that nuttyqt publishes its own state to, or under it,
+// so eg. a UPS device named "status" doesn't overwrite the availability of nuttyqt.
+func checkMQTTReservedTopic(mqttTopic string, topic string) error {
+	levels := strings.Split(strings.TrimPrefix(topic, mqttTopic+"/"), "/")
+	if !strings.HasPrefix(topic, mqttTopic+"/") || !mqttReservedTopicLevels[levels[0]] {
+		return nil
+	}
+	return fmt.Errorf("topic %q is under %s/%s, which is reserved for nuttyqt itself", topic, mqttTopic, levels[0])
+}
+
+// Mark nuttyqt as online every time the MQTT client (re)connects,
+// as the broker may have published the Last Will in the meantime.
+// The payload schema is published alongside it, so consumers can always find it.
+var mqttConnectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
+	log.Debug("Connected to MQTT broker, publishing availability ...")
+	availabilityToken := client.Publish(MQTTAvailabilityTopic(), 1, true, mqttAvailabilityOnline)
+	schemaToken := client.Publish(MQTTSchemaTopic(), 1, true, UPSPayloadSchema)
+	go func() {
+		if !availabilityToken.WaitTimeout(5*time.Second) || availabilityToken.Error() != nil {
+			log.Warn("Failed to publish availability to MQTT broker: ", availabilityToken.Error())
+		}
+		if !schemaToken.WaitTimeout(5*time.Second) || schemaToken.Error() != nil {
+			log.Warn("Failed to publish payload schema to MQTT broker: ", schemaToken.Error())
+		}
+	}()
+
+	// Subscriptions don't survive a reconnect, so (re)subscribe every time.
+	SubscribeUPSCommands(client)
+}
+
+// Certificates of the MQTT connection, which are reloaded on SIGHUP.
+var mqttTLSFiles atomic.Pointer[TLSFiles]
+
+// Check whether an MQTT broker protocol uses TLS, eg. "ssl" or "wss".
+func IsMQTTTLSProtocol(protocol string) bool {
+	switch protocol {
+	case "ssl", "tls", "mqtts", "mqtt+ssl", "tcps", "wss":
+		return true
+	}
+	return false
+}
+
+// Load the certificates of the MQTT connection, which are used from the next (re)connect onwards.
+func LoadMQTTTLSFiles() error {
+	config := CurrentConfig()
+	files, err := LoadTLSFiles(config.MQTTTLSCA, config.MQTTTLSCert, config.MQTTTLSKey)
+	if err != nil {
+		return err
+	}
+	mqttTLSFiles.Store(files)
+	return nil
+}
+
+// Create the TLS config of the MQTT connection from the configuration.
+func NewMQTTTLSConfig() (*tls.Config, error) {
+	if err := LoadMQTTTLSFiles(); err != nil {
+		return nil, err
+	}
+	config := CurrentConfig()
+	minVersion, err := ParseTLSVersion(config.MQTTTLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	serverName := config.MQTTTLSServerName
+	if serverName == "" {
+		serverName = config.MQTTBrokerHost
+	}
+	if config.MQTTTLSInsecure {
+		log.Warn("Verifying the certificate of the MQTT broker is disabled, the connection isn't protected against impersonation")
+	}
+	return NewTLSConfig(&mqttTLSFiles, serverName, minVersion, config.MQTTTLSInsecure), nil
+}
+
+// Create a new MQTT client and connect to the MQTT broker.
+func CreateMQTTClient() {
+	//
+	// NOTE: Usage examples for the Paho MQTT client:
+	//
+	// https://github.com/eclipse/paho.mqtt.golang/tree/master/cmd
+	//
+
+	// FIXME: How can we catch runtime errors from the mqtt library? Eg. "error triggered" messages that it handles internally..
+
+	// mqtt.DEBUG = log.New(os.Stdout, "", 0)
+	// mqtt.ERROR = log.New(os.Stdout, "", 0)
+	mqtt.ERROR = logrus.New() // FIXME: Ideally redirect these to our existing logger, instead of a new one.
+
+	// TODO: Does this library handle reconnecting automatically?
+	log.Debug("Setting up MQTT client ...")
+	config := CurrentConfig()
+	opts := mqtt.NewClientOptions()
+	opts.SetConnectRetry(false)
+	opts.SetAutoReconnect(true)
+	opts.AddBroker(fmt.Sprintf("%s://%s:%d", config.MQTTBrokerProtocol, config.MQTTBrokerHost, config.MQTTBrokerPort))
+	opts.SetClientID(config.MQTTClient)
+	if IsMQTTTLSProtocol(config.MQTTBrokerProtocol) {
+		tlsConfig, err := NewMQTTTLSConfig()
+		if err != nil {
+			log.Fatal("Failed to set up TLS for MQTT broker: ", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if config.MQTTUser != "" {
+		log.Debug("Authenticating with MQTT broker as ", config.MQTTUser, " ...")
+		opts.SetUsername(config.MQTTUser)
+		opts.SetPassword(config.MQTTPass)
+	}
+	opts.SetDefaultPublishHandler(mqttMessageHandler)
+	opts.SetKeepAlive(2 * time.Second)
+	opts.SetDefaultPublishHandler(mqttMessageHandler)
+	opts.SetPingTimeout(1 * time.Second)
+
+	// Let the broker mark nuttyqt as offline if the connection is lost unexpectedly.
+	opts.SetWill(MQTTAvailabilityTopic(), mqttAvailabilityOffline, 1, true)
+	opts.SetOnConnectHandler(mqttConnectHandler)
+
+	// FIXME: If mqttClient can't be a pointer, how can we check if it's nil and not recreate it?
+	log.Debug("Creating MQTT client ...")
+	mqttClient = mqtt.NewClient(opts)
+
+	log.Info(fmt.Sprintf("Connecting to MQTT broker at %s://%s:%d ...", config.MQTTBrokerProtocol, config.MQTTBrokerHost, config.MQTTBrokerPort))
+	if token := mqttClient.Connect(); token.WaitTimeout(5*time.Second) && token.Error() != nil {
+		log.Fatal("Failed to connect to MQTT broker: ", token.Error())
+	}
+}
+
+// Get the MQTT topic for a UPS variable, eg. "battery.charge" to "<ups topic>/battery/charge".
+func MQTTVariableTopic(upsTopic string, variableName string) string {
+	return fmt.Sprintf("%s/%s", upsTopic, strings.ReplaceAll(variableName, ".", "/"))
+}
+
+// Format the value of a UPS variable as a plain MQTT payload, eg. "100" or "232.6",
+// or the raw value of an identifier, eg. "0601" for "ups.productid".
+func MQTTVariableValue(variable nut.Variable) string {
+	return NUTVariableString(variable)
+}
+
+// Get the decoded "ups.status" flags and "ups.alarm" alarms of a UPS device as plain values by topic,
+// eg. "<ups topic>/status/on_battery" → "true" and "<ups topic>/alarms" → `["Replace battery!"]`,
+// so consumers of the variables don't have to decode the raw "ups.status" variable themselves.
+func MQTTDecodedTopics(upsTopic string, payload UPSPayload) (map[string]string, error) {
+	topics := map[string]string{}
+	if payload.Status != nil {
+		statusJSON, err := json.Marshal(payload.Status)
+		if err != nil {
+			return nil, err
+		}
+		flags := map[string]json.RawMessage{}
+		if err := json.Unmarshal(statusJSON, &flags); err != nil {
+			return nil, err
+		}
+		for name, value := range flags {
+			topics[fmt.Sprintf("%s/status/%s", upsTopic, name)] = string(value)
+		}
+	}
+
+	// The alarms are published even when there are none, so the retained alarms are cleared once they are gone.
+	alarms := payload.Alarms
+	if alarms == nil {
+		alarms = []string{}
+	}
+	alarmsJSON, err := json.Marshal(alarms)
+	if err != nil {
+		return nil, err
+	}
+	topics[fmt.Sprintf("%s/alarms", upsTopic)] = string(alarmsJSON)
+	return topics, nil
+}
+
+// Publish a message to the MQTT broker and wait for it to be sent.
+func PublishMQTT(topic string, qos byte, retained bool, payload interface{}) error {
+	token := mqttClient.Publish(topic, qos, retained, payload)
+	var err error
+	if !token.WaitTimeout(5 * time.Second) {
+		err = fmt.Errorf("timed out publishing to MQTT topic %s", topic)
+	} else {
+		err = token.Error()
+	}
+	RecordMQTTPublish(err)
+	return err
+}
+
+// MQTTSink publishes the UPS devices and their events to the MQTT broker.
+type MQTTSink struct{}
+
+func (sink *MQTTSink) Name() string {
+	return "mqtt"
+}
+
+// Publish the UPS devices of a successful poll, using a separate topic for each UPS device.
+// Publishing continues after an error, which is returned once all UPS devices have been published.
+func (sink *MQTTSink) WritePoll(poll Poll) error {
+	if poll.Err != nil {
+		return nil
+	}
+	if mqttClient == nil || !mqttClient.IsConnectionOpen() {
+		return errors.New("MQTT client is not connected")
+	}
+
+	// Keep the Home Assistant discovery configs in sync with the UPS devices.
+	PublishHomeAssistantDiscovery(poll.Server, poll.UPSList)
+
+	var firstErr error
+	for _, upsDevice := range poll.UPSList {
+		if err := sink.publishUPS(poll, upsDevice); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Publish a UPS device as JSON, as variables or both, depending on the publish mode.
+func (sink *MQTTSink) publishUPS(poll Poll, upsDevice nut.UPS) error {
+	upsTopic, err := poll.Server.UPSTopic(upsDevice.Name)
+	if err != nil {
+		return err
+	}
+
+	payload := NewUPSPayload(poll.Server, upsDevice, poll.Timestamp)
+
+	if CurrentConfig().MQTTPublishMode != MQTTPublishModeVariables {
+		// Serialize the UPS device to JSON.
+		log.Debug("Serializing UPS device ", upsDevice.Name, " to JSON ...")
+		upsDeviceJSON, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to serialize UPS device to JSON: %w", err)
+		}
+
+		log.Debug("Sending data to MQTT broker on topic ", upsTopic, " ...")
+		if err := PublishMQTT(upsTopic, 0, false, upsDeviceJSON); err != nil {
+			return fmt.Errorf("failed to send data to MQTT broker: %w", err)
+		}
+	}
+
+	if CurrentConfig().MQTTPublishMode != MQTTPublishModeJSON {
+		// Send each variable to its own retained topic, eg. "battery.charge" to "<ups topic>/battery/charge".
+		log.Debug("Sending variables to MQTT broker on topic ", upsTopic, "/# ...")
+		for _, variable := range upsDevice.Variables {
+			if err := PublishMQTT(MQTTVariableTopic(upsTopic, variable.Name), 0, true, MQTTVariableValue(variable)); err != nil {
+				return fmt.Errorf("failed to send data to MQTT broker: %w", err)
+			}
+		}
+
+		// Send the decoded status flags and alarms as well, eg. "<ups topic>/status/on_battery".
+		decodedTopics, err := MQTTDecodedTopics(upsTopic, payload)
+		if err != nil {
+			return fmt.Errorf("failed to decode the status of UPS device %s: %w", upsDevice.Name, err)
+		}
+		for topic, value := range decodedTopics {
+			if err := PublishMQTT(topic, 0, true, value); err != nil {
+				return fmt.Errorf("failed to send data to MQTT broker: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Publish an event of a UPS device to the MQTT broker.
+func (sink *MQTTSink) WriteEvent(server *NUTServer, event UPSEvent) error {
+	if mqttClient == nil || !mqttClient.IsConnectionOpen() {
+		return errors.New("MQTT client is not connected")
+	}
+	return PublishUPSEvent(server, event)
+}
+
+// Disconnect from the MQTT broker.
+func (sink *MQTTSink) Close() error {
+	return CloseMQTT()
+}
+
+// Close the MQTT client.
+func CloseMQTT() error {
+	if mqttClient == nil {
+		log.Debug("No MQTT client to disconnect from, skipping ...")
+		return nil
+	}
+
+	// Mark nuttyqt as offline, as the broker doesn't publish the Last Will on a clean disconnect.
+	var publishErr error
+	if mqttClient.IsConnectionOpen() {
+		log.Debug("Publishing offline availability to MQTT broker ...")
+		publishErr = PublishMQTT(MQTTAvailabilityTopic(), 1, true, mqttAvailabilityOffline)
+	}
+
+	log.Debug("Disconnecting from MQTT broker ...")
+	mqttClient.Disconnect(250)
+	return publishErr
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+func TestMQTTVariableTopic(t *testing.T) {
+	if topic := MQTTVariableTopic("nuttyqt/rack1", "battery.charge.low"); topic != "nuttyqt/rack1/battery/charge/low" {
+		t.Errorf("MQTTVariableTopic() = %q, want %q", topic, "nuttyqt/rack1/battery/charge/low")
+	}
+}
+
+func TestMQTTVariableValue(t *testing.T) {
+	tests := []struct {
+		value   interface{}
+		payload string
+	}{
+		{int64(100), "100"},
+		{232.6, "232.6"},
+		{50.0, "50"},
+		{false, "false"},
+		{"OL CHRG ", "OL CHRG"},
+	}
+	for _, test := range tests {
+		if payload := MQTTVariableValue(nut.Variable{Name: "battery.charge", Value: test.value}); payload != test.payload {
+			t.Errorf("MQTTVariableValue(%v) = %q, want %q", test.value, payload, test.payload)
+		}
+	}
+}
+
+func TestMQTTVariableValueIdentifiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		payload string
+	}{
+		{"ups.serial", "000000000000", "000000000000"},
+		{"ups.productid", "0601", "0601"},
+		{"ups.firmware", "1.10", "1.10"},
+		{"battery.charge", "100", "100"},
+		{"input.voltage", "232.60", "232.6"},
+	}
+	for _, test := range tests {
+		variable := newNUTVariable(test.name, test.value, "", nil)
+		if payload := MQTTVariableValue(variable); payload != test.payload {
+			t.Errorf("MQTTVariableValue() of %s %q = %q, want %q", test.name, test.value, payload, test.payload)
+		}
+	}
+}
+
+func TestMQTTDecodedTopics(t *testing.T) {
+	ups := nut.UPS{Name: "rack1", Variables: []nut.Variable{
+		{Name: "ups.status", Value: "OB DISCHRG TEST"},
+		{Name: "ups.alarm", Value: "[Replace battery!] [Overload]"},
+	}}
+	topics, err := MQTTDecodedTopics("nuttyqt/rack1", NewUPSPayload(NewNUTServer(NUTServerConfig{}), ups, time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"nuttyqt/rack1/status/online":     "false",
+		"nuttyqt/rack1/status/on_battery": "true",
+		"nuttyqt/rack1/status/unknown":    `["TEST"]`,
+		"nuttyqt/rack1/alarms":            `["Replace battery!","Overload"]`,
+	}
+	for topic, value := range want {
+		if topics[topic] != value {
+			t.Errorf("MQTTDecodedTopics()[%q] = %q, want %q", topic, topics[topic], value)
+		}
+	}
+
+	// Alarms that are gone are cleared, as the topics are retained.
+	topics, _ = MQTTDecodedTopics("nuttyqt/rack1", NewUPSPayload(NewNUTServer(NUTServerConfig{}), nut.UPS{Name: "rack1"}, time.Now()))
+	if len(topics) != 1 || topics["nuttyqt/rack1/alarms"] != "[]" {
+		t.Errorf("MQTTDecodedTopics() without status = %q, want only empty alarms", topics)
+	}
+}
@@ -0,0 +1,807 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+// ErrNUTServerUnreachable is returned while a NUT server is unreachable and waiting to be reconnected.
+var ErrNUTServerUnreachable = errors.New("NUT server is unreachable")
+
+// NUTServerConfig holds the configuration for a single NUT server.
+type NUTServerConfig struct {
+	// Name of the NUT server, used for logging. Defaults to "<host>:<port>".
+	Name string `yaml:"name"`
+
+	// NUT server host. Defaults to "localhost".
+	Host string `yaml:"host"`
+
+	// NUT server port. Defaults to 3493.
+	Port int `yaml:"port"`
+
+	// NUT username. Defaults to "".
+	User string `yaml:"user"`
+
+	// NUT password. Defaults to "".
+	Pass string `yaml:"pass"`
+
+	// Negotiate TLS with STARTTLS before authenticating. Defaults to false.
+	StartTLS bool `yaml:"starttls"`
+
+	// CA bundle to verify the NUT server with. Defaults to "",
+	// which uses the system roots, unless a certificate fingerprint is pinned.
+	TLSCA string `yaml:"tls_ca"`
+
+	// SHA-256 fingerprint of the certificate of the NUT server to pin, eg. "48:AB:FF:...". Defaults to "".
+	TLSFingerprint string `yaml:"tls_fingerprint"`
+
+	// Name to verify the certificate of the NUT server for. Defaults to "", which uses the NUT server host.
+	TLSServerName string `yaml:"tls_server_name"`
+
+	// Send the username and password without STARTTLS, where anyone on the network can read them. Defaults to false.
+	AllowCleartextAuth bool `yaml:"allow_cleartext_auth"`
+
+	// MQTT topic prefix for the UPS devices of this server,
+	// relative to the MQTT topic. Defaults to "".
+	TopicPrefix string `yaml:"topic_prefix"`
+
+	// Go template for the MQTT topic of the UPS devices of this server, eg. "{{.Topic}}/{{.Server}}/{{.UPS}}".
+	// Defaults to "", which uses "<MQTT topic>/<topic prefix>/<UPS name>".
+	TopicTemplate string `yaml:"topic_template"`
+
+	// Names of the UPS devices to monitor. Defaults to all devices.
+	UPSInclude []string `yaml:"ups_include"`
+
+	// Names of the UPS devices to skip. Defaults to none.
+	UPSExclude []string `yaml:"ups_exclude"`
+
+	// Instant commands that may be sent over MQTT, by UPS name,
+	// or "*" for all UPS devices. Defaults to none.
+	UPSCommands map[string][]string `yaml:"commands"`
+
+	// Variables that may be written over MQTT, by UPS name,
+	// or "*" for all UPS devices. Defaults to none.
+	UPSVariables map[string][]string `yaml:"variables"`
+}
+
+// NUTServer holds the connection state of a single NUT server,
+// and reconnects to it in the background when the connection is lost.
+type NUTServer struct {
+	Config NUTServerConfig
+
+	// Parsed topic template, or nil to use the default topic.
+	topicTemplate *template.Template
+
+	// Why the topic template is invalid, so no topics are used for this server instead of the wrong ones.
+	topicTemplateErr error
+
+	client *NUTClient
+
+	// Guards the client, as a NUT connection can only handle one command at a time.
+	// Every command has a deadline, so a stuck NUT server only holds it until the command times out.
+	mutex sync.Mutex
+
+	// Whether the server is unreachable and being reconnected in the background.
+	reconnecting bool
+
+	// Closed when the server is closed, to stop reconnecting.
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NUT servers that are being monitored.
+var nutServers []*NUTServer
+
+// Create a new NUT server from its configuration.
+func NewNUTServer(serverConfig NUTServerConfig) *NUTServer {
+	if serverConfig.Name == "" {
+		serverConfig.Name = fmt.Sprintf("%s:%d", serverConfig.Host, serverConfig.Port)
+	}
+	server := &NUTServer{Config: serverConfig, stop: make(chan struct{})}
+	if serverConfig.TopicTemplate != "" {
+		server.topicTemplate, server.topicTemplateErr = ParseNUTTopicTemplate(serverConfig.TopicTemplate, NewNUTTopicTemplateData(serverConfig, CurrentConfig().MQTTTopic))
+		if server.topicTemplateErr != nil {
+			log.Error("Invalid topic template for NUT server ", serverConfig.Name, ", skipping its UPS devices: ", server.topicTemplateErr)
+		}
+	}
+	return server
+}
+
+// NUTTopicTemplateData is the data that is available to the topic template of a NUT server.
+type NUTTopicTemplateData struct {
+	// MQTT topic, eg. "nuttyqt".
+	Topic string
+
+	// Topic prefix of the NUT server, without leading or trailing slashes.
+	Prefix string
+
+	// Name of the NUT server.
+	Server string
+
+	// Name of the UPS device.
+	UPS string
+}
+
+// Get the data for the topic template of a NUT server, without the UPS name.
+func NewNUTTopicTemplateData(serverConfig NUTServerConfig, topic string) NUTTopicTemplateData {
+	name := serverConfig.Name
+	if name == "" {
+		name = fmt.Sprintf("%s:%d", serverConfig.Host, serverConfig.Port)
+	}
+	return NUTTopicTemplateData{Topic: topic, Prefix: strings.Trim(serverConfig.TopicPrefix, "/"), Server: name}
+}
+
+// Parse the topic template of a NUT server, and make sure that it results in valid MQTT topics with the actual values
+// of the server, eg. an empty topic prefix, and with the UPS name as a topic level of its own, so the command topics can be subscribed to.
+func ParseNUTTopicTemplate(text string, data NUTTopicTemplateData) (*template.Template, error) {
+	topicTemplate, err := template.New("topic").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var topic strings.Builder
+	data.UPS = "+"
+	if err := topicTemplate.Execute(&topic, data); err != nil {
+		return nil, err
+	}
+	upsLevels := 0
+	for _, level := range strings.Split(topic.String(), "/") {
+		switch {
+		case level == "+":
+			upsLevels++
+		case level == "":
+			return nil, fmt.Errorf("topic %q has an empty topic level", topic.String())
+		case strings.ContainsAny(level, "+#"):
+			return nil, fmt.Errorf("topic %q contains an MQTT wildcard", topic.String())
+		}
+	}
+	if upsLevels != 1 {
+		return nil, errors.New("the UPS name ({{.UPS}}) must be used exactly once, as a topic level of its own")
+	}
+	if err := checkMQTTReservedTopic(data.Topic, topic.String()); err != nil {
+		return nil, err
+	}
+	return topicTemplate, nil
+}
+
+// Get the delay before the given reconnect attempt, using exponential backoff with jitter.
+func NUTReconnectDelay(attempt int) time.Duration {
+	minDelay := time.Duration(CurrentConfig().NUTReconnectMinDelay) * time.Second
+	maxDelay := time.Duration(CurrentConfig().NUTReconnectMaxDelay) * time.Second
+	delay := minDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// Randomize the second half of the delay, so multiple bridges don't reconnect in lockstep.
+	// #nosec G404 -- Jitter doesn't need a cryptographically secure random number.
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Descriptions of the NUT protocol error codes, as the NUT documentation and the client of go.nut describe them.
+var nutErrorDescriptions = map[string]string{
+	"ACCESS-DENIED":          "The client’s host and/or authentication details (username, password) are not sufficient to execute the requested command",
+	"UNKNOWN-UPS":            "The UPS specified in the request is not known to upsd. This usually means that it didn’t match anything in ups.conf",
+	"VAR-NOT-SUPPORTED":      "The specified UPS doesn’t support the variable in the request. This is also sent for unrecognized variables which are in a space which is handled by upsd, such as server.*",
+	"CMD-NOT-SUPPORTED":      "The specified UPS doesn’t support the instant command in the request",
+	"INVALID-ARGUMENT":       "The client sent an argument to a command which is not recognized or is otherwise invalid in this context. This is typically caused by sending a valid command like GET with an invalid subcommand",
+	"INSTCMD-FAILED":         "upsd failed to deliver the instant command request to the driver. No further information is available to the client. This typically indicates a dead or broken driver",
+	"SET-FAILED":             "upsd failed to deliver the set request to the driver. This is just like INSTCMD-FAILED above",
+	"READONLY":               "The requested variable in a SET command is not writable",
+	"TOO-LONG":               "The requested value in a SET command is too long",
+	"FEATURE-NOT-SUPPORTED":  "This instance of upsd does not support the requested feature. This is only used for TLS/SSL mode (STARTTLS) at the moment",
+	"FEATURE-NOT-CONFIGURED": "This instance of upsd hasn’t been configured properly to allow the requested feature to operate. This is also limited to STARTTLS for now",
+	"ALREADY-SSL-MODE":       "TLS/SSL mode is already enabled on this connection, so upsd can’t start it again",
+	"DRIVER-NOT-CONNECTED":   "upsd can’t perform the requested command, since the driver for that UPS is not connected. This usually means that the driver is not running, or if it is, the ups.conf is misconfigured",
+	"DATA-STALE":             "upsd is connected to the driver for the UPS, but that driver isn’t providing regular updates or has specifically marked the data as stale. upsd refuses to provide variables on stale units to avoid false readings. This generally means that the driver is running, but it has lost communications with the hardware. Check the physical connection to the equipment",
+	"ALREADY-LOGGED-IN":      "The client already sent LOGIN for a UPS and can’t do it again. There is presently a limit of one LOGIN record per connection",
+	"INVALID-PASSWORD":       "The client sent an invalid PASSWORD - perhaps an empty one",
+	"ALREADY-SET-PASSWORD":   "The client already set a PASSWORD and can’t set another. This also should never happen with normal NUT clients",
+	"INVALID-USERNAME":       "The client sent an invalid USERNAME",
+	"ALREADY-SET-USERNAME":   "The client has already set a USERNAME, and can’t set another. This should never happen with normal NUT clients",
+	"USERNAME-REQUIRED":      "The requested command requires a username for authentication, but the client hasn’t set one",
+	"PASSWORD-REQUIRED":      "The requested command requires a passname for authentication, but the client hasn’t set one",
+	"UNKNOWN-COMMAND":        "upsd doesn’t recognize the requested command",
+	"INVALID-VALUE":          "The value specified in the request is not valid. This usually applies to a SET of an ENUM type which is using a value which is not in the list of allowed values",
+}
+
+// NUTValueError is returned when nuttyqt rejects a value before sending it to the NUT server,
+// with the error code that the NUT server would have used, eg. "READONLY".
+type NUTValueError struct {
+	Code    string
+	Message string
+}
+
+func (err *NUTValueError) Error() string {
+	return err.Message
+}
+
+// Get the NUT protocol error code of an error from the NUT client, eg. "ACCESS-DENIED".
+func NUTErrorCode(err error) string {
+	var valueErr *NUTValueError
+	if errors.As(err, &valueErr) {
+		return valueErr.Code
+	}
+	if isNUTConnectionError(err) {
+		return "CONNECTION-FAILED"
+	}
+	if errors.Is(err, ErrNUTServerUnreachable) {
+		return "SERVER-UNREACHABLE"
+	}
+	var nutErr *NUTError
+	if errors.As(err, &nutErr) {
+		return nutErr.Code
+	}
+	return "UNKNOWN-ERROR"
+}
+
+// NUTVariableType is the type of a UPS variable, as reported by GET TYPE.
+type NUTVariableType struct {
+	// Whether the variable can be written with SET VAR.
+	Writable bool
+
+	// Whether the variable only accepts the values from LIST ENUM.
+	Enum bool
+
+	// Whether the variable only accepts values within the ranges from LIST RANGE.
+	Range bool
+
+	// Whether the variable is numeric.
+	Number bool
+
+	// Maximum length of a string variable, or 0 if unknown.
+	MaxLength int
+}
+
+// Parse the types of a UPS variable from a GET TYPE response, eg. ["RW", "STRING:32"].
+func ParseNUTVariableType(types []string) NUTVariableType {
+	varType := NUTVariableType{}
+	for _, t := range types {
+		switch {
+		case t == "RW":
+			varType.Writable = true
+		case t == "ENUM":
+			varType.Enum = true
+		case t == "RANGE":
+			varType.Range = true
+		case t == "NUMBER":
+			varType.Number = true
+		case strings.HasPrefix(t, "STRING:"):
+			varType.MaxLength, _ = strconv.Atoi(strings.TrimPrefix(t, "STRING:"))
+		}
+	}
+	return varType
+}
+
+// Check that a value can be written to a UPS variable of the given type,
+// using the allowed values of ENUM variables and the allowed ranges of RANGE variables.
+func ValidateNUTVariableValue(varType NUTVariableType, value string, enumValues []string, ranges [][2]float64) error {
+	if !varType.Writable {
+		return &NUTValueError{"READONLY", "The variable is not writable"}
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return &NUTValueError{"INVALID-VALUE", "The value must be a single line"}
+	}
+	if varType.MaxLength > 0 && len(value) > varType.MaxLength {
+		return &NUTValueError{"TOO-LONG", fmt.Sprintf("The value is longer than %d characters", varType.MaxLength)}
+	}
+	if varType.Number || varType.Range {
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return &NUTValueError{"INVALID-VALUE", "The value is not a number"}
+		}
+		if varType.Range {
+			inRange := false
+			for _, r := range ranges {
+				if number >= r[0] && number <= r[1] {
+					inRange = true
+				}
+			}
+			if !inRange {
+				return &NUTValueError{"INVALID-VALUE", fmt.Sprintf("The value is not within the allowed ranges %v", ranges)}
+			}
+		}
+	}
+	if varType.Enum {
+		for _, enumValue := range enumValues {
+			if enumValue == value {
+				return nil
+			}
+		}
+		return &NUTValueError{"INVALID-VALUE", fmt.Sprintf("The value is not one of the allowed values %q", enumValues)}
+	}
+	return nil
+}
+
+// Get the quoted values from a line of a NUT response, eg. ["120", "140"] from `RANGE <ups> <variable> "120" "140"`.
+func nutQuotedValues(line string) []string {
+	values := []string{}
+	var value strings.Builder
+	quoted, escaped := false, false
+	for _, r := range line {
+		switch {
+		case escaped:
+			value.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			if quoted {
+				values = append(values, value.String())
+				value.Reset()
+			}
+			quoted = !quoted
+		case quoted:
+			value.WriteRune(r)
+		}
+	}
+	return values
+}
+
+// NUT variable name components of identifiers that may look like numbers, eg. "serial" in "ups.serial".
+var nutIdentifierComponents = map[string]bool{
+	"date":      true,
+	"firmware":  true,
+	"id":        true,
+	"macaddr":   true,
+	"mfr":       true,
+	"model":     true,
+	"productid": true,
+	"serial":    true,
+	"vendorid":  true,
+	"version":   true,
+}
+
+// Check if a NUT variable is an identifier that may look like a number, eg. "ups.serial" or "battery.mfr.date".
+func isNUTIdentifier(name string) bool {
+	for _, component := range strings.Split(name, ".") {
+		if nutIdentifierComponents[component] {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the value of a NUT variable as a number, if it is a measurement, eg. "battery.charge".
+// Identifiers that look like numbers, eg. "ups.serial" or "battery.mfr.date", aren't measurements,
+// as the NUT client library converts any value that looks like a number.
+func NUTVariableNumber(variable nut.Variable) (float64, bool) {
+	if isNUTIdentifier(variable.Name) {
+		return 0, false
+	}
+	switch value := variable.Value.(type) {
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+// Get the value of a NUT variable as a string, eg. "000000000000" for "ups.serial", which the NUT client keeps
+// as the NUT server sent it, as opposed to numbers and booleans, which are formatted, eg. "232.6" or "false".
+func NUTVariableString(variable nut.Variable) string {
+	switch value := variable.Value.(type) {
+	case string:
+		return strings.TrimSpace(value)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// Check if an error from the NUT client means that the connection itself is broken,
+// as opposed to an error response from the NUT server.
+func isNUTConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF)
+}
+
+// Check if a UPS device should be monitored, based on the include and exclude lists.
+func (server *NUTServer) IsUPSAllowed(name string) bool {
+	for _, excluded := range server.Config.UPSExclude {
+		if excluded == name {
+			return false
+		}
+	}
+	if len(server.Config.UPSInclude) == 0 {
+		return true
+	}
+	for _, included := range server.Config.UPSInclude {
+		if included == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the MQTT topic for the connection state of this server.
+func (server *NUTServer) StateTopic() string {
+	name := strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(server.Config.Name)
+	return fmt.Sprintf("%s/nut/%s", CurrentConfig().MQTTTopic, name)
+}
+
+// Get the MQTT topic for a UPS device of this server, or an error if the topic template doesn't result in a valid topic for it.
+func (server *NUTServer) UPSTopic(upsName string) (string, error) {
+	if server.topicTemplateErr != nil {
+		return "", fmt.Errorf("invalid topic template for NUT server %s: %w", server.Config.Name, server.topicTemplateErr)
+	}
+	return nutUPSTopic(server.Config, server.topicTemplate, CurrentConfig().MQTTTopic, upsName)
+}
+
+// Get the MQTT topic for a UPS device of a NUT server with its parsed topic template, or nil for the default topic.
+func nutUPSTopic(serverConfig NUTServerConfig, topicTemplate *template.Template, mqttTopic string, upsName string) (string, error) {
+	data := NewNUTTopicTemplateData(serverConfig, mqttTopic)
+	data.UPS = upsName
+	topic := fmt.Sprintf("%s/%s", data.Topic, data.UPS)
+	if data.Prefix != "" {
+		topic = fmt.Sprintf("%s/%s/%s", data.Topic, data.Prefix, data.UPS)
+	}
+	if topicTemplate != nil {
+		var text strings.Builder
+		if err := topicTemplate.Execute(&text, data); err != nil {
+			return "", fmt.Errorf("failed to execute the topic template of NUT server %s for UPS device %s: %w", data.Server, upsName, err)
+		}
+		if topic = text.String(); strings.Contains("/"+topic+"/", "//") {
+			return "", fmt.Errorf("topic template of NUT server %s results in %q for UPS device %s, which has an empty topic level", data.Server, topic, upsName)
+		}
+	}
+	if err := checkMQTTReservedTopic(mqttTopic, topic); err != nil {
+		return "", fmt.Errorf("invalid topic for UPS device %s of NUT server %s: %w", upsName, data.Server, err)
+	}
+	return topic, nil
+}
+
+// Check if an allowlist by UPS name contains a name, either for the UPS device itself or for all devices ("*").
+func allowlistContains(allowlist map[string][]string, upsName string, name string) bool {
+	for _, key := range []string{upsName, "*"} {
+		for _, allowed := range allowlist[key] {
+			if allowed == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check if an instant command may be sent to a UPS device over MQTT.
+func (server *NUTServer) IsCommandAllowed(upsName string, command string) bool {
+	return allowlistContains(server.Config.UPSCommands, upsName, command)
+}
+
+// Check if a variable of a UPS device may be written over MQTT.
+func (server *NUTServer) IsVariableAllowed(upsName string, variable string) bool {
+	return allowlistContains(server.Config.UPSVariables, upsName, variable)
+}
+
+// Connect and authenticate with the NUT server. The mutex must be held by the caller.
+func (server *NUTServer) connect() error {
+	hasCredentials := server.Config.User != "" && server.Config.Pass != ""
+	if hasCredentials && !server.Config.StartTLS && !server.Config.AllowCleartextAuth {
+		return fmt.Errorf("refusing to send the credentials for NUT server %s in cleartext, enable STARTTLS or allow cleartext authentication", server.Config.Name)
+	}
+
+	// Create a new NUT client and connect to the server, negotiating TLS first if enabled.
+	var client *NUTClient
+	var connectErr error
+	if server.Config.StartTLS {
+		log.Info(fmt.Sprintf("Connecting to NUT server %s at %s:%d with STARTTLS ...", server.Config.Name, server.Config.Host, server.Config.Port))
+		if client, connectErr = server.dialStartTLS(); connectErr != nil {
+			return fmt.Errorf("failed to connect to NUT server %s with STARTTLS: %w", server.Config.Name, connectErr)
+		}
+	} else {
+		log.Info(fmt.Sprintf("Connecting to NUT server %s at %s:%d ...", server.Config.Name, server.Config.Host, server.Config.Port))
+		if client, connectErr = DialNUT(server.Config.Host, server.Config.Port); connectErr != nil {
+			return fmt.Errorf("failed to connect to NUT server %s: %w", server.Config.Name, connectErr)
+		}
+	}
+
+	// Authenticate with the NUT server.
+	log.Debug("Authenticating with NUT server ", server.Config.Name, " ...")
+	if hasCredentials {
+		if authErr := client.Authenticate(server.Config.User, server.Config.Pass); authErr != nil {
+			_ = client.Disconnect()
+			return fmt.Errorf("failed to authenticate with NUT server %s: %w", server.Config.Name, authErr)
+		}
+	} else {
+		log.Debug("No NUT credentials provided for ", server.Config.Name, ". Skipping authentication ...")
+	}
+
+	server.client = client
+	return nil
+}
+
+// Run a function with the connected NUT client, connecting first if necessary.
+// If the connection turns out to be broken, it is dropped and reconnected in the background,
+// and ErrNUTServerUnreachable is returned until the server is reachable again.
+// A command that times out breaks the connection too, as the rest of its response may still arrive.
+func (server *NUTServer) Do(fn func(client *NUTClient) error) error {
+	server.mutex.Lock()
+	if server.client == nil {
+		if server.reconnecting {
+			server.mutex.Unlock()
+			return ErrNUTServerUnreachable
+		}
+		if err := server.connect(); err != nil {
+			server.startReconnecting()
+			server.mutex.Unlock()
+			PublishNUTServerState(server, err, 0)
+			return err
+		}
+		PublishNUTServerState(server, nil, 0)
+	}
+
+	err := fn(server.client)
+	if err != nil && isNUTConnectionError(err) {
+		log.Warn("Lost connection to NUT server ", server.Config.Name, ": ", err)
+		_ = server.client.Close()
+		server.client = nil
+		server.startReconnecting()
+		server.mutex.Unlock()
+		PublishNUTServerState(server, err, 0)
+		return err
+	}
+	server.mutex.Unlock()
+	return err
+}
+
+// Start reconnecting to the NUT server in the background. The mutex must be held by the caller.
+func (server *NUTServer) startReconnecting() {
+	if server.reconnecting {
+		return
+	}
+	server.reconnecting = true
+	go server.reconnect()
+}
+
+// Reconnect to the NUT server until it succeeds or the server is closed.
+func (server *NUTServer) reconnect() {
+	for attempt := 0; ; attempt++ {
+		delay := NUTReconnectDelay(attempt)
+		log.Info(fmt.Sprintf("Reconnecting to NUT server %s in %s ...", server.Config.Name, delay.Round(time.Millisecond)))
+		select {
+		case <-server.stop:
+			return
+		case <-time.After(delay):
+		}
+
+		server.mutex.Lock()
+		select {
+		case <-server.stop:
+			server.mutex.Unlock()
+			return
+		default:
+		}
+		err := server.connect()
+		if err == nil {
+			server.reconnecting = false
+		}
+		server.mutex.Unlock()
+
+		if err == nil {
+			log.Info("Reconnected to NUT server ", server.Config.Name)
+			PublishNUTServerState(server, nil, 0)
+			return
+		}
+		log.Warn(err)
+		PublishNUTServerState(server, err, attempt+1)
+	}
+}
+
+// Send an instant command to a UPS device.
+func (server *NUTServer) SendCommand(upsName string, command string) error {
+	log.Info(fmt.Sprintf("Sending instant command %s to UPS device %s on %s ...", command, upsName, server.Config.Name))
+	return server.Do(func(client *NUTClient) error {
+		_, err := client.SendCommand(fmt.Sprintf("INSTCMD %s %s", upsName, command))
+		return err
+	})
+}
+
+// Write a variable of a UPS device, after checking that it's writable and that the value is valid for its type,
+// and return the value that is read back from the UPS device afterwards.
+func (server *NUTServer) SetVariable(upsName string, variable string, value string) (string, error) {
+	log.Info(fmt.Sprintf("Setting variable %s of UPS device %s on %s to %q ...", variable, upsName, server.Config.Name, value))
+	var newValue string
+	err := server.Do(func(client *NUTClient) error {
+		// Get the type of the variable, eg. "TYPE <ups> <variable> RW STRING:32".
+		resp, err := client.SendCommand(fmt.Sprintf("GET TYPE %s %s", upsName, variable))
+		if err != nil {
+			return err
+		}
+		prefix := fmt.Sprintf("TYPE %s %s", upsName, variable)
+		if !strings.HasPrefix(resp[0], prefix) {
+			return fmt.Errorf("unexpected response to GET TYPE: %q", resp[0])
+		}
+		varType := ParseNUTVariableType(strings.Fields(strings.TrimPrefix(resp[0], prefix)))
+
+		// Double check that the variable is writable, as not every driver reports it in the type.
+		if varType.Writable {
+			resp, err = client.SendCommand(fmt.Sprintf("LIST RW %s", upsName))
+			if err != nil {
+				return err
+			}
+			varType.Writable = false
+			for _, line := range resp {
+				if strings.HasPrefix(line, fmt.Sprintf("RW %s %s ", upsName, variable)) {
+					varType.Writable = true
+				}
+			}
+		}
+
+		// Get the allowed values of the variable.
+		var enumValues []string
+		if varType.Writable && varType.Enum {
+			resp, err = client.SendCommand(fmt.Sprintf("LIST ENUM %s %s", upsName, variable))
+			if err != nil {
+				return err
+			}
+			for _, line := range resp {
+				if values := nutQuotedValues(line); strings.HasPrefix(line, "ENUM ") && len(values) == 1 {
+					enumValues = append(enumValues, values[0])
+				}
+			}
+		}
+		var ranges [][2]float64
+		if varType.Writable && varType.Range {
+			resp, err = client.SendCommand(fmt.Sprintf("LIST RANGE %s %s", upsName, variable))
+			if err != nil {
+				return err
+			}
+			for _, line := range resp {
+				if values := nutQuotedValues(line); strings.HasPrefix(line, "RANGE ") && len(values) == 2 {
+					low, lowErr := strconv.ParseFloat(values[0], 64)
+					high, highErr := strconv.ParseFloat(values[1], 64)
+					if lowErr == nil && highErr == nil {
+						ranges = append(ranges, [2]float64{low, high})
+					}
+				}
+			}
+		}
+
+		if err := ValidateNUTVariableValue(varType, value, enumValues, ranges); err != nil {
+			return err
+		}
+
+		// Write the variable, escaping the value the same way upsd expects it.
+		escapedValue := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value)
+		if _, err := client.SendCommand(fmt.Sprintf(`SET VAR %s %s "%s"`, upsName, variable, escapedValue)); err != nil {
+			return err
+		}
+
+		// Read the variable back, although drivers may take a moment to apply the new value.
+		resp, err = client.SendCommand(fmt.Sprintf("GET VAR %s %s", upsName, variable))
+		if err != nil {
+			return err
+		}
+		if values := nutQuotedValues(resp[0]); len(values) == 1 {
+			newValue = strings.TrimSpace(values[0])
+		}
+		return nil
+	})
+	return newValue, err
+}
+
+// NUTListItem is a name and its value from a LIST response, eg. a UPS device and its description,
+// or a variable and its value, exactly as the NUT server sent them.
+type NUTListItem struct {
+	Name  string
+	Value string
+}
+
+// Send a LIST command to the NUT server, and get the items of the response that start with the given type, eg. "VAR".
+func (server *NUTServer) list(command string, itemType string) ([]NUTListItem, error) {
+	var items []NUTListItem
+	err := server.Do(func(client *NUTClient) error {
+		resp, err := client.SendCommand(command)
+		if err != nil {
+			return err
+		}
+		for _, line := range resp {
+			// Items look like `<type> [<ups>] <name> "<value>"`, eg. `VAR FakeUPS battery.charge "100"`.
+			quote := strings.Index(line, `"`)
+			if quote < 0 {
+				continue
+			}
+			fields, values := strings.Fields(line[:quote]), nutQuotedValues(line)
+			if len(fields) < 2 || fields[0] != itemType || len(values) == 0 {
+				continue
+			}
+			items = append(items, NUTListItem{Name: fields[len(fields)-1], Value: values[0]})
+		}
+		return nil
+	})
+	return items, err
+}
+
+// Get the names and descriptions of the monitored UPS devices, without querying every variable like GetUPSList.
+func (server *NUTServer) ListUPS() ([]NUTListItem, error) {
+	items, err := server.list("LIST UPS", "UPS")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list UPS devices on NUT server %s: %w", server.Config.Name, err)
+	}
+	filteredItems := []NUTListItem{}
+	for _, item := range items {
+		if server.IsUPSAllowed(item.Name) {
+			filteredItems = append(filteredItems, item)
+		}
+	}
+	return filteredItems, nil
+}
+
+// Get the variables of a UPS device with their raw values, in the order the NUT server sends them.
+func (server *NUTServer) ListVariables(upsName string) ([]NUTListItem, error) {
+	items, err := server.list(fmt.Sprintf("LIST VAR %s", upsName), "VAR")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list variables of UPS device %s on NUT server %s: %w", upsName, server.Config.Name, err)
+	}
+	return items, nil
+}
+
+// Get all monitored UPS devices from the NUT server.
+func (server *NUTServer) GetUPSList() ([]nut.UPS, error) {
+	// Get a list of all available UPS devices.
+	log.Debug("Getting a list of all UPS devices from ", server.Config.Name, " ...")
+	var upsList []nut.UPS
+	err := server.Do(func(client *NUTClient) error {
+		var listErr error
+		upsList, listErr = client.GetUPSList()
+		return listErr
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a list of UPS devices from NUT server %s: %w", server.Config.Name, err)
+	}
+
+	// Filter out the UPS devices we're not interested in.
+	filteredUPSList := []nut.UPS{}
+	for _, ups := range upsList {
+		if !server.IsUPSAllowed(ups.Name) {
+			log.Debug("Skipping UPS device ", ups.Name, " on ", server.Config.Name, " ...")
+			continue
+		}
+		filteredUPSList = append(filteredUPSList, ups)
+	}
+
+	return filteredUPSList, nil
+}
+
+// Close the NUT client and stop reconnecting.
+func (server *NUTServer) Close() error {
+	server.stopOnce.Do(func() { close(server.stop) })
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if server.client == nil {
+		log.Debug("No NUT client to disconnect from for ", server.Config.Name, ", skipping ...")
+		return nil
+	}
+	log.Debug("Disconnecting from NUT server ", server.Config.Name, " ...")
+	client := server.client
+	server.client = nil
+	return client.Disconnect()
+}
+
+// Close the clients of all NUT servers.
+func CloseNUT() error {
+	var closeErr error
+	for _, server := range nutServers {
+		if err := server.Close(); err != nil {
+			closeErr = fmt.Errorf("failed to disconnect from NUT server %s: %w", server.Config.Name, err)
+		}
+	}
+	return closeErr
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsUPSAllowed(t *testing.T) {
+	tests := []struct {
+		include []string
+		exclude []string
+		name    string
+		allowed bool
+	}{
+		{nil, nil, "rack1", true},
+		{[]string{"rack1", "rack2"}, nil, "rack1", true},
+		{[]string{"rack1", "rack2"}, nil, "nas", false},
+		{nil, []string{"testups"}, "testups", false},
+		{nil, []string{"testups"}, "nas", true},
+		{[]string{"rack1"}, []string{"rack1"}, "rack1", false},
+	}
+	for _, test := range tests {
+		server := NewNUTServer(NUTServerConfig{Host: "localhost", Port: 3493, UPSInclude: test.include, UPSExclude: test.exclude})
+		if allowed := server.IsUPSAllowed(test.name); allowed != test.allowed {
+			t.Errorf("IsUPSAllowed(%q) with include %v and exclude %v = %v, want %v", test.name, test.include, test.exclude, allowed, test.allowed)
+		}
+	}
+}
+
+func TestUPSTopic(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		template string
+		topic    string
+	}{
+		{"", "", "nuttyqt/rack1"},
+		{"site-a", "", "nuttyqt/site-a/rack1"},
+		{"/site-a/", "", "nuttyqt/site-a/rack1"},
+		{"site-a", "{{.Topic}}/{{.Prefix}}/{{.UPS}}", "nuttyqt/site-a/rack1"},
+		{"", "{{.Topic}}/{{.Prefix}}/{{.UPS}}", ""},
+		{"", `{{.Topic}}/{{if eq .UPS "rack1"}}{{else}}ups{{end}}/{{.UPS}}`, ""},
+	}
+	for _, test := range tests {
+		server := NewNUTServer(NUTServerConfig{Host: "localhost", Port: 3493, TopicPrefix: test.prefix, TopicTemplate: test.template})
+		if topic, err := server.UPSTopic("rack1"); topic != test.topic || (err != nil) != (test.topic == "") {
+			t.Errorf("UPSTopic(%q) with prefix %q and template %q = %q, %v, want %q", "rack1", test.prefix, test.template, topic, err, test.topic)
+		}
+	}
+}
+
+func TestUPSTopicReserved(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		template string
+		ups      string
+		topic    string
+	}{
+		{"", "", "status", ""},
+		{"", "", "schema", ""},
+		{"", "", "nut", ""},
+		{"", "", "statuses", "nuttyqt/statuses"},
+		{"site-a", "", "status", "nuttyqt/site-a/status"},
+		{"", "{{.Topic}}/{{.UPS}}/state", "nut", ""},
+		{"", "{{.Topic}}/ups/{{.UPS}}", "status", "nuttyqt/ups/status"},
+	}
+	for _, test := range tests {
+		server := NewNUTServer(NUTServerConfig{Host: "localhost", Port: 3493, TopicPrefix: test.prefix, TopicTemplate: test.template})
+		if topic, err := server.UPSTopic(test.ups); topic != test.topic || (err != nil) != (test.topic == "") {
+			t.Errorf("UPSTopic(%q) with prefix %q and template %q = %q, %v, want %q", test.ups, test.prefix, test.template, topic, err, test.topic)
+		}
+	}
+}
+
+func TestNUTReconnectDelay(t *testing.T) {
+	defer SetConfig(*CurrentConfig())
+	config := *CurrentConfig()
+	config.NUTReconnectMinDelay, config.NUTReconnectMaxDelay = 1, 60
+	SetConfig(config)
+
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 1 * time.Second},
+		{1, 2 * time.Second},
+		{3, 8 * time.Second},
+		{10, 60 * time.Second},
+		{100, 60 * time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 10; i++ {
+			if delay := NUTReconnectDelay(test.attempt); delay < test.max/2 || delay > test.max {
+				t.Errorf("NUTReconnectDelay(%d) = %s, want between %s and %s", test.attempt, delay, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestIsCommandAllowed(t *testing.T) {
+	commands := map[string][]string{
+		"rack1": {"beeper.disable", "test.battery.start.quick"},
+		"*":     {"beeper.mute"},
+	}
+	tests := []struct {
+		ups     string
+		command string
+		allowed bool
+	}{
+		{"rack1", "beeper.disable", true},
+		{"rack1", "beeper.mute", true},
+		{"rack1", "load.off", false},
+		{"rack2", "beeper.mute", true},
+		{"rack2", "beeper.disable", false},
+	}
+	for _, test := range tests {
+		server := NewNUTServer(NUTServerConfig{Host: "localhost", Port: 3493, UPSCommands: commands})
+		if allowed := server.IsCommandAllowed(test.ups, test.command); allowed != test.allowed {
+			t.Errorf("IsCommandAllowed(%q, %q) = %v, want %v", test.ups, test.command, allowed, test.allowed)
+		}
+	}
+}
+
+func TestValidateNUTVariableValue(t *testing.T) {
+	tests := []struct {
+		types  []string
+		value  string
+		enum   []string
+		ranges [][2]float64
+		code   string
+	}{
+		{[]string{"NUMBER"}, "20", nil, nil, "READONLY"},
+		{[]string{"RW", "NUMBER"}, "20", nil, nil, ""},
+		{[]string{"RW", "NUMBER"}, "twenty", nil, nil, "INVALID-VALUE"},
+		{[]string{"RW", "STRING:4"}, "abcd", nil, nil, ""},
+		{[]string{"RW", "STRING:4"}, "abcde", nil, nil, "TOO-LONG"},
+		{[]string{"RW", "STRING:32"}, "a\nb", nil, nil, "INVALID-VALUE"},
+		{[]string{"RW", "ENUM"}, "low", []string{"normal", "low"}, nil, ""},
+		{[]string{"RW", "ENUM"}, "high", []string{"normal", "low"}, nil, "INVALID-VALUE"},
+		{[]string{"RW", "RANGE"}, "600", nil, [][2]float64{{0, 600}}, ""},
+		{[]string{"RW", "RANGE"}, "900", nil, [][2]float64{{0, 600}}, "INVALID-VALUE"},
+	}
+	for _, test := range tests {
+		code := ""
+		if err := ValidateNUTVariableValue(ParseNUTVariableType(test.types), test.value, test.enum, test.ranges); err != nil {
+			code = NUTErrorCode(err)
+		}
+		if code != test.code {
+			t.Errorf("ValidateNUTVariableValue(%v, %q) = %q, want %q", test.types, test.value, code, test.code)
+		}
+	}
+}
+
+func TestNUTQuotedValues(t *testing.T) {
+	tests := []struct {
+		line   string
+		values []string
+	}{
+		{`VAR ups battery.charge "100"`, []string{"100"}},
+		{`RANGE ups ups.delay.shutdown "0" "600"`, []string{"0", "600"}},
+		{`VAR ups ups.id "say \"hi\" \\o/"`, []string{`say "hi" \o/`}},
+		{`TYPE ups battery.charge NUMBER`, []string{}},
+	}
+	for _, test := range tests {
+		if values := nutQuotedValues(test.line); fmt.Sprint(values) != fmt.Sprint(test.values) {
+			t.Errorf("nutQuotedValues(%q) = %q, want %q", test.line, values, test.values)
+		}
+	}
+}
+
+// Start a NUT server on a free port that answers each command with its response in the map, or not at all, and return the port.
+func startTestNUTStub(t *testing.T, responses map[string]string) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					command, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if response, ok := responses[strings.TrimSpace(command)]; ok {
+						fmt.Fprintln(conn, response)
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestNUTServerListError(t *testing.T) {
+	port := startTestNUTStub(t, map[string]string{
+		"LIST UPS":       "BEGIN LIST UPS\nUPS rack1 \"Rack 1\"\nEND LIST UPS",
+		"LIST VAR rack1": "ERR DATA-STALE",
+		"LOGOUT":         "OK Goodbye",
+	})
+	server := NewNUTServer(NUTServerConfig{Host: "127.0.0.1", Port: port})
+	defer server.Close()
+
+	// The error is returned instead of waiting for the end of the list, and the connection stays usable.
+	if _, err := server.ListVariables("rack1"); NUTErrorCode(err) != "DATA-STALE" {
+		t.Errorf("ListVariables(rack1) error = %v, want DATA-STALE", err)
+	}
+	if upsList, err := server.ListUPS(); err != nil || len(upsList) != 1 || upsList[0].Name != "rack1" {
+		t.Errorf("ListUPS() after an error = %v, %v, want rack1", upsList, err)
+	}
+}
+
+func TestNUTServerTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { nutTimeout = timeout }(nutTimeout)
+	nutTimeout = 100 * time.Millisecond
+
+	port := startTestNUTStub(t, map[string]string{})
+	server := NewNUTServer(NUTServerConfig{Host: "127.0.0.1", Port: port})
+	defer server.Close()
+
+	// A NUT server that doesn't answer breaks the connection, which is reconnected in the background.
+	started := time.Now()
+	if _, err := server.ListVariables("rack1"); NUTErrorCode(err) != "CONNECTION-FAILED" {
+		t.Errorf("ListVariables(rack1) error = %v, want CONNECTION-FAILED", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("ListVariables(rack1) took %s, want it to time out after %s", elapsed, nutTimeout)
+	}
+	if _, err := server.ListUPS(); !errors.Is(err, ErrNUTServerUnreachable) {
+		t.Errorf("ListUPS() after a timeout error = %v, want %v", err, ErrNUTServerUnreachable)
+	}
+}
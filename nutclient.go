@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+// Timeout for connecting to a NUT server, negotiating TLS and every command.
+var nutTimeout = 10 * time.Second
+
+// NUTClient speaks the NUT network protocol over a single connection to a NUT server.
+// Unlike the client of go.nut, every command has a deadline, so a stuck NUT server can't block the bridge,
+// and an error response to a LIST command is returned instead of waiting for the end of the list forever.
+type NUTClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NUTError is an error response of a NUT server, eg. "ERR DATA-STALE".
+type NUTError struct {
+	Code string
+}
+
+func (err *NUTError) Error() string {
+	if description, ok := nutErrorDescriptions[err.Code]; ok {
+		return description
+	}
+	return fmt.Sprintf("NUT server responded with error %s", err.Code)
+}
+
+// Values of NUT variables that the client of go.nut converts to numbers.
+var nutNumberPattern = regexp.MustCompile(`^-?[0-9\.]+$`)
+
+// Create a NUT client on a connection to a NUT server, eg. a TLS connection after STARTTLS.
+func NewNUTClient(conn net.Conn) *NUTClient {
+	return &NUTClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// Connect to a NUT server over plain TCP.
+func DialNUT(host string, port int) (*NUTClient, error) {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), nutTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return NewNUTClient(conn), nil
+}
+
+// Send a command to the NUT server and return the lines of its response,
+// which includes the BEGIN and END lines of a LIST command.
+func (client *NUTClient) SendCommand(command string) ([]string, error) {
+	if err := client.conn.SetDeadline(time.Now().Add(nutTimeout)); err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(client.conn, "%s\n", command); err != nil {
+		return nil, err
+	}
+
+	isList := strings.HasPrefix(command, "LIST ")
+	response := []string{}
+	for {
+		line, err := client.reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("error reading response: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "ERR" {
+			return nil, &NUTError{Code: fields[1]}
+		}
+		response = append(response, line)
+		if !isList || line == "END "+command {
+			return response, nil
+		}
+	}
+}
+
+// Authenticate the connection with a username and password.
+func (client *NUTClient) Authenticate(username string, password string) error {
+	if _, err := client.SendCommand(fmt.Sprintf("USERNAME %s", username)); err != nil {
+		return err
+	}
+	_, err := client.SendCommand(fmt.Sprintf("PASSWORD %s", password))
+	return err
+}
+
+// Log out from the NUT server and close the connection.
+func (client *NUTClient) Disconnect() error {
+	_, logoutErr := client.SendCommand("LOGOUT")
+	if err := client.Close(); err != nil {
+		return err
+	}
+	return logoutErr
+}
+
+// Close the connection without logging out, eg. when it's broken.
+func (client *NUTClient) Close() error {
+	return client.conn.Close()
+}
+
+// Get all UPS devices of the NUT server with their variables and instant commands.
+func (client *NUTClient) GetUPSList() ([]nut.UPS, error) {
+	resp, err := client.SendCommand("LIST UPS")
+	if err != nil {
+		return nil, err
+	}
+	upsList := []nut.UPS{}
+	for _, line := range resp {
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "UPS" {
+			ups, err := client.GetUPS(fields[1])
+			if err != nil {
+				return upsList, err
+			}
+			upsList = append(upsList, ups)
+		}
+	}
+	return upsList, nil
+}
+
+// Get a UPS device with its variables and instant commands, the same way as the client of go.nut.
+func (client *NUTClient) GetUPS(name string) (nut.UPS, error) {
+	ups := nut.UPS{Name: name, Clients: []string{}, Commands: []nut.Command{}, Variables: []nut.Variable{}}
+
+	// Get the clients that are logged in to the UPS device, eg. "CLIENT <ups> 127.0.0.1".
+	resp, err := client.SendCommand(fmt.Sprintf("LIST CLIENT %s", name))
+	if err != nil {
+		return ups, err
+	}
+	for _, line := range resp {
+		if fields := strings.Fields(line); len(fields) > 2 && fields[0] == "CLIENT" {
+			ups.Clients = append(ups.Clients, fields[2])
+		}
+	}
+
+	// Get the instant commands with their descriptions, eg. "CMD <ups> beeper.disable".
+	resp, err = client.SendCommand(fmt.Sprintf("LIST CMD %s", name))
+	if err != nil {
+		return ups, err
+	}
+	for _, line := range resp {
+		if fields := strings.Fields(line); len(fields) > 2 && fields[0] == "CMD" {
+			description, err := client.getQuoted(fmt.Sprintf("GET CMDDESC %s %s", name, fields[2]))
+			if err != nil {
+				return ups, err
+			}
+			ups.Commands = append(ups.Commands, nut.Command{Name: fields[2], Description: description})
+		}
+	}
+
+	// Get the description and the number of logins, eg. `UPSDESC <ups> "Rack 1"` and "NUMLOGINS <ups> 1".
+	if ups.Description, err = client.getQuoted(fmt.Sprintf("GET UPSDESC %s", name)); err != nil {
+		return ups, err
+	}
+	resp, err = client.SendCommand(fmt.Sprintf("GET NUMLOGINS %s", name))
+	if err != nil {
+		return ups, err
+	}
+	if fields := strings.Fields(resp[0]); len(fields) > 0 {
+		if ups.NumberOfLogins, err = strconv.Atoi(fields[len(fields)-1]); err != nil {
+			return ups, err
+		}
+	}
+
+	// Get the variables with their descriptions and types, eg. `VAR <ups> battery.charge "100"`.
+	resp, err = client.SendCommand(fmt.Sprintf("LIST VAR %s", name))
+	if err != nil {
+		return ups, err
+	}
+	for _, line := range resp {
+		fields, values := strings.Fields(line), nutQuotedValues(line)
+		if len(fields) < 3 || fields[0] != "VAR" || len(values) == 0 {
+			continue
+		}
+		description, err := client.getQuoted(fmt.Sprintf("GET DESC %s %s", name, fields[2]))
+		if err != nil {
+			return ups, err
+		}
+		typeResp, err := client.SendCommand(fmt.Sprintf("GET TYPE %s %s", name, fields[2]))
+		if err != nil {
+			return ups, err
+		}
+		types := strings.Fields(strings.TrimPrefix(typeResp[0], fmt.Sprintf("TYPE %s %s", name, fields[2])))
+		ups.Variables = append(ups.Variables, newNUTVariable(fields[2], strings.Trim(values[0], " "), description, types))
+	}
+	return ups, nil
+}
+
+// Send a GET command and return the first quoted value of the response, eg. the description of a variable.
+func (client *NUTClient) getQuoted(command string) (string, error) {
+	resp, err := client.SendCommand(command)
+	if err != nil {
+		return "", err
+	}
+	if values := nutQuotedValues(resp[0]); len(values) > 0 {
+		return values[0], nil
+	}
+	return "", nil
+}
+
+// Create a variable from its raw value and its types from GET TYPE, eg. ["RW", "STRING:32"],
+// converting the value the same way as the client of go.nut, eg. "100" to the integer 100.
+// Identifiers keep their raw value, so eg. the serial number "000000000000" doesn't turn into 0.
+func newNUTVariable(name string, value string, description string, types []string) nut.Variable {
+	variable := nut.Variable{Name: name, Value: value, Description: description, Type: "UNKNOWN"}
+	if len(types) > 0 && types[0] == "RW" {
+		variable.Writeable, types = true, types[1:]
+	}
+	if len(types) > 0 {
+		variable.Type = types[0]
+		if strings.HasPrefix(variable.Type, "STRING:") {
+			variable.MaximumLength, _ = strconv.Atoi(strings.TrimPrefix(variable.Type, "STRING:"))
+			variable.Type = "STRING"
+		}
+	}
+	varType := variable.Type
+
+	if isNUTIdentifier(name) {
+		variable.Type, variable.OriginalType = "STRING", varType
+		return variable
+	}
+	switch value {
+	case "enabled":
+		variable.Value, variable.Type = true, "BOOLEAN"
+	case "disabled":
+		variable.Value, variable.Type = false, "BOOLEAN"
+	}
+	if !nutNumberPattern.MatchString(value) {
+		variable.Type, variable.OriginalType = "STRING", varType
+	} else if strings.Count(value, ".") == 1 {
+		if number, err := strconv.ParseFloat(value, 64); err == nil {
+			variable.Value, variable.Type, variable.OriginalType = number, "FLOAT_64", varType
+		}
+	} else if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		variable.Value, variable.Type, variable.OriginalType = number, "INTEGER", varType
+	}
+	return variable
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+// Version of the UPS payload schema, increased on breaking changes.
+const UPSPayloadSchemaVersion = 1
+
+// JSON Schema of the UPS payload, for downstream consumers to validate against.
+//
+//go:embed schemas/ups-payload.schema.json
+var UPSPayloadSchema []byte
+
+// UPSPayload is the state of a single UPS device, as published to the MQTT broker.
+// It is independent of the NUT client library, so it only changes together with UPSPayloadSchemaVersion.
+type UPSPayload struct {
+	// Version of the payload schema.
+	SchemaVersion int `json:"schema_version"`
+
+	// Time the UPS device was polled.
+	Timestamp time.Time `json:"timestamp"`
+
+	// Name of the NUT server the UPS device belongs to.
+	Server string `json:"server"`
+
+	// Name of the UPS device.
+	UPS string `json:"ups"`
+
+	// Description of the UPS device.
+	Description string `json:"description,omitempty"`
+
+	// Decoded "ups.status" variable, if the UPS device has one.
+	Status *UPSStatus `json:"status,omitempty"`
+
+	// Decoded "ups.alarm" variable, if the UPS device has any alarms.
+	Alarms []string `json:"alarms,omitempty"`
+
+	// UPS variables by name, eg. "battery.charge": 100.
+	Variables map[string]interface{} `json:"variables"`
+}
+
+// Create the payload for a UPS device of a NUT server.
+func NewUPSPayload(server *NUTServer, ups nut.UPS, timestamp time.Time) UPSPayload {
+	payload := UPSPayload{
+		SchemaVersion: UPSPayloadSchemaVersion,
+		Timestamp:     timestamp.UTC(),
+		Server:        server.Config.Name,
+		UPS:           ups.Name,
+		Description:   ups.Description,
+		Variables:     map[string]interface{}{},
+	}
+	for _, variable := range ups.Variables {
+		// Identifiers are always strings, so eg. the product ID "0601" isn't published as the number 601.
+		if _, ok := variable.Value.(string); ok || isNUTIdentifier(variable.Name) {
+			payload.Variables[variable.Name] = NUTVariableString(variable)
+		} else {
+			payload.Variables[variable.Name] = variable.Value
+		}
+
+		switch variable.Name {
+		case "ups.status":
+			status := DecodeUPSStatus(fmt.Sprint(variable.Value))
+			payload.Status = &status
+		case "ups.alarm":
+			if alarms := DecodeUPSAlarms(fmt.Sprint(variable.Value)); len(alarms) > 0 {
+				payload.Alarms = alarms
+			}
+		}
+	}
+	return payload
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+func TestNewUPSPayload(t *testing.T) {
+	server := NewNUTServer(NUTServerConfig{Name: "site-a", Host: "localhost", Port: 3493})
+	ups := nut.UPS{
+		Name:        "rack1",
+		Description: "Rack 1",
+		Variables: []nut.Variable{
+			{Name: "battery.charge", Value: int64(100)},
+			{Name: "input.voltage", Value: 232.6},
+			{Name: "ups.beeper.status", Value: false},
+			{Name: "ups.status", Value: "OL CHRG TEST "},
+			{Name: "ups.alarm", Value: "Replace battery! Overload!"},
+		},
+	}
+	timestamp := time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	payloadJSON, err := json.Marshal(NewUPSPayload(server, ups, timestamp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"schema_version":1,"timestamp":"2023-01-02T03:04:05Z","server":"site-a","ups":"rack1","description":"Rack 1",` +
+		`"status":{"online":true,"on_battery":false,"low_battery":false,"high_battery":false,"charging":true,"discharging":false,` +
+		`"replace_battery":false,"overloaded":false,"bypass":false,"boost":false,"trim":false,"off":false,"calibrating":false,` +
+		`"forced_shutdown":false,"unknown":["TEST"]},"alarms":["Replace battery!","Overload!"],` +
+		`"variables":{"battery.charge":100,"input.voltage":232.6,"ups.alarm":"Replace battery! Overload!","ups.beeper.status":false,"ups.status":"OL CHRG TEST"}}`
+	if string(payloadJSON) != want {
+		t.Errorf("payload = %s, want %s", payloadJSON, want)
+	}
+}
+
+func TestNewUPSPayloadIdentifiers(t *testing.T) {
+	ups := nut.UPS{
+		Name: "rack1",
+		Variables: []nut.Variable{
+			newNUTVariable("ups.serial", "000000000000", "UPS serial number", []string{"STRING:12"}),
+			newNUTVariable("ups.productid", "0601", "Product ID for USB devices", []string{"STRING:4"}),
+			newNUTVariable("battery.charge", "100", "Battery charge (percent of full)", []string{"NUMBER"}),
+			{Name: "device.model", Value: int64(1500)},
+		},
+	}
+
+	// Identifiers stay strings as the NUT server sent them, while measurements are numbers.
+	payloadJSON, err := json.Marshal(NewUPSPayload(NewNUTServer(NUTServerConfig{}), ups, time.Now()).Variables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"battery.charge":100,"device.model":"1500","ups.productid":"0601","ups.serial":"000000000000"}`
+	if string(payloadJSON) != want {
+		t.Errorf("payload variables = %s, want %s", payloadJSON, want)
+	}
+}
+
+func TestUPSPayloadSchema(t *testing.T) {
+	var schema struct {
+		Required   []string                   `json:"required"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	if err := json.Unmarshal(UPSPayloadSchema, &schema); err != nil {
+		t.Fatal("invalid payload schema: ", err)
+	}
+
+	// Every field of the payload should be described by the schema.
+	var payload map[string]interface{}
+	ups := nut.UPS{
+		Description: "UPS",
+		Variables: []nut.Variable{
+			{Name: "ups.status", Value: "OB LB"},
+			{Name: "ups.alarm", Value: "Replace battery!"},
+		},
+	}
+	payloadJSON, _ := json.Marshal(NewUPSPayload(NewNUTServer(NUTServerConfig{}), ups, time.Now()))
+	_ = json.Unmarshal(payloadJSON, &payload)
+	for field := range payload {
+		if _, ok := schema.Properties[field]; !ok {
+			t.Errorf("payload field %q is missing from the schema", field)
+		}
+	}
+	for _, field := range schema.Required {
+		if _, ok := payload[field]; !ok {
+			t.Errorf("required schema field %q is missing from the payload", field)
+		}
+	}
+
+	// Every identifier should be a string in the schema.
+	var variables struct {
+		PatternProperties map[string]json.RawMessage `json:"patternProperties"`
+	}
+	_ = json.Unmarshal(schema.Properties["variables"], &variables)
+	for component := range nutIdentifierComponents {
+		matched := false
+		for pattern := range variables.PatternProperties {
+			matched = matched || regexp.MustCompile(pattern).MatchString("ups."+component)
+		}
+		if !matched {
+			t.Errorf("identifier %q isn't a string in the schema", "ups."+component)
+		}
+	}
+}
+
+func TestDecodeUPSAlarms(t *testing.T) {
+	tests := []struct {
+		alarm  string
+		alarms []string
+	}{
+		{"", []string{}},
+		{"Replace battery!", []string{"Replace battery!"}},
+		{"Replace battery! Shutdown imminent!", []string{"Replace battery!", "Shutdown imminent!"}},
+		{"[Replace battery!] [Fan failure]", []string{"Replace battery!", "Fan failure"}},
+		{"Temperature too high", []string{"Temperature too high"}},
+	}
+	for _, test := range tests {
+		if alarms := DecodeUPSAlarms(test.alarm); fmt.Sprintf("%q", alarms) != fmt.Sprintf("%q", test.alarms) {
+			t.Errorf("DecodeUPSAlarms(%q) = %q, want %q", test.alarm, alarms, test.alarms)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Reload the configuration from the config file, environment variables and flags, and apply the differences
+// without restarting, eg. added or removed NUT servers, sinks, the update interval and the log level.
+// The current configuration is kept if the new one is invalid.
+func ReloadConfig(flags *ConfigFlags) bool {
+	path := ""
+	if flags != nil {
+		path = flags.ConfigPath
+	}
+	log.Info("Reloading configuration ...")
+
+	// The new configuration is loaded and checked on its own, and only replaces the current one once it's complete,
+	// as the update loop, the MQTT handlers and the reconnects read the current configuration concurrently.
+	previous := CurrentConfig()
+	config, err := LoadConfig(path, flags)
+	if err != nil {
+		var configErrs ConfigErrors
+		if errors.As(err, &configErrs) {
+			for _, configErr := range configErrs {
+				log.Error(configErr)
+			}
+		} else {
+			log.Error(err)
+		}
+		log.Warn("Invalid configuration, keeping the current configuration ...")
+		return false
+	}
+
+	// The MQTT connection can't be changed without dropping the MQTT session, so those settings are kept until a restart.
+	if config.MQTTBrokerProtocol != previous.MQTTBrokerProtocol || config.MQTTBrokerHost != previous.MQTTBrokerHost ||
+		config.MQTTBrokerPort != previous.MQTTBrokerPort || config.MQTTClient != previous.MQTTClient || config.MQTTTopic != previous.MQTTTopic ||
+		config.MQTTUser != previous.MQTTUser || config.MQTTPass != previous.MQTTPass || config.MQTTTLSServerName != previous.MQTTTLSServerName ||
+		config.MQTTTLSMinVersion != previous.MQTTTLSMinVersion || config.MQTTTLSInsecure != previous.MQTTTLSInsecure {
+		log.Warn("Changing the MQTT broker, client, topic, credentials or TLS settings requires a restart, keeping the current values ...")
+		config.MQTTBrokerProtocol, config.MQTTBrokerHost, config.MQTTBrokerPort = previous.MQTTBrokerProtocol, previous.MQTTBrokerHost, previous.MQTTBrokerPort
+		config.MQTTClient, config.MQTTTopic = previous.MQTTClient, previous.MQTTTopic
+		config.MQTTUser, config.MQTTPass = previous.MQTTUser, previous.MQTTPass
+		config.MQTTTLSServerName, config.MQTTTLSMinVersion, config.MQTTTLSInsecure = previous.MQTTTLSServerName, previous.MQTTTLSMinVersion, previous.MQTTTLSInsecure
+	}
+	if config.NUTFake != previous.NUTFake || config.NUTFakeRate != previous.NUTFakeRate || config.NUTFakeScenario != previous.NUTFakeScenario ||
+		config.NUTFakeDumps != previous.NUTFakeDumps {
+		log.Warn("Changing nut.fake, nut.fake_rate, nut.fake_scenario or nut.fake_dumps requires a restart, keeping the current values ...")
+		config.NUTFake, config.NUTFakeRate = previous.NUTFake, previous.NUTFakeRate
+		config.NUTFakeScenario, config.NUTFakeDumps = previous.NUTFakeScenario, previous.NUTFakeDumps
+	}
+
+	// Sinks that are enabled, disabled or changed are started before the new configuration is applied,
+	// so the current sink and its settings are kept if the new one fails to start, eg. as the metrics address is in use.
+	influxDBChanged := config.InfluxDBURL != previous.InfluxDBURL || config.InfluxDBDatabase != previous.InfluxDBDatabase ||
+		config.InfluxDBUser != previous.InfluxDBUser || config.InfluxDBPass != previous.InfluxDBPass || config.InfluxDBOrg != previous.InfluxDBOrg ||
+		config.InfluxDBBucket != previous.InfluxDBBucket || config.InfluxDBToken != previous.InfluxDBToken ||
+		config.InfluxDBMeasurement != previous.InfluxDBMeasurement || config.InfluxDBBatchSize != previous.InfluxDBBatchSize ||
+		config.InfluxDBBufferSize != previous.InfluxDBBufferSize
+	var influxDBRunner *SinkRunner
+	if influxDBChanged && config.InfluxDBURL != "" {
+		if sink, err := NewInfluxDBSink(config); err != nil {
+			log.Error("Failed to start the InfluxDB sink, keeping the current InfluxDB settings: ", err)
+			config.InfluxDBURL, config.InfluxDBDatabase, config.InfluxDBUser, config.InfluxDBPass = previous.InfluxDBURL, previous.InfluxDBDatabase, previous.InfluxDBUser, previous.InfluxDBPass
+			config.InfluxDBOrg, config.InfluxDBBucket, config.InfluxDBToken = previous.InfluxDBOrg, previous.InfluxDBBucket, previous.InfluxDBToken
+			config.InfluxDBMeasurement, config.InfluxDBBatchSize, config.InfluxDBBufferSize = previous.InfluxDBMeasurement, previous.InfluxDBBatchSize, previous.InfluxDBBufferSize
+			influxDBChanged = false
+		} else {
+			influxDBRunner = NewSinkRunner(sink)
+		}
+	}
+	metricsChanged := config.MetricsListen != previous.MetricsListen
+	var metricsRunner *SinkRunner
+	if metricsChanged && config.MetricsListen != "" {
+		if sink, err := NewMetricsSink(config.MetricsListen); err != nil {
+			log.Error("Failed to start the metrics sink, keeping the current metrics.listen: ", err)
+			config.MetricsListen, metricsChanged = previous.MetricsListen, false
+		} else {
+			metricsRunner = NewSinkRunner(sink)
+		}
+	}
+
+	SetConfig(config)
+
+	// Certificates, which may have been rotated even if their paths haven't changed.
+	if IsMQTTTLSProtocol(config.MQTTBrokerProtocol) {
+		if err := LoadMQTTTLSFiles(); err != nil {
+			log.Warn("Failed to reload the MQTT certificates, keeping the current certificates: ", err)
+		} else {
+			log.Info("Reloaded the MQTT certificates, which are used from the next reconnect onwards")
+		}
+	}
+
+	// Log level
+	if config.Verbose {
+		log.SetLevel(logrus.DebugLevel)
+	} else {
+		log.SetLevel(logrus.InfoLevel)
+	}
+
+	// Replace the changed sinks, after writing what is still queued for the current ones.
+	ctx, cancel := context.WithTimeout(context.Background(), sinkCloseTimeout)
+	defer cancel()
+	if influxDBChanged {
+		ReplaceSink(ctx, "influxdb", influxDBRunner)
+	}
+	if metricsChanged {
+		ReplaceSink(ctx, "metrics", metricsRunner)
+	}
+
+	// Home Assistant discovery configs are published again by the next update, so changing the prefix moves them.
+	haChanged := config.HADiscovery != previous.HADiscovery || config.HADiscoveryPrefix != previous.HADiscoveryPrefix
+
+	// Keep the NUT servers that haven't changed, along with their connections, and replace the rest.
+	previousServers := nutServers
+	previousCommandFilters, previousVariableFilters := upsCommandTopicFilters("cmd"), upsCommandTopicFilters("set")
+	kept, added := map[*NUTServer]bool{}, map[string]bool{}
+	servers := []*NUTServer{}
+	for _, serverConfig := range config.NUTServers {
+		server := NewNUTServer(serverConfig)
+		for _, previousServer := range previousServers {
+			if !kept[previousServer] && reflect.DeepEqual(previousServer.Config, server.Config) {
+				server = previousServer
+				kept[server] = true
+				break
+			}
+		}
+		if !kept[server] {
+			added[server.Config.Name] = true
+		}
+		servers = append(servers, server)
+	}
+
+	upsDevicesMutex.Lock()
+	nutServers = servers
+	for _, server := range previousServers {
+		if !kept[server] {
+			delete(upsDevices, server)
+		}
+	}
+	upsDevicesMutex.Unlock()
+
+	for _, server := range previousServers {
+		if kept[server] && !haChanged {
+			continue
+		}
+		RemoveHomeAssistantDiscovery(server)
+		if kept[server] {
+			continue
+		}
+		RemoveNUTServerMetrics(server)
+		if added[server.Config.Name] {
+			log.Info("Updating NUT server ", server.Config.Name, " ...")
+			delete(added, server.Config.Name)
+		} else {
+			log.Info("Removing NUT server ", server.Config.Name, " ...")
+		}
+		if err := server.Close(); err != nil {
+			log.Warn("Failed to close NUT connection: ", err)
+		}
+	}
+
+	for name := range added {
+		log.Info("Adding NUT server ", name, " ...")
+	}
+
+	// Move the command subscriptions to the topics of the new NUT servers.
+	if mqttClient != nil && mqttClient.IsConnectionOpen() {
+		unsubscribeUPSCommands(mqttClient, previousCommandFilters, upsCommandTopicFilters("cmd"))
+		unsubscribeUPSCommands(mqttClient, previousVariableFilters, upsCommandTopicFilters("set"))
+		SubscribeUPSCommands(mqttClient)
+	}
+
+	log.Info("Configuration reloaded")
+	return true
+}
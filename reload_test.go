@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	defer func(original *Config, originalServers []*NUTServer) {
+		SetConfig(*original)
+		nutServers = originalServers
+	}(CurrentConfig(), nutServers)
+
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	writeConfig := func(text string) {
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig(`
+nut:
+  servers:
+    - name: site-a
+      host: nut-a.local
+    - name: site-b
+      host: nut-b.local
+update_interval: 60
+`)
+	flags := &ConfigFlags{ConfigPath: path}
+	config, err := LoadConfig(path, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetConfig(config)
+	nutServers = []*NUTServer{NewNUTServer(config.NUTServers[0]), NewNUTServer(config.NUTServers[1])}
+	siteA, siteB := nutServers[0], nutServers[1]
+
+	writeConfig(`
+mqtt:
+  host: broker.elsewhere
+nut:
+  servers:
+    - name: site-a
+      host: nut-a.local
+    - name: site-b
+      host: nut-b.local
+      ups_include: [rack1]
+    - name: site-c
+      host: nut-c.local
+update_interval: 30
+verbose: true
+`)
+	if !ReloadConfig(flags) {
+		t.Fatal("ReloadConfig() = false, want the new configuration to be applied")
+	}
+	config = *CurrentConfig()
+	if config.UpdateInterval != 30 || !config.Verbose || config.MQTTBrokerHost != "localhost" {
+		t.Errorf("config = %d %v %s, want the new interval and log level, and the MQTT broker kept", config.UpdateInterval, config.Verbose, config.MQTTBrokerHost)
+	}
+	if len(nutServers) != 3 || nutServers[0] != siteA || nutServers[1] == siteB || nutServers[2].Config.Name != "site-c" {
+		t.Fatalf("NUT servers = %v, want site-a kept, site-b replaced and site-c added", nutServers)
+	}
+
+	writeConfig("update_interval: 0\n")
+	servers := nutServers
+	if ReloadConfig(flags) {
+		t.Fatal("ReloadConfig() = true, want the invalid configuration to be rejected")
+	}
+	config = *CurrentConfig()
+	if config.UpdateInterval != 30 || len(nutServers) != 3 || nutServers[2] != servers[2] {
+		t.Errorf("config = %d with %d NUT servers, want the previous configuration kept", config.UpdateInterval, len(nutServers))
+	}
+}
+
+// Run with -race, as the handlers and reconnects read the configuration while it's being reloaded.
+func TestReloadConfigConcurrentReads(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	defer func(original *Config, originalServers []*NUTServer) {
+		SetConfig(*original)
+		nutServers = originalServers
+	}(CurrentConfig(), nutServers)
+
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	flags := &ConfigFlags{ConfigPath: path}
+	server := NewNUTServer(NUTServerConfig{Name: "site-a", Host: "nut-a.local", Port: 3493})
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := server.UPSTopic("rack1"); err != nil {
+				t.Error(err)
+				return
+			}
+			_ = NUTReconnectDelay(1)
+			_ = MQTTAvailabilityTopic()
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		text := fmt.Sprintf("nut:\n  servers:\n    - name: site-a\n      host: nut-a.local\n  reconnect_min_delay: %d\nupdate_interval: %d\n", i%3+1, 30+i)
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if !ReloadConfig(flags) {
+			t.Fatal("ReloadConfig() = false, want the new configuration to be applied")
+		}
+	}
+	close(done)
+	<-stopped
+
+	if config := CurrentConfig(); config.UpdateInterval != 49 || config.NUTReconnectMinDelay != 2 {
+		t.Errorf("config = %d, %d, want the last reloaded configuration", config.UpdateInterval, config.NUTReconnectMinDelay)
+	}
+}
+
+func TestReloadConfigSinks(t *testing.T) {
+	defer log.SetLevel(log.GetLevel())
+	defer func(original *Config, originalServers []*NUTServer, originalSinks []*SinkRunner) {
+		SetConfig(*original)
+		nutServers = originalServers
+		sinks = originalSinks
+	}(CurrentConfig(), nutServers, sinks)
+	sinks = nil
+
+	path := filepath.Join(t.TempDir(), "nuttyqt.yml")
+	flags := &ConfigFlags{ConfigPath: path}
+	reload := func(text string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if !ReloadConfig(flags) {
+			t.Fatal("ReloadConfig() = false, want the new configuration to be applied")
+		}
+	}
+	sinkNames := func() string {
+		names := []string{}
+		for _, runner := range currentSinks() {
+			names = append(names, runner.sink.Name())
+		}
+		return fmt.Sprint(names)
+	}
+
+	// Enabling InfluxDB and the metrics adds their sinks.
+	reload("influxdb:\n  url: http://127.0.0.1:1\n  database: nut\nmetrics:\n  listen: 127.0.0.1:0\n")
+	if names := sinkNames(); names != "[influxdb metrics]" {
+		t.Fatalf("sinks = %s, want the InfluxDB and metrics sinks added", names)
+	}
+	influxDB, metrics := currentSinks()[0], currentSinks()[1]
+
+	// Changing the InfluxDB settings replaces its sink, and disabling the metrics closes their sink.
+	reload("influxdb:\n  url: http://127.0.0.1:1\n  database: ups\n")
+	if names := sinkNames(); names != "[influxdb]" || currentSinks()[0] == influxDB {
+		t.Fatalf("sinks = %s, want the InfluxDB sink replaced and the metrics sink removed", names)
+	}
+	for _, runner := range []*SinkRunner{influxDB, metrics} {
+		select {
+		case <-runner.done:
+		default:
+			t.Errorf("sink %s is still running, want it closed", runner.sink.Name())
+		}
+	}
+	if server := metrics.sink.(*MetricsSink).server; server.ListenAndServe() != http.ErrServerClosed {
+		t.Error("metrics server is still serving, want it closed")
+	}
+
+	// Disabling InfluxDB removes its sink.
+	influxDB = currentSinks()[0]
+	reload("update_interval: 30\n")
+	if names := sinkNames(); names != "[]" {
+		t.Errorf("sinks = %s, want all sinks removed", names)
+	}
+	<-influxDB.done
+}
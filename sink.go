@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	nut "github.com/robbiet480/go.nut"
+)
+
+// Maximum number of polls and events that are queued for a sink, after which the oldest are dropped.
+const sinkQueueSize = 100
+
+// Time to write what is still queued for a sink that is replaced on reload, before closing it anyway.
+const sinkCloseTimeout = 5 * time.Second
+
+// Delays before retrying a failed write to a sink, doubling from the minimum to the maximum.
+var (
+	sinkRetryMinDelay = time.Second
+	sinkRetryMaxDelay = time.Minute
+)
+
+// Poll is the result of polling a NUT server.
+type Poll struct {
+	Server *NUTServer
+
+	// Monitored UPS devices of the NUT server, or nil if the poll failed.
+	UPSList []nut.UPS
+
+	// Time the NUT server was polled, and how long it took.
+	Timestamp time.Time
+	Duration  time.Duration
+
+	// Reason the poll failed, or nil if it succeeded.
+	Err error
+}
+
+// Sink receives the result of every poll and every event of the UPS devices, eg. the MQTT broker or InfluxDB.
+// Each sink runs in its own SinkRunner, so a slow or failing sink doesn't hold back the others.
+type Sink interface {
+	// Name of the sink, eg. "mqtt".
+	Name() string
+
+	// Write the result of a poll, including failed polls.
+	WritePoll(poll Poll) error
+
+	// Write an event of a UPS device of a NUT server.
+	WriteEvent(server *NUTServer, event UPSEvent) error
+
+	// Close the sink after the last poll and event have been written.
+	Close() error
+}
+
+// SinkHealth is the health status of a sink.
+type SinkHealth struct {
+	// Name of the sink.
+	Name string
+
+	// Whether the last write succeeded.
+	Healthy bool
+
+	// Number of polls and events that are waiting to be written.
+	Queued int
+
+	// Number of writes, failed writes, and polls and events that were dropped as the queue was full.
+	Writes  uint64
+	Errors  uint64
+	Dropped uint64
+
+	// Last error and when it happened, and the time of the last successful write.
+	LastError     string
+	LastErrorTime time.Time
+	LastSuccess   time.Time
+}
+
+// sinkItem is a poll or an event that is queued for a sink.
+type sinkItem struct {
+	poll   *Poll
+	server *NUTServer
+	event  *UPSEvent
+}
+
+// SinkRunner writes the polls and events to a sink in the background, in order, and keeps track of its health.
+// Failed writes are retried with exponential backoff, except for polls that a newer poll of the same NUT server supersedes.
+type SinkRunner struct {
+	sink Sink
+
+	// Delays before retrying a failed write.
+	retryMinDelay time.Duration
+	retryMaxDelay time.Duration
+
+	// Guards the queue and the health status.
+	mutex  sync.Mutex
+	queue  []sinkItem
+	health SinkHealth
+
+	// Wakes up the runner after an item has been queued.
+	wake chan struct{}
+
+	// Closed to stop the runner once the queue is empty, which closes done when it has stopped.
+	stop chan struct{}
+	done chan struct{}
+
+	// Closed to stop the runner right away, without writing or retrying the items that are still queued.
+	abort chan struct{}
+}
+
+// Sinks that the polls and events are written to, which are replaced as a whole on reload.
+var (
+	sinks      []*SinkRunner
+	sinksMutex sync.Mutex
+)
+
+// Start writing to a sink in the background.
+func NewSinkRunner(sink Sink) *SinkRunner {
+	runner := &SinkRunner{
+		sink:          sink,
+		retryMinDelay: sinkRetryMinDelay,
+		retryMaxDelay: sinkRetryMaxDelay,
+		health:        SinkHealth{Name: sink.Name(), Healthy: true},
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+		abort:         make(chan struct{}),
+	}
+	go runner.run()
+	return runner
+}
+
+// Queue a poll or an event, dropping the oldest queued item if the queue is full.
+func (runner *SinkRunner) enqueue(item sinkItem) {
+	runner.mutex.Lock()
+	if len(runner.queue) >= sinkQueueSize {
+		if runner.health.Dropped == 0 {
+			log.Warn("Queue of sink ", runner.health.Name, " is full, dropping the oldest polls and events ...")
+		}
+		runner.queue = runner.queue[1:]
+		runner.health.Dropped++
+	}
+	runner.queue = append(runner.queue, item)
+	runner.mutex.Unlock()
+
+	select {
+	case runner.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Queue the result of a poll.
+func (runner *SinkRunner) WritePoll(poll Poll) {
+	runner.enqueue(sinkItem{poll: &poll})
+}
+
+// Queue an event of a UPS device of a NUT server.
+func (runner *SinkRunner) WriteEvent(server *NUTServer, event UPSEvent) {
+	runner.enqueue(sinkItem{server: server, event: &event})
+}
+
+// Get the health status of the sink.
+func (runner *SinkRunner) Health() SinkHealth {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	health := runner.health
+	health.Queued = len(runner.queue)
+	return health
+}
+
+// Write the queued items until stopped, and then the items that are still queued, unless aborted.
+// A failed item is put back at the front of the queue to be retried, so the items are written in order.
+func (runner *SinkRunner) run() {
+	defer close(runner.done)
+	attempt := 0
+	for {
+		select {
+		case <-runner.abort:
+			return
+		default:
+		}
+
+		runner.mutex.Lock()
+		if len(runner.queue) == 0 {
+			runner.mutex.Unlock()
+			select {
+			case <-runner.wake:
+				continue
+			case <-runner.stop:
+				return
+			case <-runner.abort:
+				return
+			}
+		}
+		item := runner.queue[0]
+		runner.queue = runner.queue[1:]
+		runner.mutex.Unlock()
+
+		var err error
+		if item.poll != nil {
+			err = runner.sink.WritePoll(*item.poll)
+		} else {
+			err = runner.sink.WriteEvent(item.server, *item.event)
+		}
+		runner.record(err)
+
+		runner.mutex.Lock()
+		retry := err != nil && !runner.superseded(item)
+		if retry {
+			if len(runner.queue) < sinkQueueSize {
+				runner.queue = append([]sinkItem{item}, runner.queue...)
+			} else {
+				// The queue filled up during the write, and the failed item is the oldest.
+				runner.health.Dropped++
+				retry = false
+			}
+		}
+		runner.mutex.Unlock()
+		if !retry {
+			attempt = 0
+			continue
+		}
+
+		attempt++
+		delay := runner.retryMinDelay
+		for i := 1; i < attempt && delay < runner.retryMaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > runner.retryMaxDelay {
+			delay = runner.retryMaxDelay
+		}
+		log.Debug("Retrying the write to sink ", runner.sink.Name(), " in ", delay, " ...")
+		select {
+		case <-time.After(delay):
+		case <-runner.abort:
+			return
+		}
+	}
+}
+
+// Check whether a queued poll is superseded by a newer poll of the same NUT server, so it doesn't need to be retried.
+// Events are never superseded. Must be called with the mutex held.
+func (runner *SinkRunner) superseded(item sinkItem) bool {
+	if item.poll == nil {
+		return false
+	}
+	for _, queued := range runner.queue {
+		if queued.poll != nil && queued.poll.Server == item.poll.Server {
+			return true
+		}
+	}
+	return false
+}
+
+// Update the health status after a write, and log when the sink fails or recovers.
+func (runner *SinkRunner) record(err error) {
+	runner.mutex.Lock()
+	defer runner.mutex.Unlock()
+	health := &runner.health
+	health.Writes++
+	if err != nil {
+		health.Errors++
+		health.LastError, health.LastErrorTime = err.Error(), time.Now()
+		if health.Healthy {
+			log.Warn("Sink ", health.Name, " failed: ", err)
+		} else {
+			log.Debug("Sink ", health.Name, " failed again: ", err)
+		}
+		health.Healthy = false
+		return
+	}
+	if !health.Healthy {
+		log.Info("Sink ", health.Name, " recovered")
+	}
+	health.Healthy, health.LastSuccess = true, time.Now()
+}
+
+// Stop the runner after the queued items have been written, or the context is done, and close the sink.
+func (runner *SinkRunner) Close(ctx context.Context) error {
+	close(runner.stop)
+	select {
+	case <-runner.done:
+	case <-ctx.Done():
+		log.Warn("Timed out writing the queued polls and events to sink ", runner.sink.Name(), ", closing it anyway ...")
+		// Wait for a write that is still in progress, so the sink isn't closed in the middle of it.
+		close(runner.abort)
+		<-runner.done
+	}
+	return runner.sink.Close()
+}
+
+// Get the sinks that the polls and events are currently written to.
+func currentSinks() []*SinkRunner {
+	sinksMutex.Lock()
+	defer sinksMutex.Unlock()
+	return sinks
+}
+
+// Replace the sink with a name by a new runner, add the runner if there's no such sink, or remove the sink if the runner is nil.
+// The replaced sink is closed after writing its queued polls and events until the context is done.
+func ReplaceSink(ctx context.Context, name string, runner *SinkRunner) {
+	sinksMutex.Lock()
+	var replaced *SinkRunner
+	replacement := []*SinkRunner{}
+	for _, current := range sinks {
+		if current.sink.Name() != name {
+			replacement = append(replacement, current)
+			continue
+		}
+		replaced = current
+		if runner != nil {
+			replacement = append(replacement, runner)
+		}
+	}
+	if replaced == nil && runner != nil {
+		replacement = append(replacement, runner)
+	}
+	sinks = replacement
+	sinksMutex.Unlock()
+
+	switch {
+	case replaced == nil && runner != nil:
+		log.Info("Adding sink ", name, " ...")
+	case replaced != nil && runner != nil:
+		log.Info("Updating sink ", name, " ...")
+	case replaced != nil:
+		log.Info("Removing sink ", name, " ...")
+	}
+	if replaced != nil {
+		if err := replaced.Close(ctx); err != nil {
+			log.Warn("Failed to close sink ", name, ": ", err)
+		}
+	}
+}
+
+// Write the result of a poll to all sinks.
+func WritePollToSinks(poll Poll) {
+	for _, runner := range currentSinks() {
+		runner.WritePoll(poll)
+	}
+}
+
+// Write an event of a UPS device of a NUT server to all sinks.
+func WriteEventToSinks(server *NUTServer, event UPSEvent) {
+	for _, runner := range currentSinks() {
+		runner.WriteEvent(server, event)
+	}
+}
+
+// Close all sinks, after writing their queued polls and events until the context is done.
+func CloseSinks(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, runner := range currentSinks() {
+		wg.Add(1)
+		go func(runner *SinkRunner) {
+			defer wg.Done()
+			if err := runner.Close(ctx); err != nil {
+				log.Warn("Failed to close sink ", runner.sink.Name(), ": ", err)
+			}
+		}(runner)
+	}
+	wg.Wait()
+}
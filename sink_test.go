@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink records the polls and events written to it, and fails the writes with the given errors in order.
+type recordingSink struct {
+	mutex  sync.Mutex
+	errs   []error
+	polls  []Poll
+	events []UPSEvent
+	closed bool
+
+	// Blocks every write until it is closed, if set.
+	gate chan struct{}
+}
+
+func (sink *recordingSink) Name() string {
+	return "recording"
+}
+
+func (sink *recordingSink) write(record func()) error {
+	if sink.gate != nil {
+		<-sink.gate
+	}
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	record()
+	if len(sink.errs) > 0 {
+		err := sink.errs[0]
+		sink.errs = sink.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (sink *recordingSink) WritePoll(poll Poll) error {
+	return sink.write(func() { sink.polls = append(sink.polls, poll) })
+}
+
+func (sink *recordingSink) WriteEvent(server *NUTServer, event UPSEvent) error {
+	return sink.write(func() { sink.events = append(sink.events, event) })
+}
+
+func (sink *recordingSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.closed = true
+	return nil
+}
+
+func TestSinkRunner(t *testing.T) {
+	sink := &recordingSink{errs: []error{errors.New("broker is down"), nil}, gate: make(chan struct{})}
+	runner := NewSinkRunner(sink)
+	runner.WritePoll(Poll{Duration: 1})
+	runner.WritePoll(Poll{Duration: 2})
+	runner.WriteEvent(nil, UPSEvent{Event: "power_lost"})
+
+	// The failed poll isn't retried, as the second poll of the same NUT server is queued by then.
+	close(sink.gate)
+	if err := runner.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.polls) != 2 || sink.polls[0].Duration != 1 || sink.polls[1].Duration != 2 || len(sink.events) != 1 || !sink.closed {
+		t.Errorf("sink received %v and %v, closed %v, want both polls in order, the event and closed", sink.polls, sink.events, sink.closed)
+	}
+	health := runner.Health()
+	if !health.Healthy || health.Writes != 3 || health.Errors != 1 || health.LastError != "broker is down" || health.Queued != 0 {
+		t.Errorf("Health() = %+v, want healthy after recovering from 1 of 3 failed writes", health)
+	}
+}
+
+func TestSinkRunnerQueueFull(t *testing.T) {
+	sink := &recordingSink{gate: make(chan struct{})}
+	runner := NewSinkRunner(sink)
+
+	// The first poll blocks the sink, so the next ones are queued and the oldest of them is dropped.
+	runner.WritePoll(Poll{Duration: 0})
+	for i := 0; i < 50 && runner.Health().Queued > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 1; i <= sinkQueueSize+1; i++ {
+		runner.WritePoll(Poll{Duration: time.Duration(i)})
+	}
+	if health := runner.Health(); health.Queued != sinkQueueSize || health.Dropped != 1 {
+		t.Errorf("Health() = %+v, want a full queue and 1 dropped poll", health)
+	}
+
+	close(sink.gate)
+	if err := runner.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.polls) != sinkQueueSize+1 || sink.polls[1].Duration != 2 {
+		t.Errorf("sink received %d polls starting with %v, want %d polls without the dropped one", len(sink.polls), sink.polls[:2], sinkQueueSize+1)
+	}
+}
+
+func TestSinkRunnerRetry(t *testing.T) {
+	defer func(minDelay, maxDelay time.Duration) {
+		sinkRetryMinDelay, sinkRetryMaxDelay = minDelay, maxDelay
+	}(sinkRetryMinDelay, sinkRetryMaxDelay)
+	sinkRetryMinDelay, sinkRetryMaxDelay = time.Millisecond, 2*time.Millisecond
+
+	down := errors.New("broker is down")
+	sink := &recordingSink{errs: []error{down, down, nil, down, nil}}
+	runner := NewSinkRunner(sink)
+	runner.WriteEvent(nil, UPSEvent{Event: "power_lost"})
+	runner.WritePoll(Poll{Duration: 1})
+	if err := runner.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both the event and the latest poll are retried until they are written, in order.
+	if len(sink.events) != 3 || len(sink.polls) != 2 || sink.polls[1].Duration != 1 {
+		t.Errorf("sink received %d events and %v, want the event 3 times and the poll twice", len(sink.events), sink.polls)
+	}
+	if health := runner.Health(); !health.Healthy || health.Writes != 5 || health.Errors != 3 || health.Queued != 0 {
+		t.Errorf("Health() = %+v, want healthy after 3 of 5 failed writes", health)
+	}
+}
+
+func TestSinkRunnerCloseTimeout(t *testing.T) {
+	sink := &recordingSink{errs: []error{errors.New("broker is down")}, gate: make(chan struct{})}
+	runner := NewSinkRunner(sink)
+	runner.WriteEvent(nil, UPSEvent{Event: "power_lost"})
+
+	// The write is still in progress when the context is done, so the sink is only closed once it has finished.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sink.mutex.Lock()
+		closed := sink.closed
+		sink.mutex.Unlock()
+		if closed {
+			t.Error("sink was closed during a write")
+		}
+		close(sink.gate)
+	}()
+	if err := runner.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed event isn't retried after closing.
+	if len(sink.events) != 1 || !sink.closed {
+		t.Errorf("sink received %d events, closed %v, want 1 event and closed", len(sink.events), sink.closed)
+	}
+	if health := runner.Health(); health.Queued != 1 {
+		t.Errorf("Health() = %+v, want the failed event still queued", health)
+	}
+}
+
+func TestUpdateServer(t *testing.T) {
+	defer func(originalSinks []*SinkRunner) {
+		sinks = originalSinks
+	}(sinks)
+	sink := &recordingSink{}
+	sinks = []*SinkRunner{NewSinkRunner(sink)}
+
+	// A port that nothing listens on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	reachable := NewNUTServer(NUTServerConfig{Name: "reachable", Host: "127.0.0.1", Port: startTestFakeNUTServer(t)})
+	unreachable := NewNUTServer(NUTServerConfig{Name: "unreachable", Host: "127.0.0.1", Port: closedPort})
+	defer func() {
+		_ = reachable.Close()
+		_ = unreachable.Close()
+		upsDevicesMutex.Lock()
+		delete(upsDevices, reachable)
+		upsDevicesMutex.Unlock()
+	}()
+
+	// Polling works without an MQTT broker, as the result only goes to the sinks.
+	UpdateServer(reachable)
+	UpdateServer(unreachable)
+	CloseSinks(context.Background())
+
+	if len(sink.polls) != 2 {
+		t.Fatalf("sink received %d polls, want 2", len(sink.polls))
+	}
+	if poll := sink.polls[0]; poll.Server != reachable || poll.Err != nil || len(poll.UPSList) != 1 || poll.UPSList[0].Name != "FakeUPS" {
+		t.Errorf("poll of the reachable NUT server = %+v, want FakeUPS", poll)
+	}
+	if poll := sink.polls[1]; poll.Server != unreachable || poll.Err == nil || poll.UPSList != nil {
+		t.Errorf("poll of the unreachable NUT server = %+v, want an error", poll)
+	}
+}
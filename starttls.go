@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Create the TLS config of a NUT server, which verifies the NUT server against the CA bundle and/or the pinned fingerprint.
+// The CA bundle is read again for every connection, so a rotated CA bundle is used from the next reconnect onwards.
+func (server *NUTServer) tlsConfig() (*tls.Config, error) {
+	files, err := LoadTLSFiles(server.Config.TLSCA, "", "")
+	if err != nil {
+		return nil, err
+	}
+	var currentFiles atomic.Pointer[TLSFiles]
+	currentFiles.Store(files)
+
+	serverName := server.Config.TLSServerName
+	if serverName == "" {
+		serverName = server.Config.Host
+	}
+
+	// A pinned certificate is usually self-signed, so it's only verified against a CA bundle if one is set.
+	pinOnly := server.Config.TLSFingerprint != "" && server.Config.TLSCA == ""
+	tlsConfig := NewTLSConfig(&currentFiles, serverName, tls.VersionTLS12, pinOnly)
+	if server.Config.TLSFingerprint != "" {
+		fingerprint, err := ParseTLSFingerprint(server.Config.TLSFingerprint)
+		if err != nil {
+			return nil, err
+		}
+		PinTLSFingerprint(tlsConfig, fingerprint)
+	}
+	return tlsConfig, nil
+}
+
+// Connect to the NUT server and upgrade the connection to TLS with STARTTLS,
+// so the NUT client authenticates and sends every command over TLS.
+func (server *NUTServer) dialStartTLS() (*NUTClient, error) {
+	tlsConfig, err := server.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := DialNUT(server.Config.Host, server.Config.Port)
+	if err != nil {
+		return nil, err
+	}
+	// The NUT server doesn't send anything else until the TLS handshake, so nothing is lost in the buffer of the client.
+	response, err := client.SendCommand("STARTTLS")
+	var nutErr *NUTError
+	if errors.As(err, &nutErr) {
+		client.Close()
+		return nil, fmt.Errorf("NUT server refused STARTTLS: %w", err)
+	} else if err != nil {
+		client.Close()
+		return nil, err
+	} else if !strings.HasPrefix(response[0], "OK STARTTLS") {
+		client.Close()
+		return nil, fmt.Errorf("unexpected response to STARTTLS: %q", response[0])
+	}
+	tlsConn := tls.Client(client.conn, tlsConfig)
+	_ = tlsConn.SetDeadline(time.Now().Add(nutTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	log.Debug(fmt.Sprintf("Negotiated %s with NUT server %s", tls.VersionName(tlsConn.ConnectionState().Version), server.Config.Name))
+	return NewNUTClient(tlsConn), nil
+}
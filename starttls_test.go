@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fingerprint of the test certificate of the fake NUT server.
+const fakeNUTFingerprint = "48:AB:FF:D5:C0:09:EF:A3:76:D5:AF:39:07:E2:37:FD:1A:E4:9C:D1:50:D6:1C:BD:36:B2:AC:25:9E:F2:90:C8"
+
+// Start a fake NUT server on a free port, and return the port.
+func startTestFakeNUTServer(t *testing.T, setup ...func(*FakeNUTServer)) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	fakeNUTServer := NewFakeNUTServer()
+	fakeNUTServer.Host, fakeNUTServer.Port = "127.0.0.1", strconv.Itoa(port)
+	for _, setupFunc := range setup {
+		setupFunc(fakeNUTServer)
+	}
+	go func() { _ = fakeNUTServer.Start() }()
+	t.Cleanup(func() { _ = fakeNUTServer.Stop() })
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", fakeNUTServer.Port)); err == nil {
+			conn.Close()
+			return port
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("fake NUT server didn't start")
+	return 0
+}
+
+func TestNUTServerStartTLS(t *testing.T) {
+	port := startTestFakeNUTServer(t)
+
+	tests := []struct {
+		name   string
+		config NUTServerConfig
+		err    string
+	}{
+		{"pinned certificate", NUTServerConfig{StartTLS: true, TLSFingerprint: fakeNUTFingerprint, User: "fakeuser", Pass: "fakepass"}, ""},
+		{"wrong fingerprint", NUTServerConfig{StartTLS: true, TLSFingerprint: strings.Repeat("00", 32), User: "fakeuser", Pass: "fakepass"}, "doesn't match the pinned fingerprint"},
+		{"unknown CA", NUTServerConfig{StartTLS: true}, "certificate signed by unknown authority"},
+		{"cleartext credentials", NUTServerConfig{User: "fakeuser", Pass: "fakepass"}, "refusing to send the credentials"},
+		{"allowed cleartext credentials", NUTServerConfig{User: "fakeuser", Pass: "fakepass", AllowCleartextAuth: true}, ""},
+	}
+	for _, test := range tests {
+		test.config.Host, test.config.Port = "127.0.0.1", port
+		server := NewNUTServer(test.config)
+		upsList, err := server.ListUPS()
+		_ = server.Close()
+		if test.err == "" && (err != nil || len(upsList) != 1 || upsList[0].Name != "FakeUPS") {
+			t.Errorf("%s: ListUPS() = %v, %v, want FakeUPS", test.name, upsList, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: ListUPS() error = %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParseTLSFingerprint(t *testing.T) {
+	colons, err := ParseTLSFingerprint(fakeNUTFingerprint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ParseTLSFingerprint(strings.ToLower(strings.ReplaceAll(fakeNUTFingerprint, ":", "")))
+	if err != nil || string(plain) != string(colons) {
+		t.Errorf("ParseTLSFingerprint() without colons = %X, %v, want %X", plain, err, colons)
+	}
+	if _, err := ParseTLSFingerprint("48:AB"); err == nil {
+		t.Error("ParseTLSFingerprint(48:AB) = nil error, want an invalid fingerprint")
+	}
+}
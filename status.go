@@ -0,0 +1,95 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// UPSStatus is the decoded "ups.status" variable of a UPS device, eg. "OL CHRG".
+type UPSStatus struct {
+	Online         bool `json:"online"`
+	OnBattery      bool `json:"on_battery"`
+	LowBattery     bool `json:"low_battery"`
+	HighBattery    bool `json:"high_battery"`
+	Charging       bool `json:"charging"`
+	Discharging    bool `json:"discharging"`
+	ReplaceBattery bool `json:"replace_battery"`
+	Overloaded     bool `json:"overloaded"`
+	Bypass         bool `json:"bypass"`
+	Boost          bool `json:"boost"`
+	Trim           bool `json:"trim"`
+	Off            bool `json:"off"`
+	Calibrating    bool `json:"calibrating"`
+	ForcedShutdown bool `json:"forced_shutdown"`
+
+	// Status flags that aren't known to nuttyqt, eg. "TEST" or driver specific flags.
+	Unknown []string `json:"unknown"`
+}
+
+// Decode the flags of a "ups.status" variable, as described in the NUT developer guide.
+func DecodeUPSStatus(status string) UPSStatus {
+	decoded := UPSStatus{Unknown: []string{}}
+	for _, flag := range strings.Fields(status) {
+		switch flag {
+		case "OL":
+			decoded.Online = true
+		case "OB":
+			decoded.OnBattery = true
+		case "LB":
+			decoded.LowBattery = true
+		case "HB":
+			decoded.HighBattery = true
+		case "CHRG":
+			decoded.Charging = true
+		case "DISCHRG":
+			decoded.Discharging = true
+		case "RB":
+			decoded.ReplaceBattery = true
+		case "OVER":
+			decoded.Overloaded = true
+		case "BYPASS":
+			decoded.Bypass = true
+		case "BOOST":
+			decoded.Boost = true
+		case "TRIM":
+			decoded.Trim = true
+		case "OFF":
+			decoded.Off = true
+		case "CAL":
+			decoded.Calibrating = true
+		case "FSD":
+			decoded.ForcedShutdown = true
+		default:
+			decoded.Unknown = append(decoded.Unknown, flag)
+		}
+	}
+	return decoded
+}
+
+// Matches the bracketed alarms that some drivers use, eg. "[Replace battery!] [Overload]".
+var upsAlarmBrackets = regexp.MustCompile(`\[([^\]]*)\]`)
+
+// Matches the end of an alarm in a list of alarms separated by spaces, eg. "Replace battery! Overload!".
+var upsAlarmSeparator = regexp.MustCompile(`!\s+`)
+
+// Decode the "ups.alarm" variable into a list of alarms, as drivers join multiple alarms into a single line.
+func DecodeUPSAlarms(alarm string) []string {
+	alarms := []string{}
+	var parts []string
+	if matches := upsAlarmBrackets.FindAllStringSubmatch(alarm, -1); len(matches) > 0 {
+		for _, match := range matches {
+			parts = append(parts, match[1])
+		}
+	} else {
+		parts = upsAlarmSeparator.Split(alarm, -1)
+		for i := 0; i < len(parts)-1; i++ {
+			parts[i] += "!"
+		}
+	}
+	for _, part := range parts {
+		if part = strings.TrimSpace(part); part != "" {
+			alarms = append(alarms, part)
+		}
+	}
+	return alarms
+}
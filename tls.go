@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// TLS versions by the names used in the configuration.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Get a TLS version by its name, eg. "1.2".
+func ParseTLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q, use 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+// TLSFiles are the certificates loaded from the CA bundle and client certificate files of a TLS connection.
+type TLSFiles struct {
+	// Certificate authorities to verify the server with, or nil to use the system roots.
+	RootCAs *x509.CertPool
+
+	// Client certificate for mutual TLS, or nil to not send one.
+	Certificate *tls.Certificate
+}
+
+// Load the certificates of a TLS connection from a CA bundle and a client certificate and key, all of which are optional.
+func LoadTLSFiles(caPath string, certPath string, keyPath string) (*TLSFiles, error) {
+	files := &TLSFiles{}
+	if caPath != "" {
+		pem, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		files.RootCAs = x509.NewCertPool()
+		if !files.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", caPath)
+		}
+	}
+	if (certPath == "") != (keyPath == "") {
+		return nil, errors.New("the client certificate and key must be set together")
+	}
+	if certPath != "" {
+		certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		files.Certificate = &certificate
+	}
+	return files, nil
+}
+
+// Create the TLS config of a connection, which uses the certificates that are current at the time of each handshake,
+// so they can be replaced, eg. after a certificate has been rotated, without creating a new connection.
+// The server name is the host name or IP address that the certificate of the server is verified for.
+func NewTLSConfig(files *atomic.Pointer[TLSFiles], serverName string, minVersion uint16, insecure bool) *tls.Config {
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+		MinVersion: minVersion,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if certificate := files.Load().Certificate; certificate != nil {
+				return certificate, nil
+			}
+			return &tls.Certificate{}, nil
+		},
+
+		// The server is verified by hand against the current CA bundle, or the system roots without one,
+		// as the CA bundle of a TLS config can't be replaced. The checks are the same as the default verification.
+		// #nosec G402 -- Verification is only skipped entirely when insecure is explicitly enabled, which is warned about.
+		InsecureSkipVerify: true,
+	}
+	if insecure {
+		return tlsConfig
+	}
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("server didn't present a certificate")
+		}
+		options := x509.VerifyOptions{
+			DNSName:       serverName,
+			Roots:         files.Load().RootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, certificate := range state.PeerCertificates[1:] {
+			options.Intermediates.AddCert(certificate)
+		}
+		_, err := state.PeerCertificates[0].Verify(options)
+		return err
+	}
+	return tlsConfig
+}
+
+// Parse the SHA-256 fingerprint of a certificate, eg. "48:AB:FF:..." as printed by "openssl x509 -noout -fingerprint -sha256".
+func ParseTLSFingerprint(fingerprint string) ([]byte, error) {
+	digest, err := hex.DecodeString(strings.ReplaceAll(fingerprint, ":", ""))
+	if err != nil || len(digest) != sha256.Size {
+		return nil, fmt.Errorf("%q is not a SHA-256 fingerprint, eg. 48:AB:FF:...", fingerprint)
+	}
+	return digest, nil
+}
+
+// Pin the certificate of the server of a TLS config to a SHA-256 fingerprint,
+// in addition to the verification of the TLS config, if any.
+func PinTLSFingerprint(tlsConfig *tls.Config, fingerprint []byte) {
+	verifyConnection := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("server didn't present a certificate")
+		}
+		digest := sha256.Sum256(state.PeerCertificates[0].Raw)
+		if subtle.ConstantTimeCompare(digest[:], fingerprint) != 1 {
+			return fmt.Errorf("certificate fingerprint %X doesn't match the pinned fingerprint %X", digest, fingerprint)
+		}
+		if verifyConnection != nil {
+			return verifyConnection(state)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Create a certificate for the given names, signed by the parent certificate, or self-signed as a CA without one.
+func newTestCertificate(t *testing.T, parent *tls.Certificate, names ...string) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "nuttyqt test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     names,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	ca, otherCA := newTestCertificate(t, nil), newTestCertificate(t, nil)
+	serverCertificate := newTestCertificate(t, ca, "broker.test")
+	clientCertificate := newTestCertificate(t, ca, "nuttyqt")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{*serverCertificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	pool := func(certificate *tls.Certificate) *x509.CertPool {
+		pool := x509.NewCertPool()
+		pool.AddCert(certificate.Leaf)
+		return pool
+	}
+	tests := []struct {
+		name       string
+		files      TLSFiles
+		serverName string
+		insecure   bool
+		ok         bool
+	}{
+		{"trusted CA", TLSFiles{RootCAs: pool(ca), Certificate: clientCertificate}, "broker.test", false, true},
+		{"unknown CA", TLSFiles{RootCAs: pool(otherCA), Certificate: clientCertificate}, "broker.test", false, false},
+		{"wrong server name", TLSFiles{RootCAs: pool(ca), Certificate: clientCertificate}, "other.test", false, false},
+		{"insecure", TLSFiles{RootCAs: pool(otherCA), Certificate: clientCertificate}, "other.test", true, true},
+		{"no client certificate", TLSFiles{RootCAs: pool(ca)}, "broker.test", false, false},
+	}
+	for _, test := range tests {
+		var files atomic.Pointer[TLSFiles]
+		files.Store(&test.files)
+		conn, err := tls.Dial("tcp", listener.Addr().String(), NewTLSConfig(&files, test.serverName, tls.VersionTLS12, test.insecure))
+		if err == nil {
+			// The server only rejects a missing client certificate after the handshake of TLS 1.3.
+			_, err = conn.Read(make([]byte, 1))
+			if errors.Is(err, io.EOF) {
+				err = nil
+			}
+			conn.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%s: handshake error = %v, want ok = %v", test.name, err, test.ok)
+		}
+	}
+
+	// Replacing the certificates applies to the next handshake of the same TLS config.
+	var files atomic.Pointer[TLSFiles]
+	files.Store(&TLSFiles{RootCAs: pool(otherCA), Certificate: clientCertificate})
+	tlsConfig := NewTLSConfig(&files, "broker.test", tls.VersionTLS12, false)
+	files.Store(&TLSFiles{RootCAs: pool(ca), Certificate: clientCertificate})
+	conn, err := tls.Dial("tcp", listener.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatalf("handshake after replacing the CA bundle = %v, want ok", err)
+	}
+	conn.Close()
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	if version, err := ParseTLSVersion("1.3"); err != nil || version != tls.VersionTLS13 {
+		t.Errorf("ParseTLSVersion(1.3) = %v, %v, want TLS 1.3", version, err)
+	}
+	if _, err := ParseTLSVersion("1.4"); err == nil {
+		t.Error("ParseTLSVersion(1.4) = nil error, want an unsupported version")
+	}
+}